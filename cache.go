@@ -0,0 +1,156 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// cacheKey records the state of a regular file when it was digested. Along
+// with the size, it is used to detect whether a file has changed since
+// without reading it.
+type cacheKey struct {
+	inode        uint64
+	mtime, ctime time.Time
+}
+
+// newCacheKey returns the cache key for the file described by fi.
+func newCacheKey(fi os.FileInfo) (*cacheKey, error) {
+	inode, err := statInode(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ctime, err := statTimes(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheKey{
+		inode: inode,
+		mtime: fi.ModTime(),
+		ctime: ctime,
+	}, nil
+}
+
+// matches returns true if k and other describe the same state of a file. The
+// change time is only compared if strict is set.
+func (k *cacheKey) matches(other *cacheKey, strict bool) bool {
+	if k.inode != other.inode || !k.mtime.Equal(other.mtime) {
+		return false
+	}
+
+	return !strict || k.ctime.Equal(other.ctime)
+}
+
+// cachedResourcer is implemented by contexts which can create a regular file
+// resource from known digests, without reading the file.
+type cachedResourcer interface {
+	cachedResource(p string, fi os.FileInfo, dgsts []digest.Digest) (Resource, error)
+}
+
+// digestCache provides the digests of regular files recorded in a previous
+// manifest.
+type digestCache struct {
+	files  map[string]*regularFile
+	strict bool
+}
+
+func newDigestCache(m *Manifest, strict bool) *digestCache {
+	dc := &digestCache{
+		files:  map[string]*regularFile{},
+		strict: strict,
+	}
+
+	for _, rsrc := range m.Resources {
+		rf, ok := rsrc.(*regularFile)
+		if !ok || rf.key == nil || len(rf.digests) == 0 {
+			continue
+		}
+
+		for _, p := range rf.paths {
+			dc.files[p] = rf
+		}
+	}
+
+	return dc
+}
+
+// lookup returns the digests recorded for the file at p, if the file
+// described by fi and key is unchanged since they were recorded.
+func (dc *digestCache) lookup(p string, fi os.FileInfo, key *cacheKey) []digest.Digest {
+	if dc == nil {
+		return nil
+	}
+
+	rf, ok := dc.files[p]
+	if !ok || !fi.Mode().IsRegular() || rf.size != fi.Size() {
+		return nil
+	}
+
+	if !rf.key.matches(key, dc.strict) {
+		return nil
+	}
+
+	return rf.digests
+}
+
+// resourceResolver returns a function resolving resources from fsContext
+// according to opts, recording cache keys and reusing digests from a
+// previous manifest where requested. Like Context.Resource, fi may be nil,
+// in which case no cache key is recorded.
+func resourceResolver(fsContext Context, opts BuildOptions) func(p string, fi os.FileInfo) (Resource, error) {
+	if opts.Previous == nil && !opts.CacheKeys {
+		return fsContext.Resource
+	}
+
+	var cache *digestCache
+	if opts.Previous != nil {
+		cache = newDigestCache(opts.Previous, opts.StrictCache)
+	}
+
+	return func(p string, fi os.FileInfo) (Resource, error) {
+		if fi == nil || !fi.Mode().IsRegular() {
+			return fsContext.Resource(p, fi)
+		}
+
+		key, err := newCacheKey(fi)
+		if err != nil {
+			return nil, err
+		}
+
+		var rsrc Resource
+		cr, ok := fsContext.(cachedResourcer)
+		if dgsts := cache.lookup(p, fi, key); ok && dgsts != nil {
+			rsrc, err = cr.cachedResource(p, fi, dgsts)
+		} else {
+			rsrc, err = fsContext.Resource(p, fi)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if rf, ok := rsrc.(*regularFile); ok {
+			rf.key = key
+		}
+
+		return rsrc, nil
+	}
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"sort"
+
+	pb "github.com/containerd/continuity/proto"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/proto"
+)
+
+// MarshalCanonical encodes the manifest in its canonical form, which is the
+// same for any two encodings of the same manifest. Resources are sorted by
+// path, as are the paths of hardlinked resources, and the digests and xattrs
+// of each resource are sorted. Cache keys describe the system a manifest was
+// built on rather than the tree and are omitted. The header is included, with
+// the tool and annotations recorded by the builder, so manifests of the same
+// tree built by different tools differ; TreeDigest identifies the tree alone.
+//
+// The canonical form is a valid binary manifest and can be decoded with
+// Unmarshal.
+func MarshalCanonical(m *Manifest) ([]byte, error) {
+	return marshalCanonical(m, toProtoHeader(manifestHeader(m)))
+}
+
+// Digest returns the digest of the canonical encoding of the manifest,
+// including its whole header. Signatures cover this digest.
+func (m *Manifest) Digest() (digest.Digest, error) {
+	p, err := MarshalCanonical(m)
+	if err != nil {
+		return "", err
+	}
+
+	return digest.FromBytes(p), nil
+}
+
+// TreeDigest returns the digest identifying the tree the manifest describes,
+// which is the same for any two manifests of the same tree. It is the digest
+// of the canonical encoding with only the root attributes and digest
+// algorithms of the header, leaving out the schema version, tool and
+// annotations.
+func (m *Manifest) TreeDigest() (digest.Digest, error) {
+	var header *pb.Header
+	if h := manifestHeader(m); h != nil {
+		b := toProtoHeader(h)
+		header = &pb.Header{
+			DigestAlgorithm: b.DigestAlgorithm,
+			Root:            b.Root,
+		}
+	}
+
+	p, err := marshalCanonical(m, header)
+	if err != nil {
+		return "", err
+	}
+
+	return digest.FromBytes(p), nil
+}
+
+func marshalCanonical(m *Manifest, header *pb.Header) ([]byte, error) {
+	bm := &pb.Manifest{
+		Header: header,
+	}
+
+	for _, rsrc := range m.Resources {
+		// toProto sorts the paths and xattrs.
+		b := toProto(rsrc)
+		b.CacheKey = nil
+		sort.Strings(b.Digest)
+
+		bm.Resource = append(bm.Resource, b)
+	}
+
+	sort.SliceStable(bm.Resource, func(i, j int) bool {
+		return firstPath(bm.Resource[i]) < firstPath(bm.Resource[j])
+	})
+
+	if bm.Header != nil {
+		sort.Strings(bm.Header.DigestAlgorithm)
+	}
+
+	// Deterministic encoding orders the annotations.
+	return proto.MarshalOptions{Deterministic: true}.Marshal(bm)
+}
+
+// firstPath returns the first of the sorted paths of the resource.
+func firstPath(b *pb.Resource) string {
+	if len(b.Path) == 0 {
+		return ""
+	}
+
+	return b.Path[0]
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	_ "crypto/sha512"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestManifestDigest(t *testing.T) {
+	sha256, sha512 := digest.FromString("abc"), digest.SHA512.FromString("abc")
+
+	build := func(paths []string, dgsts []digest.Digest, key *cacheKey, reverse bool) *Manifest {
+		t.Helper()
+
+		dir, err := newDirectory(resource{
+			paths:  []string{"/a"},
+			mode:   os.ModeDir | 0o755,
+			xattrs: map[string][]byte{"user.a": []byte("a"), "user.b": []byte("b"), "user.c": []byte("c")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rf := &regularFile{
+			resource: resource{paths: paths, mode: 0o644},
+			size:     3,
+			digests:  dgsts,
+			key:      key,
+		}
+
+		m := &Manifest{
+			Header: &Header{
+				Version:          ManifestVersion,
+				DigestAlgorithms: []digest.Algorithm{digest.SHA256, digest.SHA512},
+				Annotations:      map[string]string{"a": "1", "b": "2", "c": "3"},
+			},
+			Resources: []Resource{dir, rf},
+		}
+		if reverse {
+			m.Resources = []Resource{rf, dir}
+		}
+
+		return m
+	}
+
+	expected := build([]string{"/a/b", "/a/c"}, []digest.Digest{sha256, sha512}, nil, false)
+	canonical, err := MarshalCanonical(expected)
+	if err != nil {
+		t.Fatalf("error encoding manifest: %v", err)
+	}
+	dgst, err := expected.Digest()
+	if err != nil {
+		t.Fatalf("error digesting manifest: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		m    *Manifest
+	}{
+		{"same", build([]string{"/a/b", "/a/c"}, []digest.Digest{sha256, sha512}, nil, false)},
+		{"resource order", build([]string{"/a/b", "/a/c"}, []digest.Digest{sha256, sha512}, nil, true)},
+		{"hardlink order", build([]string{"/a/c", "/a/b"}, []digest.Digest{sha256, sha512}, nil, false)},
+		{"digest order", build([]string{"/a/b", "/a/c"}, []digest.Digest{sha512, sha256}, nil, false)},
+		{"cache key", build([]string{"/a/b", "/a/c"}, []digest.Digest{sha256, sha512}, &cacheKey{inode: 42}, false)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := MarshalCanonical(tc.m)
+			if err != nil {
+				t.Fatalf("error encoding manifest: %v", err)
+			}
+			if !bytes.Equal(p, canonical) {
+				t.Fatal("canonical encodings differ")
+			}
+
+			d, err := tc.m.Digest()
+			if err != nil {
+				t.Fatalf("error digesting manifest: %v", err)
+			}
+			if d != dgst {
+				t.Fatalf("digests differ: %v != %v", d, dgst)
+			}
+		})
+	}
+
+	changed := build([]string{"/a/b", "/a/d"}, []digest.Digest{sha256, sha512}, nil, false)
+	if d, err := changed.Digest(); err != nil || d == dgst {
+		t.Fatalf("expected a different digest for a different tree: %v, %v", d, err)
+	}
+
+	decoded, err := Unmarshal(canonical)
+	if err != nil {
+		t.Fatalf("error decoding canonical manifest: %v", err)
+	}
+	if d, err := decoded.Digest(); err != nil || d != dgst {
+		t.Fatalf("decoded manifest has digest %v, expected %v: %v", d, dgst, err)
+	}
+}
+
+func TestManifestTreeDigest(t *testing.T) {
+	build := func(header *Header) *Manifest {
+		t.Helper()
+
+		rf, err := newRegularFile(resource{paths: []string{"/a"}, mode: 0o644}, []string{"/a"}, 3, digest.FromString("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &Manifest{Header: header, Resources: []Resource{rf}}
+	}
+
+	root := &RootInfo{Mode: os.ModeDir | 0o755}
+	library := build(&Header{
+		Version:          ManifestVersion,
+		DigestAlgorithms: []digest.Algorithm{digest.SHA256},
+		Root:             root,
+	})
+	cli := build(&Header{
+		Version:          ManifestVersion,
+		Tool:             "continuity",
+		DigestAlgorithms: []digest.Algorithm{digest.SHA256},
+		Root:             root,
+		Annotations:      map[string]string{"a": "1"},
+	})
+
+	// the builder metadata is signed, but does not describe the tree.
+	d1, err := library.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := cli.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 == d2 {
+		t.Fatal("expected manifest digests to cover the tool and annotations")
+	}
+
+	t1, err := library.TreeDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := cli.TreeDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t1 != t2 {
+		t.Fatalf("tree digests differ: %v != %v", t1, t2)
+	}
+
+	other := build(&Header{
+		Version:          ManifestVersion,
+		DigestAlgorithms: []digest.Algorithm{digest.SHA256},
+		Root:             &RootInfo{Mode: os.ModeDir | 0o700},
+	})
+	if d, err := other.TreeDigest(); err != nil || d == t1 {
+		t.Fatalf("expected a different tree digest for a different root: %v, %v", d, err)
+	}
+}
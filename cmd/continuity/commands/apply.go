@@ -17,6 +17,8 @@
 package commands
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 
@@ -24,29 +26,154 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var ApplyCmd = &cobra.Command{
-	Use:   "apply <root> [<manifest>]",
-	Short: "Apply the manifest to the provided root",
-	Run: func(cmd *cobra.Command, args []string) {
-		root, path := args[0], args[1]
+var (
+	applyCmdConfig struct {
+		prune         bool
+		transactional bool
+		dryRun        bool
+		format        string
+		store         string
+		ociLayout     string
+		include       []string
+		exclude       []string
+		excludeFrom   string
+		uidMap        []string
+		gidMap        []string
+		rootless      bool
+		names         bool
+	}
 
-		p, err := os.ReadFile(path)
+	ApplyCmd = &cobra.Command{
+		Use:   "apply <root> [<manifest>]",
+		Short: "Apply the manifest to the provided root",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runApply(args[0], args[1]); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+)
+
+// runApply applies the manifest at path to root, returning rather than exiting
+// on errors so that the manifest and content provider are closed.
+func runApply(root, path string) error {
+	mr, closer, err := openManifest(path)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	defer closer.Close()
+
+	contextOptions := continuity.ContextOptions{
+		Rootless: applyCmdConfig.rootless,
+		Names:    applyCmdConfig.names,
+	}
+	if contextOptions.UIDMap, err = parseIDMaps(applyCmdConfig.uidMap); err != nil {
+		return fmt.Errorf("error parsing --uidmap: %w", err)
+	}
+	if contextOptions.GIDMap, err = parseIDMaps(applyCmdConfig.gidMap); err != nil {
+		return fmt.Errorf("error parsing --gidmap: %w", err)
+	}
+
+	switch {
+	case applyCmdConfig.store != "" && applyCmdConfig.ociLayout != "":
+		return fmt.Errorf("--store and --oci-layout cannot be combined")
+	case applyCmdConfig.store != "":
+		contextOptions.Provider, err = continuity.NewContentStore(applyCmdConfig.store)
 		if err != nil {
-			log.Fatalf("error reading manifest: %v", err)
+			return fmt.Errorf("error opening content store: %w", err)
 		}
-
-		m, err := continuity.Unmarshal(p)
+	case applyCmdConfig.ociLayout != "":
+		provider, err := continuity.NewOCILayoutProvider(applyCmdConfig.ociLayout)
 		if err != nil {
-			log.Fatalf("error unmarshaling manifest: %v", err)
+			return fmt.Errorf("error opening OCI layout: %w", err)
+		}
+		defer provider.Close()
+		if err := provider.IndexLayers(); err != nil {
+			return fmt.Errorf("error indexing OCI layout: %w", err)
 		}
+		contextOptions.Provider = provider
+	}
 
-		ctx, err := continuity.NewContext(root)
+	ctx, err := continuity.NewContextWithOptions(root, contextOptions)
+	if err != nil {
+		return fmt.Errorf("error getting context: %w", err)
+	}
+
+	filter, err := newFilter(applyCmdConfig.include, applyCmdConfig.exclude, applyCmdConfig.excludeFrom)
+	if err != nil {
+		return fmt.Errorf("error parsing filter: %w", err)
+	}
+
+	opts := continuity.ApplyOptions{
+		Prune:         applyCmdConfig.prune,
+		Transactional: applyCmdConfig.transactional,
+		Filter:        filter,
+	}
+
+	if applyCmdConfig.dryRun {
+		operations, err := continuity.PlanManifestStream(ctx, mr, opts)
 		if err != nil {
-			log.Fatalf("error getting context: %v", err)
+			return fmt.Errorf("error planning manifest: %w", err)
 		}
 
-		if err := continuity.ApplyManifest(ctx, m); err != nil {
-			log.Fatalf("error applying manifest: %v", err)
+		return printOperations(operations, applyCmdConfig.format)
+	}
+
+	if err := continuity.ApplyManifestStreamWithOptions(ctx, mr, opts); err != nil {
+		return fmt.Errorf("error applying manifest: %w", err)
+	}
+
+	return nil
+}
+
+func init() {
+	ApplyCmd.Flags().StringVar(&applyCmdConfig.store, "store", "", "restore file content from a content store directory")
+	ApplyCmd.Flags().StringVar(&applyCmdConfig.ociLayout, "oci-layout", "", "restore file content from the blobs and layers of an OCI image layout")
+	ApplyCmd.Flags().BoolVar(&applyCmdConfig.prune, "prune", false, "remove files, xattrs and mismatched entries not in the manifest")
+	ApplyCmd.Flags().BoolVar(&applyCmdConfig.transactional, "transactional", false, "roll back all changes if the manifest cannot be applied completely")
+	ApplyCmd.Flags().StringArrayVar(&applyCmdConfig.include, "include", nil, "only apply paths matching the pattern (can be repeated)")
+	ApplyCmd.Flags().StringArrayVar(&applyCmdConfig.exclude, "exclude", nil, "leave paths matching the pattern untouched (can be repeated)")
+	ApplyCmd.Flags().StringVar(&applyCmdConfig.excludeFrom, "exclude-from", "", "read exclude patterns from a file, one per line")
+	ApplyCmd.Flags().StringArrayVar(&applyCmdConfig.uidMap, "uidmap", nil, "map container uids of the manifest to host uids, as container:host:size or a uid_map file (can be repeated)")
+	ApplyCmd.Flags().StringArrayVar(&applyCmdConfig.gidMap, "gidmap", nil, "map container gids of the manifest to host gids, as container:host:size or a gid_map file (can be repeated)")
+	ApplyCmd.Flags().BoolVar(&applyCmdConfig.rootless, "rootless", false, "record owners, modes and devices in the user.containers.override_stat xattr rather than applying them")
+	ApplyCmd.Flags().BoolVar(&applyCmdConfig.names, "names", false, "own files by the ids that recorded user and group names have in the etc/passwd and etc/group files of the root")
+	ApplyCmd.Flags().BoolVar(&applyCmdConfig.dryRun, "dry-run", false, "print the operations apply would perform without modifying the root")
+	ApplyCmd.Flags().StringVar(&applyCmdConfig.format, "format", "text", "specify the output format of --dry-run (text, json)")
+}
+
+// operationEntry is the JSON representation of a continuity.Operation.
+type operationEntry struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func printOperations(operations []continuity.Operation, format string) error {
+	switch format {
+	case "text":
+		for _, op := range operations {
+			fmt.Fprintln(os.Stdout, op)
+		}
+	case "json":
+		entries := make([]operationEntry, 0, len(operations))
+		for _, op := range operations {
+			entries = append(entries, operationEntry{
+				Op:     op.Kind.String(),
+				Path:   op.Path,
+				Detail: op.Detail,
+			})
 		}
-	},
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(entries); err != nil {
+			return fmt.Errorf("error encoding operations: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	return nil
 }
@@ -17,48 +17,277 @@
 package commands
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
 
 	"github.com/containerd/continuity"
+	"github.com/opencontainers/go-digest"
 	"github.com/spf13/cobra"
 )
 
+// buildTool identifies the command in the header of the manifests it builds.
+const buildTool = "continuity"
+
 var (
 	buildCmdConfig struct {
-		format string
+		format      string
+		stream      bool
+		timestamps  []string
+		concurrency int
+		cache       string
+		cacheStrict bool
+		store       string
+		tar         bool
+		overlay     bool
+		annotations map[string]string
+		include     []string
+		exclude     []string
+		excludeFrom string
+		uidMap      []string
+		gidMap      []string
+		rootless    bool
+		names       bool
 	}
 
 	BuildCmd = &cobra.Command{
 		Use:   "build <root>",
 		Short: "Build a manifest for the provided root",
+		Long: `Build a manifest for the provided root. With --tar, the argument is a tar
+archive, optionally gzip or zstd compressed, or - to read the archive from stdin. The
+manifest describes the tree the archive would extract to.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(args) != 1 {
 				log.Fatalln("please specify a root")
 			}
 
-			ctx, err := continuity.NewContext(args[0])
+			switch buildCmdConfig.format {
+			case "pb":
+			case "text", "json":
+				if buildCmdConfig.stream {
+					log.Fatalf("--stream cannot be used with format %q", buildCmdConfig.format)
+				}
+			default:
+				log.Fatalf("unknown format %q", buildCmdConfig.format)
+			}
+
+			timestamps, err := parseTimestamps(buildCmdConfig.timestamps)
 			if err != nil {
-				log.Fatalf("error creating path context: %v", err)
+				log.Fatal(err)
 			}
 
-			m, err := continuity.BuildManifest(ctx)
+			filter, err := newFilter(buildCmdConfig.include, buildCmdConfig.exclude, buildCmdConfig.excludeFrom)
 			if err != nil {
-				log.Fatalf("error generating manifest: %v", err)
+				log.Fatalf("error parsing filter: %v", err)
+			}
+
+			contextOptions := continuity.ContextOptions{
+				Timestamps: timestamps,
+				Rootless:   buildCmdConfig.rootless,
+				Names:      buildCmdConfig.names,
 			}
+			if contextOptions.UIDMap, err = parseIDMaps(buildCmdConfig.uidMap); err != nil {
+				log.Fatalf("error parsing --uidmap: %v", err)
+			}
+			if contextOptions.GIDMap, err = parseIDMaps(buildCmdConfig.gidMap); err != nil {
+				log.Fatalf("error parsing --gidmap: %v", err)
+			}
+
+			if buildCmdConfig.store != "" {
+				store, err := continuity.NewContentStore(buildCmdConfig.store)
+				if err != nil {
+					log.Fatalf("error opening content store: %v", err)
+				}
+				contextOptions.Digester = store.Digester(digest.Canonical)
+			}
+
+			// Stop digesting files on interrupt.
+			sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			if buildCmdConfig.tar {
+				if buildCmdConfig.cache != "" {
+					log.Fatalln("--cache cannot be used with --tar")
+				}
+				if buildCmdConfig.overlay {
+					log.Fatalln("--overlay cannot be used with --tar")
+				}
+				if len(contextOptions.UIDMap) > 0 || len(contextOptions.GIDMap) > 0 {
+					log.Fatalln("--uidmap and --gidmap cannot be used with --tar")
+				}
+				if buildCmdConfig.rootless {
+					log.Fatalln("--rootless cannot be used with --tar")
+				}
+				if buildCmdConfig.names {
+					log.Fatalln("--names cannot be used with --tar")
+				}
+
+				m, err := buildManifestFromTar(sigCtx, args[0], continuity.TarOptions{
+					Digester:    contextOptions.Digester,
+					Timestamps:  timestamps,
+					Tool:        buildTool,
+					Annotations: buildCmdConfig.annotations,
+					Filter:      filter,
+				})
+				if err != nil {
+					log.Fatalf("error generating manifest: %v", err)
+				}
 
-			p, err := continuity.Marshal(m)
+				writeManifest(m, buildCmdConfig.format, buildCmdConfig.stream)
+				return
+			}
+
+			ctx, err := continuity.NewContextWithOptions(args[0], contextOptions)
 			if err != nil {
-				log.Fatalf("error marshaling manifest: %v", err)
+				log.Fatalf("error creating path context: %v", err)
 			}
 
-			if _, err := os.Stdout.Write(p); err != nil {
-				log.Fatalf("error writing to stdout: %v", err)
+			opts := continuity.BuildOptions{
+				Concurrency: buildCmdConfig.concurrency,
+				StrictCache: buildCmdConfig.cacheStrict,
+				Overlay:     buildCmdConfig.overlay,
+				Tool:        buildTool,
+				Annotations: buildCmdConfig.annotations,
+				Filter:      filter,
 			}
+
+			if buildCmdConfig.cache != "" {
+				// A missing cache is not an error, the first build records
+				// the cache keys for the next.
+				opts.CacheKeys = true
+				opts.Previous, err = loadManifest(buildCmdConfig.cache)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Fatalf("error reading cache manifest: %v", err)
+				}
+			}
+
+			if buildCmdConfig.stream {
+				header, err := continuity.NewHeader(ctx, opts)
+				if err != nil {
+					log.Fatalf("error generating manifest: %v", err)
+				}
+				header.DigestAlgorithms = []digest.Algorithm{digest.Canonical}
+
+				mw, err := continuity.NewManifestWriterWithHeader(os.Stdout, header)
+				if err != nil {
+					log.Fatalf("error writing to stdout: %v", err)
+				}
+
+				if err := continuity.BuildManifestStreamWithOptions(sigCtx, ctx, mw, opts); err != nil {
+					log.Fatalf("error generating manifest: %v", err)
+				}
+				return
+			}
+
+			m, err := continuity.BuildManifestWithOptions(sigCtx, ctx, opts)
+			if err != nil {
+				log.Fatalf("error generating manifest: %v", err)
+			}
+
+			writeManifest(m, buildCmdConfig.format, false)
 		},
 	}
 )
 
+// buildManifestFromTar builds a manifest from the tar archive at path, or
+// from stdin if path is "-".
+func buildManifestFromTar(ctx context.Context, path string, opts continuity.TarOptions) (*continuity.Manifest, error) {
+	if path == "-" {
+		return continuity.BuildManifestFromTarWithOptions(ctx, os.Stdin, opts)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return continuity.BuildManifestFromTarWithOptions(ctx, f, opts)
+}
+
+// writeManifest writes m to stdout in the given format, as a stream of
+// resources if stream is set.
+func writeManifest(m *continuity.Manifest, format string, stream bool) {
+	if stream {
+		mw, err := continuity.NewManifestWriterWithHeader(os.Stdout, m.Header)
+		if err != nil {
+			log.Fatalf("error writing to stdout: %v", err)
+		}
+
+		for _, rsrc := range m.Resources {
+			if err := mw.Write(rsrc); err != nil {
+				log.Fatalf("error writing to stdout: %v", err)
+			}
+		}
+
+		if err := mw.Flush(); err != nil {
+			log.Fatalf("error writing to stdout: %v", err)
+		}
+		return
+	}
+
+	var (
+		p   []byte
+		err error
+	)
+	switch format {
+	case "pb":
+		p, err = continuity.Marshal(m)
+	case "text":
+		err = continuity.MarshalText(os.Stdout, m)
+	case "json":
+		p, err = marshalJSONIndent(m)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		log.Fatalf("error marshaling manifest: %v", err)
+	}
+
+	if _, err := os.Stdout.Write(p); err != nil {
+		log.Fatalf("error writing to stdout: %v", err)
+	}
+}
+
+// marshalJSONIndent returns the JSON encoding of m, indented and ending in a
+// newline.
+func marshalJSONIndent(m *continuity.Manifest) ([]byte, error) {
+	p, err := m.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, p, "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
+
 func init() {
-	BuildCmd.Flags().StringVar(&buildCmdConfig.format, "format", "pb", "specify the output format of the manifest")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.format, "format", "pb", "specify the output format of the manifest (pb, text, json)")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.stream, "stream", false, "write the manifest as a stream of resources, using bounded memory")
+	BuildCmd.Flags().IntVar(&buildCmdConfig.concurrency, "concurrency", runtime.NumCPU(), "number of files to digest in parallel")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.cache, "cache", "", "reuse digests of unchanged files from a previous manifest built with this flag")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.cacheStrict, "cache-strict", false, "rehash files whose inode change time moved, even if otherwise unchanged")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.store, "store", "", "add the content of files to a content store directory")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.tar, "tar", false, "build the manifest from a tar archive rather than a directory")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.overlay, "overlay", false, "read the root as an overlay upper directory, recording whiteouts and opaque directories")
+	BuildCmd.Flags().StringToStringVar(&buildCmdConfig.annotations, "annotation", nil, "record an annotation in the manifest header (key=value)")
+	BuildCmd.Flags().StringArrayVar(&buildCmdConfig.include, "include", nil, "only include paths matching the pattern (can be repeated)")
+	BuildCmd.Flags().StringArrayVar(&buildCmdConfig.exclude, "exclude", nil, "exclude paths matching the pattern (can be repeated)")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.excludeFrom, "exclude-from", "", "read exclude patterns from a file, one per line")
+	BuildCmd.Flags().StringSliceVar(&buildCmdConfig.timestamps, "timestamps", nil, "record file times in the manifest (mtime, atime, ctime)")
+	BuildCmd.Flags().StringArrayVar(&buildCmdConfig.uidMap, "uidmap", nil, "map host uids of files to container uids, as container:host:size or a uid_map file (can be repeated)")
+	BuildCmd.Flags().StringArrayVar(&buildCmdConfig.gidMap, "gidmap", nil, "map host gids of files to container gids, as container:host:size or a gid_map file (can be repeated)")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.rootless, "rootless", false, "read the owner, mode and type of files recorded by a rootless apply")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.names, "names", false, "record user and group names from the etc/passwd and etc/group files of the root")
 }
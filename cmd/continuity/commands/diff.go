@@ -0,0 +1,211 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffCmdConfig struct {
+		format string
+	}
+
+	DiffCmd = &cobra.Command{
+		Use:   "diff <manifest> <manifest>",
+		Short: "Compare two manifests",
+		Long: `Compare two manifests and list the resources that were added, removed or
+modified between them. The command exits with status 1 if the manifests differ.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 2 {
+				log.Fatalln("please specify two manifests")
+			}
+
+			a, err := loadManifest(args[0])
+			if err != nil {
+				log.Fatalf("error reading manifest: %v", err)
+			}
+
+			b, err := loadManifest(args[1])
+			if err != nil {
+				log.Fatalf("error reading manifest: %v", err)
+			}
+
+			changes := continuity.DiffManifests(a, b)
+
+			switch diffCmdConfig.format {
+			case "text":
+				for _, c := range changes {
+					fmt.Fprintln(os.Stdout, formatChange(c))
+				}
+			case "json":
+				entries := make([]diffEntry, 0, len(changes))
+				for _, c := range changes {
+					entries = append(entries, newDiffEntry(c))
+				}
+
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(entries); err != nil {
+					log.Fatalf("error encoding changes: %v", err)
+				}
+			default:
+				log.Fatalf("unknown format %q", diffCmdConfig.format)
+			}
+
+			if len(changes) > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	DiffCmd.Flags().StringVar(&diffCmdConfig.format, "format", "text", "specify the output format (text, json)")
+}
+
+// diffEntry is the JSON representation of a continuity.ResourceChange.
+type diffEntry struct {
+	Kind   string               `json:"kind"`
+	Path   string               `json:"path"`
+	Fields map[string]diffValue `json:"fields,omitempty"`
+	XAttrs []string             `json:"xattrs,omitempty"`
+}
+
+type diffValue struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func newDiffEntry(c continuity.ResourceChange) diffEntry {
+	entry := diffEntry{
+		Kind:   c.Kind.String(),
+		Path:   c.Path,
+		XAttrs: c.XAttrs,
+	}
+
+	if len(c.Fields) > 0 {
+		entry.Fields = make(map[string]diffValue, len(c.Fields))
+		for _, f := range c.Fields {
+			from, to := describeField(f, c)
+			entry.Fields[f.String()] = diffValue{From: from, To: to}
+		}
+	}
+
+	return entry
+}
+
+// formatChange formats a change as a single line, prefixed by +, - or ~ for
+// added, removed and modified resources.
+func formatChange(c continuity.ResourceChange) string {
+	switch c.Kind {
+	case continuity.ChangeAdded:
+		return "+ " + c.Path
+	case continuity.ChangeRemoved:
+		return "- " + c.Path
+	}
+
+	details := make([]string, 0, len(c.Fields))
+	for _, f := range c.Fields {
+		if f == continuity.FieldXAttrs {
+			details = append(details, fmt.Sprintf("xattrs: %s", strings.Join(c.XAttrs, ", ")))
+			continue
+		}
+
+		from, to := describeField(f, c)
+		details = append(details, fmt.Sprintf("%v: %s -> %s", f, from, to))
+	}
+
+	return fmt.Sprintf("~ %s (%s)", c.Path, strings.Join(details, "; "))
+}
+
+// describeField returns the original and updated values of field f.
+func describeField(f continuity.ChangeField, c continuity.ResourceChange) (from, to string) {
+	return describeValue(f, c.Original, c.Path), describeValue(f, c.Updated, c.Path)
+}
+
+func describeValue(f continuity.ChangeField, rsrc continuity.Resource, path string) string {
+	switch f {
+	case continuity.FieldType, continuity.FieldMode:
+		return rsrc.Mode().String()
+	case continuity.FieldUID:
+		return fmt.Sprint(rsrc.UID())
+	case continuity.FieldGID:
+		return fmt.Sprint(rsrc.GID())
+	case continuity.FieldSize:
+		if rf, ok := rsrc.(continuity.RegularFile); ok {
+			return fmt.Sprint(rf.Size())
+		}
+	case continuity.FieldDigest:
+		if rf, ok := rsrc.(continuity.RegularFile); ok {
+			var digests []string
+			for _, dgst := range rf.Digests() {
+				digests = append(digests, dgst.String())
+			}
+			return strings.Join(digests, ",")
+		}
+	case continuity.FieldTarget:
+		if l, ok := rsrc.(continuity.SymLink); ok {
+			return l.Target()
+		}
+	case continuity.FieldDevice:
+		if d, ok := rsrc.(continuity.Device); ok {
+			return fmt.Sprintf("%d,%d", d.Major(), d.Minor())
+		}
+	case continuity.FieldHardlinks:
+		var links []string
+		if h, ok := rsrc.(continuity.Hardlinkable); ok {
+			for _, p := range h.Paths() {
+				if p != path {
+					links = append(links, p)
+				}
+			}
+		}
+		return "[" + strings.Join(links, " ") + "]"
+	case continuity.FieldTimes:
+		if t, ok := rsrc.(continuity.Timestamper); ok {
+			var times []string
+			for _, ts := range []struct {
+				name string
+				t    time.Time
+			}{
+				{"mtime", t.ModTime()},
+				{"atime", t.AccessTime()},
+				{"ctime", t.ChangeTime()},
+			} {
+				if !ts.t.IsZero() {
+					times = append(times, ts.name+"="+ts.t.UTC().Format(time.RFC3339Nano))
+				}
+			}
+			return strings.Join(times, " ")
+		}
+	case continuity.FieldFlags:
+		if la, ok := rsrc.(continuity.LinuxAttributer); ok {
+			return la.InodeFlags().String()
+		}
+	}
+
+	return ""
+}
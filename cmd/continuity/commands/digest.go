@@ -0,0 +1,65 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	digestCmdConfig struct {
+		manifest bool
+	}
+
+	DigestCmd = &cobra.Command{
+		Use:   "digest <manifest>",
+		Short: "Print the digest identifying the tree described by the manifest",
+		Long: `Print the digest identifying the tree described by the manifest. Manifests
+describing the same tree have the same digest, regardless of their encoding,
+the tool that built them and their annotations. With --manifest, the digest
+covers the whole header, as signatures do.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatalln("please specify a manifest")
+			}
+
+			m, err := loadManifest(args[0])
+			if err != nil {
+				log.Fatalf("error reading manifest: %v", err)
+			}
+
+			digestFn := m.TreeDigest
+			if digestCmdConfig.manifest {
+				digestFn = m.Digest
+			}
+
+			dgst, err := digestFn()
+			if err != nil {
+				log.Fatalf("error digesting manifest: %v", err)
+			}
+
+			fmt.Println(dgst)
+		},
+	}
+)
+
+func init() {
+	DigestCmd.Flags().BoolVar(&digestCmdConfig.manifest, "manifest", false, "digest the whole manifest, including the tool and annotations of its header")
+}
@@ -18,42 +18,82 @@ package commands
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"os"
 
-	pb "github.com/containerd/continuity/proto"
+	"github.com/containerd/continuity"
 	"github.com/spf13/cobra"
-	"google.golang.org/protobuf/encoding/prototext"
-	"google.golang.org/protobuf/proto"
 )
 
-var DumpCmd = &cobra.Command{
-	Use:   "dump <manifest>",
-	Short: "Dump the contents of the manifest in protobuf text format",
-	Run: func(cmd *cobra.Command, args []string) {
-		var p []byte
-		var err error
+var (
+	dumpCmdConfig struct {
+		format string
+	}
 
-		if len(args) < 1 {
-			p, err = io.ReadAll(os.Stdin)
-			if err != nil {
-				log.Fatalf("error reading manifest: %v", err)
+	DumpCmd = &cobra.Command{
+		Use:   "dump <manifest>",
+		Short: "Dump the contents of the manifest in protobuf text or JSON format",
+		Run: func(cmd *cobra.Command, args []string) {
+			var path string
+			if len(args) > 0 {
+				path = args[0]
+			}
+
+			switch dumpCmdConfig.format {
+			case "text":
+			case "json":
+				m, err := loadManifest(path)
+				if err != nil {
+					log.Fatalf("error reading manifest: %v", err)
+				}
+
+				p, err := marshalJSONIndent(m)
+				if err != nil {
+					log.Fatalf("error dumping manifest: %v", err)
+				}
+
+				if _, err := os.Stdout.Write(p); err != nil {
+					log.Fatalf("error dumping manifest: %v", err)
+				}
+				return
+			default:
+				log.Fatalf("unknown format %q", dumpCmdConfig.format)
 			}
-		} else {
-			p, err = os.ReadFile(args[0])
+
+			mr, closer, err := openManifest(path)
 			if err != nil {
 				log.Fatalf("error reading manifest: %v", err)
 			}
-		}
+			defer closer.Close()
+
+			// TODO(stevvooe): For now, just dump the text format. Turn this into nice text output later.
+			//
+			// The header and each resource are dumped as a manifest of their
+			// own, one per line, which together are still a valid text format
+			// manifest.
+			dump := func(m *continuity.Manifest) error {
+				if err := continuity.MarshalText(os.Stdout, m); err != nil {
+					return err
+				}
+				_, err := fmt.Fprintln(os.Stdout)
+				return err
+			}
 
-		var bm pb.Manifest
+			if header := mr.Header(); header != nil {
+				if err := dump(&continuity.Manifest{Header: header}); err != nil {
+					log.Fatalf("error dumping manifest: %v", err)
+				}
+			}
 
-		if err := proto.Unmarshal(p, &bm); err != nil {
-			log.Fatalf("error unmarshaling manifest: %v", err)
-		}
+			if err := readResources(mr, func(rsrc continuity.Resource) error {
+				return dump(&continuity.Manifest{Resources: []continuity.Resource{rsrc}})
+			}); err != nil {
+				log.Fatalf("error dumping manifest: %v", err)
+			}
+		},
+	}
+)
 
-		// TODO(stevvooe): For now, just dump the text format. Turn this into nice text output later.
-		_, _ = fmt.Fprintln(os.Stdout, prototext.Format(&bm))
-	},
+func init() {
+	DumpCmd.Flags().StringVar(&dumpCmdConfig.format, "format", "text", "specify the output format (text, json)")
 }
@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportCmdConfig struct {
+		store  string
+		mtime  int64
+		output string
+	}
+
+	ExportCmd = &cobra.Command{
+		Use:   "export <manifest>",
+		Short: "Export a manifest and its content as a tar archive",
+		Long: `Export the tree described by a manifest as a tar archive, reading file
+content from a content store. The archive is written to stdout unless --output
+is given. Exporting the same manifest always produces the same archive.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatalln("please specify a manifest")
+			}
+
+			if exportCmdConfig.store == "" {
+				log.Fatalln("please specify a content store with --store")
+			}
+
+			m, err := loadManifest(args[0])
+			if err != nil {
+				log.Fatalf("error reading manifest: %v", err)
+			}
+
+			store, err := continuity.NewContentStore(exportCmdConfig.store)
+			if err != nil {
+				log.Fatalf("error opening content store: %v", err)
+			}
+
+			out := os.Stdout
+			if exportCmdConfig.output != "" {
+				out, err = os.Create(exportCmdConfig.output)
+				if err != nil {
+					log.Fatalf("error creating output: %v", err)
+				}
+				defer out.Close()
+			}
+
+			w := bufio.NewWriter(out)
+			opts := continuity.ExportOptions{
+				ModTime: time.Unix(exportCmdConfig.mtime, 0),
+			}
+			if err := continuity.ExportManifest(w, m, store, opts); err != nil {
+				log.Fatalf("error exporting manifest: %v", err)
+			}
+
+			if err := w.Flush(); err != nil {
+				log.Fatalf("error writing archive: %v", err)
+			}
+		},
+	}
+)
+
+func init() {
+	ExportCmd.Flags().StringVar(&exportCmdConfig.store, "store", "", "read file content from a content store directory")
+	ExportCmd.Flags().Int64Var(&exportCmdConfig.mtime, "mtime", 0, "modification time of every entry, in seconds since the Unix epoch")
+	ExportCmd.Flags().StringVarP(&exportCmdConfig.output, "output", "o", "", "write the archive to a file rather than stdout")
+}
@@ -17,55 +17,189 @@
 package commands
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 
-	"github.com/containerd/continuity/proto"
+	"github.com/containerd/continuity"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
 
-var LSCmd = &cobra.Command{
-	Use:   "ls <manifest>",
-	Short: "List the contents of the manifest.",
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) != 1 {
-			log.Fatalln("please specify a manifest")
+var (
+	lsCmdConfig struct {
+		store string
+	}
+
+	LSCmd = &cobra.Command{
+		Use:   "ls <manifest>",
+		Short: "List the contents of the manifest.",
+		Long: `List the contents of the manifest. Owners are shown by the names recorded in
+the manifest. With --store, the ids of other owners are resolved against the
+etc/passwd and etc/group files of the manifest, read from the content store.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatalln("please specify a manifest")
+			}
+
+			var names *continuity.NameDatabase
+			if lsCmdConfig.store != "" {
+				store, err := continuity.NewContentStore(lsCmdConfig.store)
+				if err != nil {
+					log.Fatalf("error opening content store: %v", err)
+				}
+
+				names, err = readManifestNames(args[0], store)
+				if err != nil {
+					log.Fatalf("error reading names: %v", err)
+				}
+			}
+
+			listManifest(args[0], names)
+		},
+	}
+)
+
+func init() {
+	LSCmd.Flags().StringVar(&lsCmdConfig.store, "store", "", "resolve owner names from the etc/passwd and etc/group files of the manifest in a content store directory")
+}
+
+// listManifest prints the resources of the manifest at path, with the owner
+// names from names.
+func listManifest(path string, names *continuity.NameDatabase) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+
+	if err := readManifest(path, func(entry continuity.Resource) error {
+		user, group := getUserGroup(entry, names)
+
+		var size int64
+		if rf, ok := entry.(continuity.RegularFile); ok {
+			size = rf.Size()
 		}
 
-		bm, err := readManifestFile(args[0])
-		if err != nil {
-			log.Fatalf("error reading manifest: %v", err)
+		paths := []string{entry.Path()}
+		if h, ok := entry.(continuity.Hardlinkable); ok {
+			paths = h.Paths()
 		}
 
-		w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		attrs := formatLinuxAttrs(entry)
 
-		for _, entry := range bm.Resource {
-			user, group := getUserGroup(entry)
-			for _, path := range entry.Path {
-				if os.FileMode(entry.Mode)&os.ModeSymlink != 0 {
-					_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v -> %v\n", os.FileMode(entry.Mode), user, group, humanize.Bytes(uint64(entry.Size)), path, entry.Target) //nolint:unconvert
-				} else {
-					_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", os.FileMode(entry.Mode), user, group, humanize.Bytes(uint64(entry.Size)), path) //nolint:unconvert
-				}
+		for _, path := range paths {
+			name := path
+			if l, ok := entry.(continuity.SymLink); ok {
+				name += " -> " + l.Target()
+			} else if _, ok := entry.(continuity.Whiteout); ok {
+				name += " (whiteout)"
+			} else if _, ok := entry.(continuity.OpaqueDirectory); ok {
+				name += " (opaque)"
+			}
+			if attrs != "" {
+				name += "\t" + attrs
 			}
+
+			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", entry.Mode(), user, group, humanize.Bytes(uint64(size)), name)
+		}
+
+		return nil
+	}); err != nil {
+		log.Fatalf("error reading manifest: %v", err)
+	}
+
+	_ = w.Flush()
+}
+
+// readManifestNames reads the users and groups listed in the etc/passwd and
+// etc/group files of the manifest at path, with their content from provider.
+func readManifestNames(path string, provider continuity.ContentProvider) (*continuity.NameDatabase, error) {
+	var passwd, group io.Reader
+	if err := readManifest(path, func(entry continuity.Resource) error {
+		rf, ok := entry.(continuity.RegularFile)
+		if !ok || len(rf.Digests()) == 0 {
+			return nil
+		}
+
+		var r *io.Reader
+		switch entry.Path() {
+		case "/etc/passwd":
+			r = &passwd
+		case "/etc/group":
+			r = &group
+		default:
+			return nil
 		}
 
-		_ = w.Flush()
-	},
+		rc, err := provider.Reader(rf.Digests()[0])
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", entry.Path(), err)
+		}
+		defer rc.Close()
+
+		content, err := io.ReadAll(rc)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", entry.Path(), err)
+		}
+		*r = bytes.NewReader(content)
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return continuity.ReadNameDatabase(passwd, group)
 }
 
-func getUserGroup(entry *proto.Resource) (user, group string) {
-	user = entry.User //nolint:staticcheck // ignore SA1019: entry.User is deprecated.
+// formatLinuxAttrs returns the capabilities, ACLs and inode flags of the
+// entry, if any, such as "caps=cap_net_raw=ep flags=i".
+func formatLinuxAttrs(entry continuity.Resource) string {
+	la, ok := entry.(continuity.LinuxAttributer)
+	if !ok {
+		return ""
+	}
+
+	var attrs []string
+	if caps := la.Capabilities(); caps != nil {
+		attrs = append(attrs, "caps="+caps.String())
+	}
+	if acl := la.AccessACL(); len(acl) > 0 {
+		attrs = append(attrs, "acl="+acl.String())
+	}
+	if acl := la.DefaultACL(); len(acl) > 0 {
+		attrs = append(attrs, "default-acl="+acl.String())
+	}
+	if flags := la.InodeFlags(); flags != 0 {
+		attrs = append(attrs, "flags="+flags.String())
+	}
+
+	return strings.Join(attrs, " ")
+}
+
+// getUserGroup returns the names of the owners of the entry, or else their
+// ids. Names recorded in the manifest, which older manifests may carry
+// without meaningful ids, take precedence over those listed in names.
+func getUserGroup(entry continuity.Resource, names *continuity.NameDatabase) (user, group string) {
+	if n, ok := entry.(continuity.OwnerNamer); ok {
+		user, group = n.User(), n.Group()
+	}
+
 	if user == "" {
-		user = strconv.FormatInt(entry.Uid, 10)
+		if name, ok := names.UserName(entry.UID()); ok {
+			user = name
+		} else {
+			user = strconv.FormatInt(entry.UID(), 10)
+		}
 	}
-	group = entry.Group //nolint:staticcheck // ignore SA1019: entry.Group is deprecated.
 	if group == "" {
-		group = strconv.FormatInt(entry.Gid, 10)
+		if name, ok := names.GroupName(entry.GID()); ok {
+			group = name
+		} else {
+			group = strconv.FormatInt(entry.GID(), 10)
+		}
 	}
+
 	return user, group
 }
@@ -17,13 +17,14 @@
 package commands
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"text/tabwriter"
 
-	pb "github.com/containerd/continuity/proto"
+	"github.com/containerd/continuity"
 	"github.com/spf13/cobra"
-	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -68,27 +69,158 @@ func init() {
 	MainCmd.AddCommand(LSCmd)
 	MainCmd.AddCommand(StatsCmd)
 	MainCmd.AddCommand(DumpCmd)
+	MainCmd.AddCommand(DiffCmd)
+	MainCmd.AddCommand(ExportCmd)
+	MainCmd.AddCommand(SignCmd)
+	MainCmd.AddCommand(DigestCmd)
 	if MountCmd != nil {
 		MainCmd.AddCommand(MountCmd)
 	}
 	MainCmd.SetUsageTemplate(usageTemplate)
 }
 
-// readManifestFile reads the manifest from the given path. This should
-// probably be provided by the continuity library.
-func readManifestFile(path string) (*pb.Manifest, error) {
-	p, err := os.ReadFile(path)
+// openManifest opens the manifest at the given path for reading, or stdin if
+// the path is empty. Both streamed and regular manifests are supported. The
+// returned closer must be called once the manifest has been read.
+func openManifest(path string) (*continuity.ManifestReader, io.Closer, error) {
+	f := os.Stdin
+	if path != "" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	mr, err := continuity.NewManifestReader(f)
 	if err != nil {
-		return nil, err
+		f.Close()
+		return nil, nil, err
+	}
+
+	return mr, f, nil
+}
+
+// readManifest calls fn for each resource of the manifest at the given path,
+// as opened by openManifest.
+func readManifest(path string, fn func(continuity.Resource) error) error {
+	mr, closer, err := openManifest(path)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	return readResources(mr, fn)
+}
+
+// readResources calls fn for each remaining resource of the manifest.
+func readResources(mr *continuity.ManifestReader, fn func(continuity.Resource) error) error {
+	for {
+		rsrc, err := mr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := fn(rsrc); err != nil {
+			return err
+		}
+	}
+}
+
+// parseTimestamps converts the names of file times, as accepted by the
+// --timestamps flags, to continuity.Timestamps.
+func parseTimestamps(names []string) (continuity.Timestamps, error) {
+	var timestamps continuity.Timestamps
+	for _, name := range names {
+		switch name {
+		case "mtime":
+			timestamps |= continuity.TimestampModify
+		case "atime":
+			timestamps |= continuity.TimestampAccess
+		case "ctime":
+			timestamps |= continuity.TimestampChange
+		default:
+			return 0, fmt.Errorf("unknown timestamp %q", name)
+		}
 	}
 
-	var bm pb.Manifest
+	return timestamps, nil
+}
+
+// parseIDMaps converts the values of the --uidmap and --gidmap flags to
+// ranges of ids. A value is either a range as "container:host:size" or the
+// path of a file in the format of /proc/self/uid_map.
+func parseIDMaps(values []string) ([]continuity.IDMap, error) {
+	var maps []continuity.IDMap
+	for _, value := range values {
+		if strings.Contains(value, ":") {
+			m, err := continuity.ParseIDMap(value)
+			if err != nil {
+				return nil, err
+			}
+			maps = append(maps, m)
+			continue
+		}
+
+		f, err := os.Open(value)
+		if err != nil {
+			return nil, err
+		}
+
+		fileMaps, err := continuity.ReadIDMaps(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", value, err)
+		}
+		maps = append(maps, fileMaps...)
+	}
+
+	return maps, nil
+}
+
+// newFilter returns the filter for the --include, --exclude and
+// --exclude-from flags, or nil if no patterns were given.
+func newFilter(include, exclude []string, excludeFrom string) (*continuity.Filter, error) {
+	if excludeFrom != "" {
+		f, err := os.Open(excludeFrom)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		patterns, err := continuity.ReadFilterPatterns(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", excludeFrom, err)
+		}
+		exclude = append(patterns, exclude...)
+	}
+
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	return continuity.NewFilter(include, exclude)
+}
+
+// loadManifest reads the entire manifest at the given path into memory.
+func loadManifest(path string) (*continuity.Manifest, error) {
+	mr, closer, err := openManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
 
-	if err := proto.Unmarshal(p, &bm); err != nil {
+	m := continuity.Manifest{Header: mr.Header()}
+	if err := readResources(mr, func(rsrc continuity.Resource) error {
+		m.Resources = append(m.Resources, rsrc)
+		return nil
+	}); err != nil {
 		return nil, err
 	}
 
-	return &bm, nil
+	return &m, nil
 }
 
 // newTabwriter provides a common tabwriter with defaults.
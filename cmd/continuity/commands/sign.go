@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/containerd/continuity"
+	"github.com/spf13/cobra"
+)
+
+var (
+	signCmdConfig struct {
+		key    string
+		output string
+	}
+
+	SignCmd = &cobra.Command{
+		Use:   "sign <manifest>",
+		Short: "Create a detached signature of a manifest",
+		Long: `Sign the manifest with a PEM encoded ed25519 private key, writing a
+detached signature to stdout unless --output is given. The signature can be
+checked with "continuity verify --signature".`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatalln("please specify a manifest")
+			}
+
+			if signCmdConfig.key == "" {
+				log.Fatalln("please specify a private key with --key")
+			}
+
+			p, err := os.ReadFile(signCmdConfig.key)
+			if err != nil {
+				log.Fatalf("error reading private key: %v", err)
+			}
+
+			signer, err := continuity.NewEd25519SignerFromPEM(p)
+			if err != nil {
+				log.Fatalf("error loading private key: %v", err)
+			}
+
+			m, err := loadManifest(args[0])
+			if err != nil {
+				log.Fatalf("error reading manifest: %v", err)
+			}
+
+			sig, err := continuity.SignManifest(m, signer)
+			if err != nil {
+				log.Fatalf("error signing manifest: %v", err)
+			}
+
+			p, err = json.MarshalIndent(sig, "", "  ")
+			if err != nil {
+				log.Fatalf("error encoding signature: %v", err)
+			}
+			p = append(p, '\n')
+
+			if signCmdConfig.output == "" {
+				if _, err := os.Stdout.Write(p); err != nil {
+					log.Fatalf("error writing signature: %v", err)
+				}
+				return
+			}
+
+			if err := os.WriteFile(signCmdConfig.output, p, 0o644); err != nil {
+				log.Fatalf("error writing signature: %v", err)
+			}
+		},
+	}
+)
+
+func init() {
+	SignCmd.Flags().StringVar(&signCmdConfig.key, "key", "", "PEM encoded ed25519 private key")
+	SignCmd.Flags().StringVarP(&signCmdConfig.output, "output", "o", "", "write the signature to a file rather than stdout")
+}
+
+// verifySignature checks the detached signature at sigPath against the
+// manifest using the PEM encoded public key at keyPath.
+func verifySignature(m *continuity.Manifest, sigPath, keyPath string) error {
+	p, err := os.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("error reading public key: %w", err)
+	}
+
+	verifier, err := continuity.NewEd25519VerifierFromPEM(p)
+	if err != nil {
+		return fmt.Errorf("error loading public key: %w", err)
+	}
+
+	p, err = os.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("error reading signature: %w", err)
+	}
+
+	var sig continuity.Signature
+	if err := json.Unmarshal(p, &sig); err != nil {
+		return fmt.Errorf("error decoding signature: %w", err)
+	}
+
+	return continuity.VerifyManifestSignature(m, &sig, verifier)
+}
@@ -21,6 +21,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/containerd/continuity"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
@@ -33,11 +34,6 @@ var StatsCmd = &cobra.Command{
 			log.Fatalln("please specify a manifest")
 		}
 
-		bm, err := readManifestFile(args[0])
-		if err != nil {
-			log.Fatalf("error reading manifest: %v", err)
-		}
-
 		var stats struct {
 			resources   int
 			files       int
@@ -46,18 +42,22 @@ var StatsCmd = &cobra.Command{
 			symlinks    int
 		}
 
-		for _, entry := range bm.Resource {
+		if err := readManifest(args[0], func(entry continuity.Resource) error {
 			stats.resources++
-			stats.totalSize += int64(entry.Size)
 
-			mode := os.FileMode(entry.Mode)
-			if mode.IsRegular() {
-				stats.files += len(entry.Path) // count hardlinks!
-			} else if mode.IsDir() {
+			switch entry := entry.(type) {
+			case continuity.RegularFile:
+				stats.totalSize += entry.Size()
+				stats.files += len(entry.Paths()) // count hardlinks!
+			case continuity.Directory:
 				stats.directories++
-			} else if mode&os.ModeSymlink != 0 {
+			case continuity.SymLink:
 				stats.symlinks++
 			}
+
+			return nil
+		}); err != nil {
+			log.Fatalf("error reading manifest: %v", err)
 		}
 
 		w := newTabwriter(os.Stdout)
@@ -17,41 +17,160 @@
 package commands
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"sort"
 
 	"github.com/containerd/continuity"
 	"github.com/spf13/cobra"
 )
 
-var VerifyCmd = &cobra.Command{
-	Use:   "verify <root> [<manifest>]",
-	Short: "Verify the root against the provided manifest",
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) != 2 {
-			log.Fatalln("please specify a root and manifest")
-		}
+var (
+	verifyCmdConfig struct {
+		timestamps  []string
+		signature   string
+		key         string
+		include     []string
+		exclude     []string
+		excludeFrom string
+		uidMap      []string
+		gidMap      []string
+		rootless    bool
+		names       bool
+	}
 
-		root, path := args[0], args[1]
+	VerifyCmd = &cobra.Command{
+		Use:   "verify <root> [<manifest>]",
+		Short: "Verify the root against the provided manifest",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 2 {
+				verifyFatalf("please specify a root and manifest")
+			}
 
-		p, err := os.ReadFile(path)
-		if err != nil {
-			log.Fatalf("error reading manifest: %v", err)
-		}
+			root, path := args[0], args[1]
 
-		m, err := continuity.Unmarshal(p)
-		if err != nil {
-			log.Fatalf("error unmarshaling manifest: %v", err)
-		}
+			if (verifyCmdConfig.signature == "") != (verifyCmdConfig.key == "") {
+				verifyFatalf("--signature and --key must be used together")
+			}
 
-		ctx, err := continuity.NewContext(root)
-		if err != nil {
-			log.Fatalf("error getting context: %v", err)
-		}
+			timestamps, err := parseTimestamps(verifyCmdConfig.timestamps)
+			if err != nil {
+				verifyFatalf("%v", err)
+			}
+
+			filter, err := newFilter(verifyCmdConfig.include, verifyCmdConfig.exclude, verifyCmdConfig.excludeFrom)
+			if err != nil {
+				verifyFatalf("error parsing filter: %v", err)
+			}
+			opts := continuity.VerifyOptions{Filter: filter}
+
+			uidMap, err := parseIDMaps(verifyCmdConfig.uidMap)
+			if err != nil {
+				verifyFatalf("error parsing --uidmap: %v", err)
+			}
+			gidMap, err := parseIDMaps(verifyCmdConfig.gidMap)
+			if err != nil {
+				verifyFatalf("error parsing --gidmap: %v", err)
+			}
+
+			ctx, err := continuity.NewContextWithOptions(root, continuity.ContextOptions{
+				Timestamps: timestamps,
+				UIDMap:     uidMap,
+				GIDMap:     gidMap,
+				Rootless:   verifyCmdConfig.rootless,
+				Names:      verifyCmdConfig.names,
+			})
+			if err != nil {
+				verifyFatalf("error getting context: %v", err)
+			}
+
+			var report *continuity.VerifyReport
+			if verifyCmdConfig.signature != "" {
+				// The whole manifest is needed to check its signature, which
+				// must pass before the root is looked at.
+				m, err := loadManifest(path)
+				if err != nil {
+					verifyFatalf("error reading manifest: %v", err)
+				}
+
+				if err := verifySignature(m, verifyCmdConfig.signature, verifyCmdConfig.key); err != nil {
+					verifyFatalf("error verifying signature: %v", err)
+				}
+
+				report, err = continuity.VerifyManifestReportWithOptions(ctx, m, opts)
+				if err != nil {
+					verifyFatalf("error verifying manifest: %v", err)
+				}
+			} else {
+				mr, closer, err := openManifest(path)
+				if err != nil {
+					verifyFatalf("error reading manifest: %v", err)
+				}
+				defer closer.Close()
+
+				report, err = continuity.VerifyManifestStreamReportWithOptions(ctx, mr, opts)
+				if err != nil {
+					verifyFatalf("error verifying manifest: %v", err)
+				}
+			}
+
+			if report.OK() {
+				return
+			}
 
-		if err := continuity.VerifyManifest(ctx, m); err != nil {
-			// TODO(stevvooe): Support more interesting error reporting.
-			log.Fatalf("error verifying manifest: %v", err)
+			printVerifyReport(report)
+			os.Exit(verifyExitMismatch)
+		},
+	}
+)
+
+const (
+	// verifyExitMismatch is the exit code when the root does not match the
+	// manifest.
+	verifyExitMismatch = 1
+
+	// verifyExitError is the exit code when verification could not be
+	// completed.
+	verifyExitError = 2
+)
+
+// verifyFatalf logs the error and exits with verifyExitError, keeping
+// operational failures distinct from mismatches.
+func verifyFatalf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	os.Exit(verifyExitError)
+}
+
+// printVerifyReport prints the mismatches in report grouped by kind,
+// followed by a summary line.
+func printVerifyReport(report *continuity.VerifyReport) {
+	groups := report.ByKind()
+	kinds := make([]continuity.MismatchKind, 0, len(groups))
+	for kind := range groups {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+
+	for _, kind := range kinds {
+		fmt.Printf("%v (%d):\n", kind, len(groups[kind]))
+		for _, m := range groups[kind] {
+			fmt.Printf("\t%v\n", m)
 		}
-	},
+	}
+
+	fmt.Printf("%d mismatches found\n", len(report.Mismatches))
+}
+
+func init() {
+	VerifyCmd.Flags().StringVar(&verifyCmdConfig.signature, "signature", "", "check the detached signature of the manifest before verifying the root")
+	VerifyCmd.Flags().StringVar(&verifyCmdConfig.key, "key", "", "PEM encoded ed25519 public key to check --signature with")
+	VerifyCmd.Flags().StringArrayVar(&verifyCmdConfig.include, "include", nil, "only verify paths matching the pattern (can be repeated)")
+	VerifyCmd.Flags().StringArrayVar(&verifyCmdConfig.exclude, "exclude", nil, "ignore paths matching the pattern (can be repeated)")
+	VerifyCmd.Flags().StringVar(&verifyCmdConfig.excludeFrom, "exclude-from", "", "read exclude patterns from a file, one per line")
+	VerifyCmd.Flags().StringSliceVar(&verifyCmdConfig.timestamps, "timestamps", nil, "compare file times recorded in the manifest (mtime, atime, ctime)")
+	VerifyCmd.Flags().StringArrayVar(&verifyCmdConfig.uidMap, "uidmap", nil, "map container uids of the manifest to host uids, as container:host:size or a uid_map file (can be repeated)")
+	VerifyCmd.Flags().StringArrayVar(&verifyCmdConfig.gidMap, "gidmap", nil, "map container gids of the manifest to host gids, as container:host:size or a gid_map file (can be repeated)")
+	VerifyCmd.Flags().BoolVar(&verifyCmdConfig.rootless, "rootless", false, "read the owner, mode and type of files recorded by a rootless apply")
+	VerifyCmd.Flags().BoolVar(&verifyCmdConfig.names, "names", false, "expect the ids that recorded user and group names have in the etc/passwd and etc/group files of the root")
 }
@@ -111,6 +111,8 @@ func (f *File) getDirent(name string) (fuse.Dirent, error) {
 		t = fuse.DT_Block
 	case continuity.NamedPipe:
 		t = fuse.DT_FIFO
+	case continuity.Socket:
+		t = fuse.DT_Socket
 	default:
 		t = fuse.DT_Unknown
 	}
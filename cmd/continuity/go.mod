@@ -12,12 +12,15 @@ require (
 	github.com/spf13/cobra v1.8.1
 )
 
+require google.golang.org/protobuf v1.35.1
+
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
-	google.golang.org/protobuf v1.35.1 // indirect
 )
 
 // use local source for the main module
@@ -0,0 +1,266 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Subtree returns a manifest of the tree under the directory dir, with the
+// paths of the resources rebased onto dir. The attributes of dir are recorded
+// as the root in the header. Hardlinks to paths outside of dir are dropped
+// from their resource.
+func (m *Manifest) Subtree(dir string) (*Manifest, error) {
+	dir = path.Clean("/" + dir)
+	if dir == "/" {
+		return &Manifest{Header: m.Header, Resources: append([]Resource(nil), m.Resources...)}, nil
+	}
+
+	var (
+		root      Resource
+		resources []Resource
+	)
+	for _, rsrc := range m.Resources {
+		var paths []string
+		for _, p := range resourcePaths(rsrc) {
+			if p == dir {
+				root = rsrc
+				continue
+			}
+
+			if rel := strings.TrimPrefix(p, dir); rel != p && strings.HasPrefix(rel, "/") {
+				paths = append(paths, rel)
+			}
+		}
+
+		if len(paths) == 0 {
+			continue
+		}
+
+		rebased, err := withPaths(rsrc, paths)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, rebased)
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("subtree %q: %w", dir, ErrNotFound)
+	}
+	if _, ok := root.(Directory); !ok {
+		return nil, fmt.Errorf("subtree %q is not a directory", dir)
+	}
+
+	sort.Stable(ByPath(resources))
+
+	var header *Header
+	if m.Header != nil {
+		h := *m.Header
+		h.Root = &RootInfo{Mode: root.Mode(), UID: root.UID(), GID: root.GID()}
+		h.DigestAlgorithms = digestAlgorithms(resources)
+		header = &h
+	}
+
+	return &Manifest{Header: header, Resources: resources}, nil
+}
+
+// Overlay returns the manifest of the tree resulting from extracting the
+// OCI image layer described by upper over the tree of m, following the
+// OCI layer model:
+//
+//   - a resource of upper replaces the resource of m at the same path
+//   - the entries of a directory of m are kept when upper has a directory at
+//     the same path, and removed when upper has any other type
+//   - a ".wh.<name>" whiteout file of upper removes <name> and everything
+//     beneath it from m
+//   - a ".wh..wh..opq" opaque marker of upper removes all entries of its
+//     directory from m
+//   - Whiteout and OpaqueDirectory resources of upper act like the files
+//     marking them in an image layer
+//
+// Whiteouts only apply to m, never to other resources of upper, and are not
+// part of the result. Hardlinks of m which are replaced or removed are
+// dropped from their resource, while its other paths are kept.
+func (m *Manifest) Overlay(upper *Manifest) (*Manifest, error) {
+	var (
+		// replaced holds the paths of upper, with whether they are
+		// directories.
+		replaced = map[string]bool{}
+
+		// removed holds the paths whited out, with everything beneath.
+		removed = map[string]struct{}{}
+
+		// opaque holds the directories whose entries are hidden.
+		opaque = map[string]struct{}{}
+
+		resources []Resource
+	)
+
+	for _, rsrc := range upper.Resources {
+		if _, ok := rsrc.(Whiteout); ok {
+			removed[rsrc.Path()] = struct{}{}
+			continue
+		}
+
+		if od, ok := rsrc.(*opaqueDirectory); ok {
+			opaque[od.Path()] = struct{}{}
+
+			// the result describes a complete tree.
+			d := od.directory
+			rsrc = &d
+		}
+
+		_, isDir := rsrc.(Directory)
+
+		var paths []string
+		for _, p := range resourcePaths(rsrc) {
+			dir, name := path.Split(p)
+			dir = path.Clean(dir)
+			switch {
+			case name == whiteoutOpaqueDir:
+				opaque[dir] = struct{}{}
+			case strings.HasPrefix(name, whiteoutPrefix):
+				target := strings.TrimPrefix(name, whiteoutPrefix)
+				if target == "" || target == "." || target == ".." {
+					return nil, fmt.Errorf("invalid whiteout %q", p)
+				}
+				removed[path.Join(dir, target)] = struct{}{}
+			default:
+				replaced[p] = isDir
+				paths = append(paths, p)
+			}
+		}
+
+		if len(paths) == 0 {
+			continue
+		}
+
+		if len(paths) < len(resourcePaths(rsrc)) {
+			var err error
+			if rsrc, err = withPaths(rsrc, paths); err != nil {
+				return nil, err
+			}
+		}
+		resources = append(resources, rsrc)
+	}
+
+	// hidden returns true if the path of m is not part of the result.
+	hidden := func(p string) bool {
+		if _, ok := replaced[p]; ok {
+			return true
+		}
+		if _, ok := removed[p]; ok {
+			return true
+		}
+
+		for dir := path.Dir(p); ; dir = path.Dir(dir) {
+			if _, ok := removed[dir]; ok {
+				return true
+			}
+			if _, ok := opaque[dir]; ok {
+				return true
+			}
+			if isDir, ok := replaced[dir]; ok && !isDir {
+				return true
+			}
+
+			if dir == "/" {
+				return false
+			}
+		}
+	}
+
+	for _, rsrc := range m.Resources {
+		var paths []string
+		for _, p := range resourcePaths(rsrc) {
+			if !hidden(p) {
+				paths = append(paths, p)
+			}
+		}
+
+		if len(paths) == 0 {
+			continue
+		}
+
+		if len(paths) < len(resourcePaths(rsrc)) {
+			var err error
+			if rsrc, err = withPaths(rsrc, paths); err != nil {
+				return nil, err
+			}
+		}
+		resources = append(resources, rsrc)
+	}
+
+	sort.Stable(ByPath(resources))
+
+	// The layer cannot place entries beneath a path of m which is not a
+	// directory without replacing it.
+	types := map[string]bool{}
+	for _, rsrc := range resources {
+		_, isDir := rsrc.(Directory)
+		for _, p := range resourcePaths(rsrc) {
+			types[p] = isDir
+		}
+	}
+	for p := range types {
+		if isDir, ok := types[path.Dir(p)]; ok && !isDir {
+			return nil, fmt.Errorf("parent of %q is not a directory", p)
+		}
+	}
+
+	return &Manifest{
+		Header:    overlayHeader(m.Header, upper.Header, resources),
+		Resources: resources,
+	}, nil
+}
+
+// overlayHeader returns the header of the overlay of two manifests. The
+// root and tool of the upper header take precedence, annotations are merged.
+func overlayHeader(lower, upper *Header, resources []Resource) *Header {
+	if lower == nil && upper == nil {
+		return nil
+	}
+
+	h := &Header{
+		Version:          manifestVersionHeader,
+		DigestAlgorithms: digestAlgorithms(resources),
+	}
+
+	for _, src := range []*Header{lower, upper} {
+		if src == nil {
+			continue
+		}
+
+		if src.Tool != "" {
+			h.Tool = src.Tool
+		}
+		if src.Root != nil {
+			h.Root = src.Root
+		}
+		for k, v := range src.Annotations {
+			if h.Annotations == nil {
+				h.Annotations = map[string]string{}
+			}
+			h.Annotations[k] = v
+		}
+	}
+
+	return h
+}
@@ -0,0 +1,189 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// tarEntry is an entry of a test archive.
+type tarEntry struct {
+	typeflag byte
+	name     string
+	content  string
+	linkname string
+}
+
+// buildTarManifest builds a manifest from an archive of the entries.
+func buildTarManifest(t *testing.T, entries []tarEntry) *Manifest {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := tar.Header{
+			Typeflag: entry.typeflag,
+			Name:     entry.name,
+			Linkname: entry.linkname,
+			Mode:     0o644,
+			Size:     int64(len(entry.content)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			hdr.Mode = 0o755
+		}
+
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := BuildManifestFromTar(&buf)
+	if err != nil {
+		t.Fatalf("error building manifest from tar: %v", err)
+	}
+
+	return m
+}
+
+// describeManifest returns a line for each resource of the manifest with its
+// paths and, for regular files, content.
+func describeManifest(m *Manifest, contents ...string) []string {
+	names := map[digest.Digest]string{}
+	for _, content := range contents {
+		names[digest.FromString(content)] = content
+	}
+
+	var lines []string
+	for _, rsrc := range m.Resources {
+		line := strings.Join(resourcePaths(rsrc), ",")
+		switch r := rsrc.(type) {
+		case Directory:
+			line += "/"
+		case RegularFile:
+			line += fmt.Sprintf(" %q", names[r.Digests()[0]])
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func TestManifestSubtree(t *testing.T) {
+	m := buildTarManifest(t, []tarEntry{
+		{typeflag: tar.TypeDir, name: "usr/"},
+		{typeflag: tar.TypeDir, name: "usr/lib/"},
+		{typeflag: tar.TypeReg, name: "usr/lib/a", content: "a"},
+		{typeflag: tar.TypeLink, name: "usr/lib/b", linkname: "usr/lib/a"},
+		{typeflag: tar.TypeLink, name: "usr/c", linkname: "usr/lib/a"},
+		{typeflag: tar.TypeDir, name: "usr/lib.d/"},
+		{typeflag: tar.TypeReg, name: "usr/lib.d/d", content: "d"},
+	})
+
+	sub, err := m.Subtree("usr/lib")
+	if err != nil {
+		t.Fatalf("error extracting subtree: %v", err)
+	}
+
+	expected := []string{`/a,/b "a"`}
+	if lines := describeManifest(sub, "a", "d"); !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("unexpected subtree: %q != %q", lines, expected)
+	}
+
+	if sub.Header.Root == nil || !sub.Header.Root.Mode.IsDir() {
+		t.Fatalf("expected the subtree root in the header: %#v", sub.Header.Root)
+	}
+
+	if _, err := m.Subtree("/usr/missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected missing subtree to fail with ErrNotFound, got %v", err)
+	}
+	if _, err := m.Subtree("/usr/c"); err == nil {
+		t.Fatal("expected subtree of a file to fail")
+	}
+}
+
+func TestManifestOverlay(t *testing.T) {
+	lower := buildTarManifest(t, []tarEntry{
+		{typeflag: tar.TypeDir, name: "a/"},
+		{typeflag: tar.TypeReg, name: "a/x", content: "x"},
+		{typeflag: tar.TypeReg, name: "a/y", content: "y"},
+		{typeflag: tar.TypeDir, name: "b/"},
+		{typeflag: tar.TypeReg, name: "b/z", content: "z"},
+		{typeflag: tar.TypeReg, name: "c", content: "c"},
+		{typeflag: tar.TypeDir, name: "d/"},
+		{typeflag: tar.TypeReg, name: "d/e", content: "e"},
+		{typeflag: tar.TypeReg, name: "f", content: "f"},
+		{typeflag: tar.TypeLink, name: "g", linkname: "f"},
+		{typeflag: tar.TypeDir, name: "o/"},
+		{typeflag: tar.TypeReg, name: "o/p", content: "p"},
+	})
+
+	upper := buildTarManifest(t, []tarEntry{
+		{typeflag: tar.TypeDir, name: "a/"},
+		{typeflag: tar.TypeReg, name: "a/x", content: "x2"},
+		{typeflag: tar.TypeReg, name: ".wh.b"},
+		{typeflag: tar.TypeDir, name: "c/"},
+		{typeflag: tar.TypeReg, name: "c/n", content: "n"},
+		{typeflag: tar.TypeReg, name: "d", content: "d"},
+		{typeflag: tar.TypeReg, name: ".wh.f"},
+		{typeflag: tar.TypeDir, name: "o/"},
+		{typeflag: tar.TypeReg, name: "o/.wh..wh..opq"},
+		{typeflag: tar.TypeReg, name: "o/q", content: "q"},
+		// whiteouts only apply to the layers below.
+		{typeflag: tar.TypeReg, name: "o/.wh.q"},
+	})
+
+	m, err := lower.Overlay(upper)
+	if err != nil {
+		t.Fatalf("error overlaying manifests: %v", err)
+	}
+
+	expected := []string{
+		`/a/`,
+		`/a/x "x2"`,
+		`/a/y "y"`,
+		`/c/`,
+		`/c/n "n"`,
+		`/d "d"`,
+		`/g "f"`,
+		`/o/`,
+		`/o/q "q"`,
+	}
+	if lines := describeManifest(m, "x", "x2", "y", "z", "c", "n", "d", "e", "f", "p", "q"); !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("unexpected overlay:\n%s\nexpected:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// entries cannot be placed beneath a file without replacing it.
+	if _, err := lower.Overlay(buildTarManifest(t, []tarEntry{
+		{typeflag: tar.TypeReg, name: "c/n", content: "n"},
+	})); err == nil {
+		t.Fatal("expected overlay beneath a file to fail")
+	}
+}
@@ -23,9 +23,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/containerd/continuity/devices"
 	driverpkg "github.com/containerd/continuity/driver"
 	"github.com/containerd/continuity/pathdriver"
 
@@ -61,8 +62,55 @@ type ContextOptions struct {
 	Driver     driverpkg.Driver
 	PathDriver pathdriver.PathDriver
 	Provider   ContentProvider
+
+	// Timestamps selects the file times recorded by Resource. Verify only
+	// compares the selected times. Apply always restores the access and
+	// modification times recorded in a resource.
+	Timestamps Timestamps
+
+	// UIDMap and GIDMap map the user and group ids recorded in resources,
+	// which are ids of a container, to the ids of the files under the root,
+	// which are ids of the host. Resource translates the ids of files, and
+	// of the root id of file capabilities and the entries of ACLs, to
+	// container ids, and Apply translates them back to host ids. Ids outside
+	// of the ranges are an error. Without ranges, ids are not translated.
+	UIDMap []IDMap
+	GIDMap []IDMap
+
+	// Rootless applies resources without privileges. Rather than changing
+	// the owner of files and creating devices, Apply records the owner,
+	// mode, type and device numbers of resources in the
+	// user.containers.override_stat xattr, as fuse-overlayfs does, and
+	// creates empty regular files in place of devices, named pipes and
+	// sockets. Resource reads the recorded metadata back. Symlinks cannot
+	// carry the xattr and keep the owner of the files created, so Verify
+	// does not compare their owner. Rootless is only supported on Linux.
+	Rootless bool
+
+	// Names resolves owners by name, against the etc/passwd and etc/group
+	// files of the root rather than those of the host. Resource records the
+	// names of the owners of files. Apply and Verify use the ids the names
+	// recorded in resources have under the root, falling back to the
+	// recorded ids for names without an entry. The files are read when the
+	// context is created.
+	Names bool
 }
 
+// Timestamps is a set of file times to record in resources.
+type Timestamps uint
+
+const (
+	// TimestampModify selects the modification time.
+	TimestampModify Timestamps = 1 << iota
+
+	// TimestampAccess selects the access time.
+	TimestampAccess
+
+	// TimestampChange selects the inode change time. It can be recorded and
+	// verified but cannot be restored.
+	TimestampChange
+)
+
 // context represents a file system context for accessing resources.
 // Generally, all path qualified access and system considerations should land
 // here.
@@ -72,6 +120,10 @@ type context struct {
 	root       string
 	digester   Digester
 	provider   ContentProvider
+	timestamps Timestamps
+	ids        idMapping
+	rootless   bool
+	names      *NameDatabase
 }
 
 // NewContext returns a Context associated with root. The default driver will
@@ -120,13 +172,25 @@ func NewContextWithOptions(root string, options ContextOptions) (Context, error)
 		return nil, &os.PathError{Op: "NewContext", Path: root, Err: os.ErrInvalid}
 	}
 
-	return &context{
+	c := &context{
 		root:       root,
 		driver:     driver,
 		pathDriver: pathDriver,
 		digester:   digester,
 		provider:   options.Provider,
-	}, nil
+		timestamps: options.Timestamps,
+		ids:        idMapping{uids: options.UIDMap, gids: options.GIDMap},
+		rootless:   options.Rootless,
+	}
+
+	if options.Names {
+		c.names, err = c.readNameDatabase()
+		if err != nil {
+			return nil, fmt.Errorf("error reading names: %w", err)
+		}
+	}
+
+	return c, nil
 }
 
 // Resource returns the resource as path p, populating the entry with info
@@ -134,6 +198,16 @@ func NewContextWithOptions(root string, options ContextOptions) (Context, error)
 // typically obtained through Walk or from the value of Resource.Path(). If fi
 // is nil, it will be resolved.
 func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
+	return c.resource(p, fi, nil)
+}
+
+// cachedResource returns the resource at path p like Resource, using dgsts
+// as the digests of a regular file rather than reading it.
+func (c *context) cachedResource(p string, fi os.FileInfo, dgsts []digest.Digest) (Resource, error) {
+	return c.resource(p, fi, dgsts)
+}
+
+func (c *context) resource(p string, fi os.FileInfo, dgsts []digest.Digest) (Resource, error) {
 	fp, err := c.fullpath(p)
 	if err != nil {
 		return nil, err
@@ -146,25 +220,45 @@ func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
 		}
 	}
 
-	base, err := newBaseResource(p, fi)
+	fi, err = c.overrideFileInfo(fp, fi)
 	if err != nil {
 		return nil, err
 	}
 
+	base, err := c.baseResource(p, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	base.user, _ = c.names.UserName(base.uid)
+	base.group, _ = c.names.GroupName(base.gid)
+
 	base.xattrs, err = c.resolveXAttrs(fp, fi, base)
 	if err != nil && !errors.Is(err, ErrNotSupported) {
 		return nil, err
 	}
 
+	base.flags, err = c.resolveInodeFlags(fp, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.resolveTimes(fi, base); err != nil {
+		return nil, err
+	}
+
 	// TODO(stevvooe): Handle windows alternate data streams.
 
 	if fi.Mode().IsRegular() {
-		dgst, err := c.digest(p)
-		if err != nil {
-			return nil, err
+		if len(dgsts) == 0 {
+			dgst, err := c.digest(p)
+			if err != nil {
+				return nil, err
+			}
+			dgsts = []digest.Digest{dgst}
 		}
 
-		return newRegularFile(*base, base.paths, fi.Size(), dgst)
+		return newRegularFile(*base, base.paths, fi.Size(), dgsts...)
 	}
 
 	if fi.Mode().IsDir() {
@@ -187,6 +281,10 @@ func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
 		return newNamedPipe(*base, base.paths)
 	}
 
+	if fi.Mode()&os.ModeSocket != 0 {
+		return newSocket(*base, base.paths)
+	}
+
 	if fi.Mode()&os.ModeDevice != 0 {
 		deviceDriver, ok := c.driver.(driverpkg.DeviceInfoDriver)
 		if !ok {
@@ -206,98 +304,153 @@ func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
 	return nil, fmt.Errorf("%q (%v) is not supported: %w", fp, fi.Mode(), ErrNotFound)
 }
 
-func (c *context) verifyMetadata(resource, target Resource) error {
-	if target.Mode() != resource.Mode() {
-		return fmt.Errorf("resource %q has incorrect mode: %v != %v", target.Path(), target.Mode(), resource.Mode())
+// verifyMetadata compares the metadata of target against resource, returning
+// a *Mismatch for every discrepancy found. In rootless mode, the owner of
+// symlinks is not compared: they cannot carry xattrOverrideStat and keep the
+// owner of the user applying the manifest.
+func (c *context) verifyMetadata(resource, target Resource) []*Mismatch {
+	var mismatches []*Mismatch
+	mismatch := func(kind MismatchKind, name string, expected, actual interface{}) {
+		mismatches = append(mismatches, &Mismatch{
+			Kind:     kind,
+			Path:     target.Path(),
+			Name:     name,
+			Expected: expected,
+			Actual:   actual,
+		})
 	}
 
-	if target.UID() != resource.UID() {
-		return fmt.Errorf("unexpected uid for %q: %v != %v", target.Path(), target.UID(), resource.GID())
+	if target.Mode() != resource.Mode() {
+		mismatch(MismatchMode, "", resource.Mode(), target.Mode())
 	}
 
-	if target.GID() != resource.GID() {
-		return fmt.Errorf("unexpected gid for %q: %v != %v", target.Path(), target.GID(), resource.GID())
-	}
+	if _, ok := target.(SymLink); !ok || !c.rootless {
+		uid, gid := c.owner(resource)
+		if target.UID() != uid {
+			mismatch(MismatchUID, "", uid, target.UID())
+		}
 
-	if xattrer, ok := resource.(XAttrer); ok {
-		txattrer, tok := target.(XAttrer)
-		if !tok {
-			return fmt.Errorf("resource %q has xattrs but target does not support them", resource.Path())
+		if target.GID() != gid {
+			mismatch(MismatchGID, "", gid, target.GID())
 		}
+	}
 
+	if xattrer, ok := resource.(XAttrer); ok {
 		// For xattrs, only ensure that we have those defined in the resource
 		// and their values match. We can ignore other xattrs. In other words,
 		// we only verify that target has the subset defined by resource.
-		txattrs := txattrer.XAttrs()
+		var txattrs map[string][]byte
+		if txattrer, ok := target.(XAttrer); ok {
+			txattrs = txattrer.XAttrs()
+		}
 		for attr, value := range xattrer.XAttrs() {
 			tvalue, ok := txattrs[attr]
 			if !ok {
-				return fmt.Errorf("resource %q target missing xattr %q", resource.Path(), attr)
-			}
-
-			if !bytes.Equal(value, tvalue) {
-				return fmt.Errorf("xattr %q value differs for resource %q", attr, resource.Path())
+				mismatch(MismatchXAttr, attr, value, nil)
+			} else if !bytes.Equal(value, tvalue) {
+				mismatch(MismatchXAttr, attr, value, tvalue)
 			}
 		}
 	}
 
+	if inodeFlagsOf(target) != inodeFlagsOf(resource) {
+		mismatch(MismatchFlags, "", inodeFlagsOf(resource), inodeFlagsOf(target))
+	}
+
+	if tr, ok := resource.(Timestamper); ok {
+		mismatches = append(mismatches, c.verifyTimes(tr, target)...)
+	}
+
+	// TODO(stevvooe): Another reason to use a record-based approach. We
+	// have to do another type switch to get this to work. This could be
+	// fixed with an Equal function, but let's study this a little more to
+	// be sure.
+	if resourceType(target) != resourceType(resource) {
+		mismatch(MismatchType, "", resourceType(resource), resourceType(target))
+		return mismatches
+	}
+
 	switch r := resource.(type) {
 	case RegularFile:
-		// TODO(stevvooe): Another reason to use a record-based approach. We
-		// have to do another type switch to get this to work. This could be
-		// fixed with an Equal function, but let's study this a little more to
-		// be sure.
-		t, ok := target.(RegularFile)
-		if !ok {
-			return fmt.Errorf("resource %q target not a regular file", r.Path())
-		}
-
+		t := target.(RegularFile)
 		if t.Size() != r.Size() {
-			return fmt.Errorf("resource %q target has incorrect size: %v != %v", t.Path(), t.Size(), r.Size())
+			mismatch(MismatchSize, "", r.Size(), t.Size())
 		}
 	case Directory:
-		t, ok := target.(Directory)
-		if !ok {
-			return fmt.Errorf("resource %q target not a directory", t.Path())
-		}
 	case SymLink:
-		t, ok := target.(SymLink)
-		if !ok {
-			return fmt.Errorf("resource %q target not a symlink", t.Path())
-		}
-
+		t := target.(SymLink)
 		if t.Target() != r.Target() {
-			return fmt.Errorf("resource %q target has mismatched target: %q != %q", t.Path(), t.Target(), r.Target())
+			mismatch(MismatchTarget, "", r.Target(), t.Target())
 		}
 	case Device:
-		t, ok := target.(Device)
-		if !ok {
-			return fmt.Errorf("resource %q is not a device", t.Path())
-		}
-
+		t := target.(Device)
 		if t.Major() != r.Major() || t.Minor() != r.Minor() {
-			return fmt.Errorf("resource %q has mismatched major/minor numbers: %d,%d != %d,%d", t.Path(), t.Major(), t.Minor(), r.Major(), r.Minor())
+			mismatch(MismatchDevice, "", fmt.Sprintf("%d,%d", r.Major(), r.Minor()), fmt.Sprintf("%d,%d", t.Major(), t.Minor()))
 		}
 	case NamedPipe:
-		t, ok := target.(NamedPipe)
-		if !ok {
-			return fmt.Errorf("resource %q is not a named pipe", t.Path())
-		}
+	case Socket:
 	default:
-		return fmt.Errorf("cannot verify resource: %v", resource)
+		mismatch(MismatchType, "", resourceType(resource), resourceType(target))
 	}
 
-	return nil
+	return mismatches
+}
+
+// verifyTimes compares the times selected for the context that are recorded
+// in both resource and target.
+func (c *context) verifyTimes(resource Timestamper, target Resource) []*Mismatch {
+	tt, ok := target.(Timestamper)
+	if !ok {
+		return nil
+	}
+
+	var mismatches []*Mismatch
+	for _, ts := range []struct {
+		selected         Timestamps
+		name             string
+		expected, actual time.Time
+	}{
+		{TimestampModify, "mtime", resource.ModTime(), tt.ModTime()},
+		{TimestampAccess, "atime", resource.AccessTime(), tt.AccessTime()},
+		{TimestampChange, "ctime", resource.ChangeTime(), tt.ChangeTime()},
+	} {
+		if c.timestamps&ts.selected == 0 || ts.expected.IsZero() || ts.actual.IsZero() {
+			continue
+		}
+
+		if !ts.actual.Equal(ts.expected) {
+			mismatches = append(mismatches, &Mismatch{
+				Kind:     MismatchTime,
+				Path:     target.Path(),
+				Name:     ts.name,
+				Expected: ts.expected,
+				Actual:   ts.actual,
+			})
+		}
+	}
+
+	return mismatches
 }
 
 // Verify the resource in the context. An error will be returned a discrepancy
-// is found.
+// is found. All discrepancies found for the resource are reported as *Mismatch
+// errors, joined with errors.Join if there is more than one.
 func (c *context) Verify(resource Resource) error {
 	fp, err := c.fullpath(resource.Path())
 	if err != nil {
 		return err
 	}
 
+	if _, ok := resource.(Whiteout); ok {
+		// whited out paths must not exist.
+		if _, err := c.driver.Lstat(fp); err == nil {
+			return joinMismatches([]*Mismatch{{Kind: MismatchExtra, Path: resource.Path()}})
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
 	fi, err := c.driver.Lstat(fp)
 	if err != nil {
 		return err
@@ -312,56 +465,27 @@ func (c *context) Verify(resource Resource) error {
 		return fmt.Errorf("resource paths do not match: %q != %q", target.Path(), resource.Path())
 	}
 
-	if err := c.verifyMetadata(resource, target); err != nil {
-		return err
-	}
+	mismatches := c.verifyMetadata(resource, target)
 
 	if h, isHardlinkable := resource.(Hardlinkable); isHardlinkable {
 		hardlinkKey, err := newHardlinkKey(fi)
-		if err == errNotAHardLink {
-			if len(h.Paths()) > 1 {
-				return fmt.Errorf("%q is not a hardlink to %q", h.Paths()[1], resource.Path())
-			}
-		} else if err != nil {
+		if err != nil && err != errNotAHardLink {
 			return err
 		}
 
-		for _, path := range h.Paths()[1:] {
-			fpLink, err := c.fullpath(path)
-			if err != nil {
-				return err
-			}
-
-			fiLink, err := c.driver.Lstat(fpLink)
-			if err != nil {
-				return err
-			}
-
-			targetLink, err := c.Resource(path, fiLink)
-			if err != nil {
-				return err
-			}
-
-			hardlinkKeyLink, err := newHardlinkKey(fiLink)
-			if err != nil {
-				return err
-			}
-
-			if hardlinkKeyLink != hardlinkKey {
-				return fmt.Errorf("%q is not a hardlink to %q", path, resource.Path())
-			}
-
-			if err := c.verifyMetadata(resource, targetLink); err != nil {
-				return err
-			}
+		linkMismatches, err := c.verifyHardlinks(resource, h.Paths()[1:], hardlinkKey, err == nil)
+		if err != nil {
+			return err
 		}
+		mismatches = append(mismatches, linkMismatches...)
 	}
 
 	switch r := resource.(type) {
 	case RegularFile:
 		t, ok := target.(RegularFile)
 		if !ok {
-			return fmt.Errorf("resource %q target not a regular file", r.Path())
+			// type mismatch has been reported by verifyMetadata.
+			break
 		}
 
 		// TODO(stevvooe): This may need to get a little more sophisticated
@@ -369,11 +493,61 @@ func (c *context) Verify(resource Resource) error {
 		// provided digests, rather than the implementations having an
 		// overlap.
 		if !digestsMatch(t.Digests(), r.Digests()) {
-			return fmt.Errorf("digests for resource %q do not match: %v != %v", t.Path(), t.Digests(), r.Digests())
+			mismatches = append(mismatches, &Mismatch{
+				Kind:     MismatchDigest,
+				Path:     t.Path(),
+				Expected: r.Digests(),
+				Actual:   t.Digests(),
+			})
 		}
 	}
 
-	return nil
+	return joinMismatches(mismatches)
+}
+
+// verifyHardlinks checks that each of paths is a hardlink to the file
+// identified by key with metadata matching resource. If linked is false, the
+// resource has no other links and each existing path is reported.
+func (c *context) verifyHardlinks(resource Resource, paths []string, key hardlinkKey, linked bool) ([]*Mismatch, error) {
+	var mismatches []*Mismatch
+	for _, path := range paths {
+		fp, err := c.fullpath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := c.driver.Lstat(fp)
+		if err != nil {
+			if os.IsNotExist(err) {
+				mismatches = append(mismatches, &Mismatch{Kind: MismatchMissing, Path: path})
+				continue
+			}
+			return nil, err
+		}
+
+		linkKey, err := newHardlinkKey(fi)
+		if err != nil && err != errNotAHardLink {
+			return nil, err
+		}
+
+		if !linked || err == errNotAHardLink || linkKey != key {
+			mismatches = append(mismatches, &Mismatch{
+				Kind:     MismatchHardlink,
+				Path:     path,
+				Expected: resource.Path(),
+			})
+			continue
+		}
+
+		target, err := c.Resource(path, fi)
+		if err != nil {
+			return nil, err
+		}
+
+		mismatches = append(mismatches, c.verifyMetadata(resource, target)...)
+	}
+
+	return mismatches, nil
 }
 
 func (c *context) checkoutFile(fp string, rf RegularFile) error {
@@ -395,13 +569,71 @@ func (c *context) checkoutFile(fp string, rf RegularFile) error {
 	}
 	defer r.Close()
 
-	return atomicWriteFile(fp, r, rf.Size(), rf.Mode())
+	return atomicWriteFile(fp, r, rf.Size(), c.createMode(rf))
 }
 
 // Apply the resource to the contexts. An error will be returned if the
 // operation fails. Depending on the resource type, the resource may be
 // created. For resource that cannot be resolved, an error will be returned.
 func (c *context) Apply(resource Resource) error {
+	return c.apply(resource, false)
+}
+
+// applyExact applies the resource like Apply, but makes the result match the
+// resource exactly. Existing entries of a different type are replaced and
+// xattrs not defined by the resource are removed.
+func (c *context) applyExact(resource Resource) error {
+	return c.apply(resource, true)
+}
+
+// readDirNames returns the sorted names of the entries of the directory at
+// the full path fp.
+func (c *context) readDirNames(fp string) ([]string, error) {
+	f, err := c.driver.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if isTransactionDir(c.root, filepath.Join(fp, fi.Name()), fi) {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// remove removes the entry at path p from the context. Directories must be
+// empty.
+func (c *context) remove(p string) error {
+	fp, err := c.fullpath(p)
+	if err != nil {
+		return err
+	}
+
+	return c.driver.Remove(fp)
+}
+
+// apply applies the resource by running the operations planned for it, so
+// that a plan lists exactly what apply does.
+func (c *context) apply(resource Resource, exact bool) error {
+	return c.applyOperations(resource, exact, nil)
+}
+
+// applyOperations applies the resource like apply, calling record, if set,
+// with each operation before it is run. The operations changing the entry
+// are run first. Its metadata is then planned against the entry as they
+// left it.
+func (c *context) applyOperations(resource Resource, exact bool, record func(Operation) error) error {
 	fp, err := c.fullpath(resource.Path())
 	if err != nil {
 		return err
@@ -411,178 +643,324 @@ func (c *context) Apply(resource Resource) error {
 		return fmt.Errorf("resource %v escapes root", resource)
 	}
 
-	chmod := true
-	fi, err := c.driver.Lstat(fp)
+	fi, err := c.lstat(fp)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return err
 		}
 	}
 
-	switch r := resource.(type) {
-	case RegularFile:
-		if fi == nil {
-			if err := c.checkoutFile(fp, r); err != nil {
-				return fmt.Errorf("error checking out file %q: %w", resource.Path(), err)
-			}
-			chmod = false
-		} else {
-			if !fi.Mode().IsRegular() {
-				return fmt.Errorf("file %q should be a regular file, but is not", resource.Path())
-			}
-			if fi.Size() != r.Size() {
-				if err := c.checkoutFile(fp, r); err != nil {
-					return fmt.Errorf("error checking out file %q: %w", resource.Path(), err)
-				}
-			} else {
-				for _, dgst := range r.Digests() {
-					f, err := os.Open(fp)
-					if err != nil {
-						return fmt.Errorf("failure opening file for read %q: %w", resource.Path(), err)
-					}
-					compared, err := dgst.Algorithm().FromReader(f)
-					if err == nil && dgst != compared {
-						if err := c.checkoutFile(fp, r); err != nil {
-							return fmt.Errorf("error checking out file %q: %w", resource.Path(), err)
-						}
-						break
-					}
-					if err1 := f.Close(); err == nil {
-						err = err1
-					}
-					if err != nil {
-						return fmt.Errorf("error checking digest for %q: %w", resource.Path(), err)
-					}
-				}
-			}
+	r := &operationRunner{c: c, resource: resource, fp: fp, record: record}
+	if fi != nil {
+		flags, err := c.resolveInodeFlags(fp, fi)
+		if err != nil {
+			return err
 		}
-	case Directory:
-		if fi == nil {
-			if err := c.driver.Mkdir(fp, resource.Mode()); err != nil {
+		r.locked = flags&inodeFlagsLocked != 0
+	}
+
+	operations, _, err := c.planEntry(resource, fp, fi, exact)
+	if err != nil {
+		return err
+	}
+	if err := r.run(operations); err != nil {
+		return err
+	}
+
+	if _, ok := resource.(Whiteout); ok {
+		return nil
+	}
+
+	fi, err = c.lstat(fp)
+	if err != nil {
+		return err
+	}
+
+	operations, err = c.planMetadata(resource, fp, fi, exact)
+	if err != nil {
+		return err
+	}
+	if err := r.run(operations); err != nil {
+		return err
+	}
+
+	return r.relock()
+}
+
+// applyMetadata applies the metadata of the resource to the existing entry
+// at fp, running the operations planned for it.
+func (c *context) applyMetadata(fp string, resource Resource, exact bool) error {
+	fi, err := c.lstat(fp)
+	if err != nil {
+		return err
+	}
+
+	operations, err := c.planMetadata(resource, fp, fi, exact)
+	if err != nil {
+		return err
+	}
+
+	r := &operationRunner{c: c, resource: resource, fp: fp}
+	return r.run(operations)
+}
+
+// operationRunner runs the operations planned for a resource.
+type operationRunner struct {
+	c        *context
+	resource Resource
+	fp       string
+	record   func(Operation) error
+
+	// locked is set while the entry is immutable or append-only, which
+	// prevents any change to it. The flags are cleared before the first
+	// operation and restored last.
+	locked bool
+
+	// unlocked is set once the flags have been cleared and until they are
+	// set again.
+	unlocked bool
+}
+
+func (r *operationRunner) run(operations []Operation) error {
+	for _, op := range operations {
+		if r.record != nil {
+			if err := r.record(op); err != nil {
 				return err
 			}
-		} else if !fi.Mode().IsDir() {
-			return fmt.Errorf("%q should be a directory, but is not", resource.Path())
 		}
 
-	case SymLink:
-		var target string // only possibly set if target resource is a symlink
-
-		if fi != nil {
-			if fi.Mode()&os.ModeSymlink != 0 {
-				target, err = c.driver.Readlink(fp)
-				if err != nil {
-					return err
-				}
+		if r.locked {
+			if err := r.unlock(); err != nil {
+				return fmt.Errorf("error clearing inode flags of %q: %w", r.resource.Path(), err)
 			}
 		}
 
-		if target != r.Target() {
-			if fi != nil {
-				if err := c.driver.Remove(fp); err != nil { // RemoveAll in case of directory?
-					return err
-				}
-			}
+		if op.Kind == OperationChattr {
+			r.unlocked = false
+		}
 
-			if err := c.driver.Symlink(r.Target(), fp); err != nil {
-				return err
-			}
+		if err := r.c.runOperation(r.resource, r.fp, op); err != nil {
+			return err
 		}
+	}
 
-	case Device:
-		if fi == nil {
-			if err := c.driver.Mknod(fp, resource.Mode(), int(r.Major()), int(r.Minor())); err != nil {
-				return err
-			}
-		} else if (fi.Mode() & os.ModeDevice) == 0 {
-			return fmt.Errorf("%q should be a device, but is not", resource.Path())
-		} else {
-			major, minor, err := devices.DeviceInfo(fi)
-			if err != nil {
-				return err
-			}
-			if major != r.Major() || minor != r.Minor() {
-				if err := c.driver.Remove(fp); err != nil {
-					return err
-				}
-
-				if err := c.driver.Mknod(fp, resource.Mode(), int(r.Major()), int(r.Minor())); err != nil {
-					return err
-				}
-			}
+	return nil
+}
+
+// unlock clears the immutable and append-only flags of the entry, if it
+// was not moved aside by record.
+func (r *operationRunner) unlock() error {
+	r.locked = false
+
+	fi, err := r.c.driver.Lstat(r.fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
+	}
 
-	case NamedPipe:
-		if fi == nil {
-			if err := c.driver.Mkfifo(fp, resource.Mode()); err != nil {
-				return err
-			}
-		} else if (fi.Mode() & os.ModeNamedPipe) == 0 {
-			return fmt.Errorf("%q should be a named pipe, but is not", resource.Path())
+	if err := r.c.unlockInodeFlags(r.fp, fi); err != nil {
+		return err
+	}
+	r.unlocked = true
+
+	return nil
+}
+
+// relock sets the flags of the resource again, if the operations cleared
+// them without changing them.
+func (r *operationRunner) relock() error {
+	if !r.unlocked {
+		return nil
+	}
+
+	return r.run([]Operation{{Kind: OperationChattr, Path: r.resource.Path(), Detail: inodeFlagsOf(r.resource).String()}})
+}
+
+// runOperation performs the operation planned for the resource, whose entry
+// is at fp.
+func (c *context) runOperation(resource Resource, fp string, op Operation) error {
+	switch op.Kind {
+	case OperationRemove:
+		p, err := c.fullpath(op.Path)
+		if err != nil {
+			return err
+		}
+		return c.driver.RemoveAll(p)
+	case OperationCreateFile, OperationRewriteFile:
+		if err := c.checkoutFile(fp, resource.(RegularFile)); err != nil {
+			return fmt.Errorf("error checking out file %q: %w", resource.Path(), err)
+		}
+		return nil
+	case OperationMkdir:
+		return c.driver.Mkdir(fp, c.createMode(resource))
+	case OperationSymlink:
+		return c.driver.Symlink(resource.(SymLink).Target(), fp)
+	case OperationReplaceSymlink:
+		if err := c.driver.Remove(fp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return c.driver.Symlink(resource.(SymLink).Target(), fp)
+	case OperationMknod:
+		d := resource.(Device)
+		return c.driver.Mknod(fp, d.Mode(), int(d.Major()), int(d.Minor()))
+	case OperationMkfifo:
+		return c.driver.Mkfifo(fp, resource.Mode())
+	case OperationMksock:
+		socketDriver, ok := c.driver.(driverpkg.SocketDriver)
+		if !ok {
+			return fmt.Errorf("creating socket %q: %w", resource.Path(), ErrNotSupported)
 		}
+		return socketDriver.Mksock(fp, resource.Mode())
+	case OperationPlaceholder:
+		return c.createPlaceholder(fp, c.createMode(resource))
+	case OperationLink:
+		lp, err := c.fullpath(op.Path)
+		if err != nil {
+			return err
+		}
+		if err := c.driver.Remove(lp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return c.driver.Link(fp, lp)
+	case OperationChown:
+		uid, gid, err := c.ids.ownerToHost(c.owner(resource))
+		if err != nil {
+			return fmt.Errorf("error mapping owner of %q: %w", resource.Path(), err)
+		}
+		if err := c.driver.Lchown(fp, uid, gid); err != nil {
+			return err
+		}
+		if resource.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			// changing the owner clears the setuid and setgid bits.
+			return c.driver.Lchmod(fp, resource.Mode())
+		}
+		return nil
+	case OperationChmod:
+		return c.driver.Lchmod(fp, c.createMode(resource))
+	case OperationSetXAttr:
+		return c.setXAttr(fp, resource, op.Detail)
+	case OperationRemoveXAttr:
+		if err := c.removeXAttr(fp, resource, op.Detail); err != nil {
+			return fmt.Errorf("error removing xattrs from %q: %w", resource.Path(), err)
+		}
+		return nil
+	case OperationChtimes:
+		t, ok := resource.(Timestamper)
+		if !ok {
+			return nil
+		}
+		if err := c.applyTimes(fp, t); err != nil {
+			return fmt.Errorf("error setting times on %q: %w", resource.Path(), err)
+		}
+		return nil
+	case OperationChattr:
+		if err := c.applyInodeFlags(fp, inodeFlagsOf(resource)); err != nil {
+			return fmt.Errorf("error setting inode flags on %q: %w", resource.Path(), err)
+		}
+		return nil
 	}
 
-	if h, isHardlinkable := resource.(Hardlinkable); isHardlinkable {
-		for _, path := range h.Paths() {
-			if path == resource.Path() {
-				continue
-			}
+	return fmt.Errorf("unsupported operation %v", op)
+}
 
-			lp, err := c.fullpath(path)
-			if err != nil {
-				return err
-			}
+// applyTimes sets the access and modification times recorded by t on the
+// file at fp. If only one of them is recorded, the other is left unchanged.
+func (c *context) applyTimes(fp string, t Timestamper) error {
+	mtime, atime := t.ModTime(), t.AccessTime()
+	if mtime.IsZero() && atime.IsZero() {
+		return nil
+	}
 
-			if _, fi := c.driver.Lstat(lp); fi == nil {
-				c.driver.Remove(lp)
-			}
-			if err := c.driver.Link(fp, lp); err != nil {
+	chtimesDriver, ok := c.driver.(driverpkg.LChtimesDriver)
+	if !ok {
+		return fmt.Errorf("setting times is not supported: %w", ErrNotSupported)
+	}
+
+	if mtime.IsZero() || atime.IsZero() {
+		fi, err := c.driver.Lstat(fp)
+		if err != nil {
+			return err
+		}
+
+		if mtime.IsZero() {
+			mtime = fi.ModTime()
+		}
+		if atime.IsZero() {
+			atime, _, err = statTimes(fi)
+			if err != nil {
 				return err
 			}
 		}
 	}
 
-	// Update filemode if file was not created
-	if chmod {
-		if err := c.driver.Lchmod(fp, resource.Mode()); err != nil {
-			return err
-		}
+	return chtimesDriver.Lchtimes(fp, atime, mtime)
+}
+
+// createMode returns the mode entries are created with for the resource. In
+// rootless mode, the owner keeps access to the entry and its xattrs.
+func (c *context) createMode(resource Resource) os.FileMode {
+	if c.rootless {
+		return rootlessMode(resource.Mode())
 	}
 
-	if err := c.driver.Lchown(fp, resource.UID(), resource.GID()); err != nil {
-		return err
+	return resource.Mode()
+}
+
+// setXAttr sets the xattr name recorded in the resource on the entry at fp.
+// In rootless mode, xattrOverrideStat records the owner, mode and type of
+// the resource instead.
+func (c *context) setXAttr(fp string, resource Resource, name string) error {
+	if c.rootless && name == xattrOverrideStat {
+		if err := c.applyOverrideStat(fp, resource); err != nil {
+			return fmt.Errorf("error recording owner and mode of %q: %w", resource.Path(), err)
+		}
+		return nil
 	}
 
+	var value []byte
 	if xattrer, ok := resource.(XAttrer); ok {
-		// For xattrs, only ensure that we have those defined in the resource
-		// and their values are set. We can ignore other xattrs. In other words,
-		// we only set xattres defined by resource but never remove.
+		value = xattrer.XAttrs()[name]
+	}
 
-		if _, ok := resource.(SymLink); ok {
-			lxattrDriver, ok := c.driver.(driverpkg.LXAttrDriver)
-			if !ok {
-				return fmt.Errorf("unsupported symlink xattr for resource %q", resource.Path())
-			}
-			if err := lxattrDriver.LSetxattr(fp, xattrer.XAttrs()); err != nil {
-				return err
-			}
-		} else {
-			xattrDriver, ok := c.driver.(driverpkg.XAttrDriver)
-			if !ok {
-				return fmt.Errorf("unsupported xattr for resource %q", resource.Path())
-			}
-			if err := xattrDriver.Setxattr(fp, xattrer.XAttrs()); err != nil {
-				return err
-			}
+	xattrs, err := c.ids.xattrsToHost(map[string][]byte{name: value})
+	if err != nil {
+		return fmt.Errorf("error mapping xattrs of %q: %w", resource.Path(), err)
+	}
+
+	if _, ok := resource.(SymLink); ok {
+		lxattrDriver, ok := c.driver.(driverpkg.LXAttrDriver)
+		if !ok {
+			return fmt.Errorf("unsupported symlink xattr for resource %q", resource.Path())
 		}
+		return lxattrDriver.LSetxattr(fp, xattrs)
 	}
 
-	return nil
+	xattrDriver, ok := c.driver.(driverpkg.XAttrDriver)
+	if !ok {
+		return fmt.Errorf("unsupported xattr for resource %q", resource.Path())
+	}
+	return xattrDriver.Setxattr(fp, xattrs)
+}
+
+// removeXAttr removes the xattr name from the entry at fp.
+func (c *context) removeXAttr(fp string, resource Resource, name string) error {
+	removeDriver, ok := c.driver.(driverpkg.RemoveXAttrDriver)
+	if !ok {
+		return fmt.Errorf("removing xattr %q: %w", name, ErrNotSupported)
+	}
+
+	if _, ok := resource.(SymLink); ok {
+		return removeDriver.LRemovexattr(fp, []string{name})
+	}
+	return removeDriver.Removexattr(fp, []string{name})
 }
 
 // Walk provides a convenience function to call filepath.Walk correctly for
 // the context. Otherwise identical to filepath.Walk, the path argument is
-// corrected to be contained within the context.
+// corrected to be contained within the context. The directories of
+// interrupted transactions in the root are skipped.
 func (c *context) Walk(fn filepath.WalkFunc) error {
 	root := c.root
 	fi, err := c.driver.Lstat(c.root)
@@ -593,6 +971,10 @@ func (c *context) Walk(fn filepath.WalkFunc) error {
 		}
 	}
 	return c.pathDriver.Walk(root, func(p string, fi os.FileInfo, _ error) error {
+		if fi != nil && isTransactionDir(root, p, fi) {
+			return filepath.SkipDir
+		}
+
 		contained, err := c.containWithRoot(p, root)
 		return fn(contained, fi, err)
 	})
@@ -635,6 +1017,33 @@ func (c *context) digest(p string) (digest.Digest, error) {
 	return c.digester.Digest(f)
 }
 
+// resolveTimes records the times selected for the context from fi into base.
+func (c *context) resolveTimes(fi os.FileInfo, base *resource) error {
+	if c.timestamps == 0 {
+		return nil
+	}
+
+	if c.timestamps&TimestampModify != 0 {
+		base.mtime = fi.ModTime()
+	}
+
+	if c.timestamps&(TimestampAccess|TimestampChange) != 0 {
+		atime, ctime, err := statTimes(fi)
+		if err != nil {
+			return err
+		}
+
+		if c.timestamps&TimestampAccess != 0 {
+			base.atime = atime
+		}
+		if c.timestamps&TimestampChange != 0 {
+			base.ctime = ctime
+		}
+	}
+
+	return nil
+}
+
 // resolveXAttrs attempts to resolve the extended attributes for the resource
 // at the path fp, which is the full path to the resource. If the resource
 // cannot have xattrs, nil will be returned.
@@ -645,7 +1054,17 @@ func (c *context) resolveXAttrs(fp string, fi os.FileInfo, base *resource) (map[
 			return nil, fmt.Errorf("xattr extraction is not supported: %w", ErrNotSupported)
 		}
 
-		return xattrDriver.Getxattr(fp)
+		xattrs, err := xattrDriver.Getxattr(fp)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.rootless {
+			// the xattr is read as the owner, mode and type of the file.
+			delete(xattrs, xattrOverrideStat)
+		}
+
+		return c.ids.xattrsToContainer(xattrs)
 	}
 
 	if fi.Mode()&os.ModeSymlink != 0 {
@@ -654,8 +1073,50 @@ func (c *context) resolveXAttrs(fp string, fi os.FileInfo, base *resource) (map[
 			return nil, fmt.Errorf("xattr extraction for symlinks is not supported: %w", ErrNotSupported)
 		}
 
-		return lxattrDriver.LGetxattr(fp)
+		xattrs, err := lxattrDriver.LGetxattr(fp)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.ids.xattrsToContainer(xattrs)
 	}
 
 	return nil, nil
 }
+
+// owner returns the ids of the owner of the resource. With names, the ids
+// of the names recorded in the resource are used, if they have an entry
+// under the root.
+func (c *context) owner(resource Resource) (uid, gid int64) {
+	uid, gid = resource.UID(), resource.GID()
+
+	n, ok := resource.(OwnerNamer)
+	if !ok {
+		return uid, gid
+	}
+
+	if id, ok := c.names.UserID(n.User()); ok && n.User() != "" {
+		uid = id
+	}
+	if id, ok := c.names.GroupID(n.Group()); ok && n.Group() != "" {
+		gid = id
+	}
+
+	return uid, gid
+}
+
+// baseResource returns a *resource populated with data from p and fi, like
+// newBaseResource, with the owner translated to container ids.
+func (c *context) baseResource(p string, fi os.FileInfo) (*resource, error) {
+	base, err := newBaseResource(p, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	base.uid, base.gid, err = c.ids.ownerToContainer(base.uid, base.gid)
+	if err != nil {
+		return nil, fmt.Errorf("error mapping owner of %q: %w", p, err)
+	}
+
+	return base, nil
+}
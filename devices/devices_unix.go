@@ -54,6 +54,8 @@ func Mknod(p string, mode os.FileMode, major, minor int) error {
 		}
 	} else if mode&os.ModeNamedPipe != 0 {
 		m |= unix.S_IFIFO
+	} else if mode&os.ModeSocket != 0 {
+		m |= unix.S_IFSOCK
 	}
 
 	return mknod(p, m, dev)
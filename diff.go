@@ -0,0 +1,365 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// ChangeKind is the kind of change made to a resource between two
+// manifests.
+type ChangeKind int
+
+const (
+	// ChangeAdded represents a resource only present in the second manifest.
+	ChangeAdded ChangeKind = iota + 1
+
+	// ChangeRemoved represents a resource only present in the first manifest.
+	ChangeRemoved
+
+	// ChangeModified represents a resource present in both manifests with
+	// differing attributes.
+	ChangeModified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	default:
+		return ""
+	}
+}
+
+// ChangeField identifies an attribute of a modified resource.
+type ChangeField int
+
+const (
+	// FieldType is set when the resource changed type, for example from a
+	// regular file to a directory. Type specific fields are not compared in
+	// that case.
+	FieldType ChangeField = iota + 1
+	FieldMode
+	FieldUID
+	FieldGID
+	FieldSize
+	FieldDigest
+	FieldXAttrs
+	FieldTarget
+	FieldDevice
+	FieldHardlinks
+	FieldTimes
+
+	// FieldOpaque is set when a directory became opaque or stopped being
+	// opaque.
+	FieldOpaque
+
+	// FieldFlags is set when the inode flags changed.
+	FieldFlags
+)
+
+func (f ChangeField) String() string {
+	switch f {
+	case FieldType:
+		return "type"
+	case FieldMode:
+		return "mode"
+	case FieldUID:
+		return "uid"
+	case FieldGID:
+		return "gid"
+	case FieldSize:
+		return "size"
+	case FieldDigest:
+		return "digest"
+	case FieldXAttrs:
+		return "xattrs"
+	case FieldTarget:
+		return "target"
+	case FieldDevice:
+		return "device"
+	case FieldHardlinks:
+		return "hardlinks"
+	case FieldTimes:
+		return "times"
+	case FieldOpaque:
+		return "opaque"
+	case FieldFlags:
+		return "flags"
+	default:
+		return ""
+	}
+}
+
+// ResourceChange describes the change of a single path between two
+// manifests.
+type ResourceChange struct {
+	Kind ChangeKind
+	Path string
+
+	// Original is the resource from the first manifest and Updated the
+	// resource from the second. Original is nil for added resources and
+	// Updated is nil for removed resources.
+	Original Resource
+	Updated  Resource
+
+	// Fields lists the attributes that differ for a modified resource.
+	Fields []ChangeField
+
+	// XAttrs lists the names of the extended attributes that were added,
+	// removed or changed, when Fields contains FieldXAttrs.
+	XAttrs []string
+}
+
+// DiffManifests compares manifest a to manifest b and returns the changes,
+// ordered by path. Every path of a hardlinked resource is compared on its
+// own, so a change to a hardlinked file is reported for each of its paths.
+// Times are only compared when recorded in both manifests.
+func DiffManifests(a, b *Manifest) []ResourceChange {
+	as, bs := indexByPath(a), indexByPath(b)
+
+	paths := make([]string, 0, len(as))
+	for p := range as {
+		paths = append(paths, p)
+	}
+	for p := range bs {
+		if _, ok := as[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []ResourceChange
+	for _, p := range paths {
+		ra, inA := as[p]
+		rb, inB := bs[p]
+
+		switch {
+		case !inB:
+			changes = append(changes, ResourceChange{Kind: ChangeRemoved, Path: p, Original: ra})
+		case !inA:
+			changes = append(changes, ResourceChange{Kind: ChangeAdded, Path: p, Updated: rb})
+		default:
+			fields, xattrs := diffResource(p, ra, rb)
+			if len(fields) > 0 {
+				changes = append(changes, ResourceChange{
+					Kind:     ChangeModified,
+					Path:     p,
+					Original: ra,
+					Updated:  rb,
+					Fields:   fields,
+					XAttrs:   xattrs,
+				})
+			}
+		}
+	}
+
+	return changes
+}
+
+// indexByPath maps every path of the resources in the manifest, including
+// all paths of hardlinked resources, to its resource.
+func indexByPath(m *Manifest) map[string]Resource {
+	index := make(map[string]Resource, len(m.Resources))
+	for _, rsrc := range m.Resources {
+		for _, p := range resourcePaths(rsrc) {
+			index[p] = rsrc
+		}
+	}
+
+	return index
+}
+
+// resourcePaths returns all paths of the resource.
+func resourcePaths(rsrc Resource) []string {
+	if h, ok := rsrc.(Hardlinkable); ok {
+		return h.Paths()
+	}
+
+	return []string{rsrc.Path()}
+}
+
+// diffResource returns the fields that differ between a and b, both found at
+// path p, and the names of the differing xattrs.
+func diffResource(p string, a, b Resource) ([]ChangeField, []string) {
+	var fields []ChangeField
+
+	if resourceType(a) != resourceType(b) {
+		fields = append(fields, FieldType)
+	}
+	if a.Mode() != b.Mode() {
+		fields = append(fields, FieldMode)
+	}
+	if a.UID() != b.UID() {
+		fields = append(fields, FieldUID)
+	}
+	if a.GID() != b.GID() {
+		fields = append(fields, FieldGID)
+	}
+
+	if len(fields) == 0 || fields[0] != FieldType {
+		switch ta := a.(type) {
+		case Directory:
+			if isOpaque(ta) != isOpaque(b) {
+				fields = append(fields, FieldOpaque)
+			}
+		case RegularFile:
+			tb := b.(RegularFile)
+			if ta.Size() != tb.Size() {
+				fields = append(fields, FieldSize)
+			}
+			if !digestsMatch(ta.Digests(), tb.Digests()) {
+				fields = append(fields, FieldDigest)
+			}
+		case SymLink:
+			if ta.Target() != b.(SymLink).Target() {
+				fields = append(fields, FieldTarget)
+			}
+		case Device:
+			tb := b.(Device)
+			if ta.Major() != tb.Major() || ta.Minor() != tb.Minor() {
+				fields = append(fields, FieldDevice)
+			}
+		}
+	}
+
+	xattrs := diffXAttrs(a, b)
+	if len(xattrs) > 0 {
+		fields = append(fields, FieldXAttrs)
+	}
+
+	if inodeFlagsOf(a) != inodeFlagsOf(b) {
+		fields = append(fields, FieldFlags)
+	}
+
+	if !equalStrings(otherPaths(a, p), otherPaths(b, p)) {
+		fields = append(fields, FieldHardlinks)
+	}
+
+	if !sameTimes(a, b) {
+		fields = append(fields, FieldTimes)
+	}
+
+	return fields, xattrs
+}
+
+// resourceType returns a name for the type of the resource.
+func resourceType(rsrc Resource) string {
+	switch rsrc.(type) {
+	case RegularFile:
+		return "file"
+	case Directory:
+		return "directory"
+	case SymLink:
+		return "symlink"
+	case NamedPipe:
+		return "pipe"
+	case Socket:
+		return "socket"
+	case Device:
+		return "device"
+	case Whiteout:
+		return "whiteout"
+	default:
+		return "unknown"
+	}
+}
+
+// isOpaque returns true if the resource is an opaque directory.
+func isOpaque(rsrc Resource) bool {
+	_, ok := rsrc.(OpaqueDirectory)
+	return ok
+}
+
+// diffXAttrs returns the sorted names of the xattrs that differ between a
+// and b.
+func diffXAttrs(a, b Resource) []string {
+	var xa, xb map[string][]byte
+	if x, ok := a.(XAttrer); ok {
+		xa = x.XAttrs()
+	}
+	if x, ok := b.(XAttrer); ok {
+		xb = x.XAttrs()
+	}
+
+	var names []string
+	for name, value := range xa {
+		if other, ok := xb[name]; !ok || !bytes.Equal(value, other) {
+			names = append(names, name)
+		}
+	}
+	for name := range xb {
+		if _, ok := xa[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// otherPaths returns the sorted paths hardlinked to p in the resource.
+func otherPaths(rsrc Resource, p string) []string {
+	var paths []string
+	for _, path := range resourcePaths(rsrc) {
+		if path != p {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameTimes compares the times recorded in both a and b.
+func sameTimes(a, b Resource) bool {
+	ta, ok := a.(Timestamper)
+	if !ok {
+		return true
+	}
+	tb, ok := b.(Timestamper)
+	if !ok {
+		return true
+	}
+
+	same := func(x, y time.Time) bool {
+		return x.IsZero() || y.IsZero() || x.Equal(y)
+	}
+
+	return same(ta.ModTime(), tb.ModTime()) &&
+		same(ta.AccessTime(), tb.AccessTime()) &&
+		same(ta.ChangeTime(), tb.ChangeTime())
+}
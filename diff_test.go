@@ -0,0 +1,105 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestDiffManifests(t *testing.T) {
+	a := &Manifest{
+		Resources: []Resource{
+			&directory{resource: resource{paths: []string{"/etc"}, mode: os.ModeDir | 0o755}},
+			&regularFile{
+				resource: resource{paths: []string{"/etc/hosts"}, mode: 0o644},
+				size:     10,
+				digests:  []digest.Digest{"sha256:aaaa"},
+			},
+			&regularFile{
+				resource: resource{paths: []string{"/etc/passwd", "/etc/passwd-"}, mode: 0o644},
+				size:     20,
+				digests:  []digest.Digest{"sha256:bbbb"},
+			},
+			&symLink{resource: resource{paths: []string{"/lib"}, mode: os.ModeSymlink | 0o777}, target: "usr/lib"},
+			&regularFile{
+				resource: resource{paths: []string{"/removed"}, mode: 0o644},
+				digests:  []digest.Digest{"sha256:cccc"},
+			},
+		},
+	}
+
+	b := &Manifest{
+		Resources: []Resource{
+			&directory{resource: resource{paths: []string{"/etc"}, mode: os.ModeDir | 0o755}},
+			&regularFile{
+				resource: resource{
+					paths:  []string{"/etc/hosts"},
+					mode:   0o600,
+					uid:    1,
+					xattrs: map[string][]byte{"user.a": []byte("1")},
+				},
+				size:    11,
+				digests: []digest.Digest{"sha256:dddd"},
+			},
+			&regularFile{
+				resource: resource{paths: []string{"/etc/passwd"}, mode: 0o644},
+				size:     20,
+				digests:  []digest.Digest{"sha256:bbbb"},
+			},
+			&regularFile{
+				resource: resource{paths: []string{"/etc/passwd-"}, mode: 0o644},
+				size:     20,
+				digests:  []digest.Digest{"sha256:bbbb"},
+			},
+			&directory{resource: resource{paths: []string{"/lib"}, mode: os.ModeDir | 0o755}},
+			&symLink{resource: resource{paths: []string{"/new"}, mode: os.ModeSymlink | 0o777}, target: "lib"},
+		},
+	}
+
+	type change struct {
+		kind   ChangeKind
+		path   string
+		fields []ChangeField
+		xattrs []string
+	}
+
+	expected := []change{
+		{ChangeModified, "/etc/hosts", []ChangeField{FieldMode, FieldUID, FieldSize, FieldDigest, FieldXAttrs}, []string{"user.a"}},
+		{ChangeModified, "/etc/passwd", []ChangeField{FieldHardlinks}, nil},
+		{ChangeModified, "/etc/passwd-", []ChangeField{FieldHardlinks}, nil},
+		{ChangeModified, "/lib", []ChangeField{FieldType, FieldMode}, nil},
+		{ChangeAdded, "/new", nil, nil},
+		{ChangeRemoved, "/removed", nil, nil},
+	}
+
+	var actual []change
+	for _, c := range DiffManifests(a, b) {
+		actual = append(actual, change{c.Kind, c.Path, c.Fields, c.XAttrs})
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("unexpected changes:\n%v\n!=\n%v", actual, expected)
+	}
+
+	if changes := DiffManifests(a, a); len(changes) != 0 {
+		t.Fatalf("expected no changes comparing a manifest to itself: %v", changes)
+	}
+}
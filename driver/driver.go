@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 var ErrNotSupported = fmt.Errorf("not supported")
@@ -108,6 +109,50 @@ type LXAttrDriver interface {
 	LSetxattr(path string, attr map[string][]byte) error
 }
 
+// RemoveXAttrDriver should be implemented by drivers on operating systems and
+// filesystems that support removing extended attributes.
+type RemoveXAttrDriver interface {
+	// Removexattr removes the named extended attributes from the file at
+	// path, following any symbolic links.
+	Removexattr(path string, attrs []string) error
+
+	// LRemovexattr removes the named extended attributes from the file at
+	// path, without following symbolic links.
+	LRemovexattr(path string, attrs []string) error
+}
+
+// LChtimesDriver should be implemented by drivers that can set the access
+// and modification times of a file. Symbolic links should not be followed
+// where the operating system allows it.
+type LChtimesDriver interface {
+	// Lchtimes changes the access and modification times of the file at
+	// path, similar to os.Chtimes.
+	Lchtimes(path string, atime, mtime time.Time) error
+}
+
+// SocketDriver should be implemented by drivers on operating systems that
+// support unix domain sockets.
+type SocketDriver interface {
+	// Mksock creates a unix socket node at path, which no process listens
+	// on.
+	Mksock(path string, mode os.FileMode) error
+}
+
+// InodeFlagsDriver should be implemented by drivers on operating systems and
+// filesystems that support inode flags, such as the immutable and
+// append-only flags on Linux. Only regular files and directories are
+// expected to carry inode flags.
+type InodeFlagsDriver interface {
+	// GetInodeFlags returns the inode flags of the file at path. Files on
+	// filesystems without support for inode flags have none. Files the
+	// caller may not open only report the flags the kernel exposes without
+	// opening them.
+	GetInodeFlags(path string) (uint32, error)
+
+	// SetInodeFlags replaces the inode flags of the file at path.
+	SetInodeFlags(path string, flags uint32) error
+}
+
 type DeviceInfoDriver interface {
 	DeviceInfo(fi os.FileInfo) (major uint64, minor uint64, err error)
 }
@@ -23,9 +23,11 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/containerd/continuity/devices"
 	"github.com/containerd/continuity/sysx"
+	"golang.org/x/sys/unix"
 )
 
 func (d *driver) Mknod(path string, mode os.FileMode, major, minor int) error {
@@ -49,6 +51,32 @@ func (d *driver) Mkfifo(path string, mode os.FileMode) error {
 	return err
 }
 
+// Mksock creates a unix socket node at path by binding a socket to it then
+// closing the socket. Paths too long for a socket address are created with
+// mknod, where the operating system supports it.
+func (d *driver) Mksock(path string, mode os.FileMode) error {
+	var raw unix.RawSockaddrUnix
+	if len(path) >= len(raw.Path) {
+		err := devices.Mknod(path, os.ModeSocket|mode.Perm(), 0, 0)
+		if err != nil {
+			err = &os.PathError{Op: "mksock", Path: path, Err: err}
+		}
+		return err
+	}
+
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return &os.PathError{Op: "mksock", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+		return &os.PathError{Op: "mksock", Path: path, Err: err}
+	}
+
+	return os.Chmod(path, mode.Perm())
+}
+
 // Getxattr returns all of the extended attributes for the file at path p.
 func (d *driver) Getxattr(p string) (map[string][]byte, error) {
 	xattrs, err := sysx.Listxattr(p)
@@ -128,6 +156,48 @@ func (d *driver) LSetxattr(path string, attrMap map[string][]byte) error {
 	return nil
 }
 
+// Removexattr removes the named extended attributes from the file at path,
+// following symbolic links.
+func (d *driver) Removexattr(path string, attrs []string) error {
+	for _, attr := range attrs {
+		if err := sysx.Removexattr(path, attr); err != nil {
+			return fmt.Errorf("error removing xattr %q on %s: %w", attr, path, err)
+		}
+	}
+
+	return nil
+}
+
+// LRemovexattr removes the named extended attributes from the file at path,
+// not following symbolic links.
+func (d *driver) LRemovexattr(path string, attrs []string) error {
+	for _, attr := range attrs {
+		if err := sysx.LRemovexattr(path, attr); err != nil {
+			return fmt.Errorf("error removing xattr %q on %s: %w", attr, path, err)
+		}
+	}
+
+	return nil
+}
+
+// Lchtimes changes the access and modification times of the file at path,
+// not following symbolic links.
+func (d *driver) Lchtimes(path string, atime, mtime time.Time) error {
+	at, err := unix.TimeToTimespec(atime)
+	if err != nil {
+		return &os.PathError{Op: "lchtimes", Path: path, Err: err}
+	}
+	mt, err := unix.TimeToTimespec(mtime)
+	if err != nil {
+		return &os.PathError{Op: "lchtimes", Path: path, Err: err}
+	}
+
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{at, mt}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "lchtimes", Path: path, Err: err}
+	}
+	return nil
+}
+
 func (d *driver) DeviceInfo(fi os.FileInfo) (major uint64, minor uint64, err error) {
 	return devices.DeviceInfo(fi)
 }
@@ -24,6 +24,7 @@ package driver
 
 import (
 	"os"
+	"time"
 )
 
 func (d *driver) Mknod(path string, mode os.FileMode, major, minor int) error {
@@ -39,3 +40,9 @@ func (d *driver) Lchmod(path string, mode os.FileMode) (err error) {
 	// TODO: Use Window's equivalent
 	return os.Chmod(path, mode)
 }
+
+// Lchtimes changes the access and modification times of a file.
+func (d *driver) Lchtimes(path string, atime, mtime time.Time) error {
+	// TODO: Do not follow symlinks
+	return os.Chtimes(path, atime, mtime)
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openInodeFlags opens the file at path for the inode flag ioctls, without
+// following symlinks or blocking on special files.
+func openInodeFlags(path string) (int, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return fd, nil
+}
+
+// GetInodeFlags returns the inode flags of the file at path, as read by
+// lsattr(1). Files the caller may not open for reading, such as directories
+// without read permission, only report the flags statx(2) exposes.
+func (d *driver) GetInodeFlags(path string) (uint32, error) {
+	fd, err := openInodeFlags(path)
+	if err != nil {
+		if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+			return statxInodeFlags(path)
+		}
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if noInodeFlags(err) {
+			return 0, nil
+		}
+		return 0, &os.PathError{Op: "getflags", Path: path, Err: err}
+	}
+	return flags, nil
+}
+
+// statxInodeFlags returns the immutable, append-only and nodump flags of the
+// file at path, which statx(2) reports through an O_PATH descriptor without
+// any permission on the file itself. The file attributes share the values
+// of the inode flags.
+func statxInodeFlags(path string) (uint32, error) {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+
+	var stx unix.Statx_t
+	if err := unix.Statx(fd, "", unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW, 0, &stx); err != nil {
+		if errors.Is(err, unix.ENOSYS) || noInodeFlags(err) {
+			return 0, nil
+		}
+		return 0, &os.PathError{Op: "statx", Path: path, Err: err}
+	}
+
+	attrs := stx.Attributes & stx.Attributes_mask
+	return uint32(attrs & (unix.STATX_ATTR_IMMUTABLE | unix.STATX_ATTR_APPEND | unix.STATX_ATTR_NODUMP)), nil
+}
+
+// noInodeFlags reports whether err means the flags of a file cannot be read,
+// either because its filesystem has none or because the caller may not read
+// them, in which case the file is treated as having none.
+func noInodeFlags(err error) bool {
+	return errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM)
+}
+
+// SetInodeFlags replaces the inode flags of the file at path, as changed by
+// chattr(1).
+func (d *driver) SetInodeFlags(path string, flags uint32) error {
+	fd, err := openInodeFlags(path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if err := unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags)); err != nil {
+		return &os.PathError{Op: "setflags", Path: path, Err: err}
+	}
+	return nil
+}
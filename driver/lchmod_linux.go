@@ -27,7 +27,7 @@ func (d *driver) Lchmod(path string, mode os.FileMode) error {
 	// On Linux, file mode is not supported for symlinks,
 	// and fchmodat() does not support AT_SYMLINK_NOFOLLOW,
 	// so symlinks need to be skipped entirely.
-	if st, err := os.Stat(path); err == nil && st.Mode()&os.ModeSymlink != 0 {
+	if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSymlink != 0 {
 		return nil
 	}
 
@@ -0,0 +1,231 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportOptions configures how a manifest is exported as a tar archive.
+type ExportOptions struct {
+	// ModTime is the modification time of every entry. The Unix epoch is
+	// used if zero.
+	ModTime time.Time
+}
+
+// ExportManifest writes the tree described by the manifest as a tar archive
+// to w, reading file content from provider. The archive is deterministic:
+// entries are sorted by path, every entry has the same modification time and
+// no owner names, further paths of hardlinked resources are written as links
+// to the first path and xattrs are written as PAX "SCHILY.xattr." records.
+// The root directory is written first if the manifest header describes it.
+// Whiteouts and opaque directories are written as OCI whiteout files, so
+// that a manifest of a layer exports to an image layer. Sockets cannot be
+// archived and are left out, like tar(1) does.
+func ExportManifest(w io.Writer, manifest *Manifest, provider ContentProvider, opts ExportOptions) error {
+	mtime := opts.ModTime
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	mtime = mtime.UTC().Truncate(time.Second)
+
+	var entries []exportEntry
+	for _, rsrc := range manifest.Resources {
+		if _, ok := rsrc.(Whiteout); ok {
+			dir, name := path.Split(rsrc.Path())
+			entries = append(entries, exportEntry{path: path.Join(dir, whiteoutPrefix+name), whiteout: true})
+			continue
+		}
+		if _, ok := rsrc.(Socket); ok {
+			continue
+		}
+		if isOpaque(rsrc) {
+			entries = append(entries, exportEntry{path: path.Join(rsrc.Path(), whiteoutOpaqueDir), whiteout: true})
+		}
+
+		paths := resourcePaths(rsrc)
+		sort.Strings(paths)
+
+		for i, p := range paths {
+			entry := exportEntry{path: p, resource: rsrc}
+			if i > 0 {
+				entry.link = paths[0]
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	tw := tar.NewWriter(w)
+	if manifest.Header != nil && manifest.Header.Root != nil {
+		root := manifest.Header.Root
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     "./",
+			Mode:     tarMode(root.Mode),
+			Uid:      int(root.UID),
+			Gid:      int(root.GID),
+			ModTime:  mtime,
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return fmt.Errorf("error exporting root: %w", err)
+		}
+	}
+
+	for _, entry := range entries {
+		if err := exportEntryTo(tw, entry, provider, mtime); err != nil {
+			return fmt.Errorf("error exporting %q: %w", entry.path, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// exportEntry is a single path of a resource in an exported archive. Link is
+// set for every path of a hardlinked resource but the first. Whiteout is set
+// for the empty files marking whiteouts and opaque directories, which have
+// no resource.
+type exportEntry struct {
+	path     string
+	link     string
+	whiteout bool
+	resource Resource
+}
+
+// exportEntryTo writes the header and content of entry to tw.
+func exportEntryTo(tw *tar.Writer, entry exportEntry, provider ContentProvider, mtime time.Time) error {
+	if entry.whiteout {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(entry.path, "/"),
+			ModTime:  mtime,
+			Format:   tar.FormatPAX,
+		})
+	}
+
+	rsrc := entry.resource
+	hdr := &tar.Header{
+		Name:    strings.TrimPrefix(entry.path, "/"),
+		Mode:    tarMode(rsrc.Mode()),
+		Uid:     int(rsrc.UID()),
+		Gid:     int(rsrc.GID()),
+		ModTime: mtime,
+		Format:  tar.FormatPAX,
+	}
+
+	if entry.link != "" {
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = strings.TrimPrefix(entry.link, "/")
+		return tw.WriteHeader(hdr)
+	}
+
+	if xattrer, ok := rsrc.(XAttrer); ok {
+		for name, value := range xattrer.XAttrs() {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[paxXAttrPrefix+name] = string(value)
+		}
+	}
+
+	switch r := rsrc.(type) {
+	case RegularFile:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = r.Size()
+	case Directory:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case SymLink:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = r.Target()
+	case NamedPipe:
+		hdr.Typeflag = tar.TypeFifo
+	case Device:
+		hdr.Typeflag = tar.TypeBlock
+		if r.Mode()&os.ModeCharDevice != 0 {
+			hdr.Typeflag = tar.TypeChar
+		}
+		hdr.Devmajor = int64(r.Major())
+		hdr.Devminor = int64(r.Minor())
+	default:
+		return fmt.Errorf("resource type %v cannot be exported: %w", rsrc.Mode(), ErrNotSupported)
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	rf, ok := rsrc.(RegularFile)
+	if !ok || rf.Size() == 0 {
+		return nil
+	}
+
+	return exportContent(tw, rf, provider)
+}
+
+// exportContent copies the content of rf from provider to tw.
+func exportContent(tw *tar.Writer, rf RegularFile, provider ContentProvider) error {
+	if provider == nil {
+		return fmt.Errorf("no content provider: %w", ErrNotFound)
+	}
+
+	var r io.ReadCloser
+	err := fmt.Errorf("no digests: %w", ErrNotFound)
+	for _, dgst := range rf.Digests() {
+		r, err = provider.Reader(dgst)
+		if err == nil {
+			break
+		}
+	}
+	if r == nil {
+		return fmt.Errorf("content unavailable: %w", err)
+	}
+	defer r.Close()
+
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return err
+	}
+	if n != rf.Size() {
+		return fmt.Errorf("content has size %d, expected %d", n, rf.Size())
+	}
+
+	return nil
+}
+
+// tarMode returns the tar header mode bits for the file mode.
+func tarMode(mode os.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 0o1000
+	}
+
+	return m
+}
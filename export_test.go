@@ -0,0 +1,154 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestExportManifest(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind:   rhardlink,
+			path:   "a-hardlink",
+			target: "a",
+		},
+		{
+			kind: rdirectory,
+			path: "b",
+			mode: 0o755,
+		},
+		{
+			kind:   rhardlink,
+			path:   "b/a-hardlink",
+			target: "a",
+		},
+		{
+			path: "b/c",
+			mode: 0o600 | os.ModeSetgid,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "b/c-symlink",
+			target: "c",
+		},
+		{
+			kind: rnamedpipe,
+			path: "b/fifo",
+			mode: os.ModeNamedPipe | 0o640,
+		},
+	})
+
+	store, err := NewContentStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsContext, err := NewContextWithOptions(root, ContextOptions{
+		Digester: store.Digester(digest.Canonical),
+	})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	var first, second bytes.Buffer
+	if err := ExportManifest(&first, m, store, ExportOptions{}); err != nil {
+		t.Fatalf("error exporting manifest: %v", err)
+	}
+	if err := ExportManifest(&second, m, store, ExportOptions{}); err != nil {
+		t.Fatalf("error exporting manifest: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatal("export is not deterministic")
+	}
+
+	// hardlinks link to the first path and all times are normalized.
+	tr := tar.NewReader(bytes.NewReader(first.Bytes()))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, hdr.Name)
+		if !hdr.ModTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("%s: unexpected modification time %v", hdr.Name, hdr.ModTime)
+		}
+		if hdr.Name == "a-hardlink" || hdr.Name == "b/a-hardlink" {
+			if hdr.Typeflag != tar.TypeLink || hdr.Linkname != "a" {
+				t.Errorf("%s: expected hardlink to a, got %q -> %q", hdr.Name, hdr.Typeflag, hdr.Linkname)
+			}
+		}
+	}
+
+	expected := []string{"./", "a", "a-hardlink", "b/", "b/a-hardlink", "b/c", "b/c-symlink", "b/fifo"}
+	if !equalStrings(names, expected) {
+		t.Fatalf("unexpected entries: %v != %v", names, expected)
+	}
+
+	exported, err := BuildManifestFromTar(&first)
+	if err != nil {
+		t.Fatalf("error building manifest from export: %v", err)
+	}
+	if changes := DiffManifests(m, exported); len(changes) > 0 {
+		t.Fatalf("exported archive differs from manifest: %v", changes)
+	}
+	if *exported.Header.Root != *m.Header.Root {
+		t.Fatalf("unexpected root: %+v != %+v", exported.Header.Root, m.Header.Root)
+	}
+}
+
+func TestExportManifestMissingContent(t *testing.T) {
+	m := &Manifest{}
+	rf, err := newRegularFile(resource{paths: []string{"/a"}, mode: 0o644}, []string{"/a"}, 3, digest.FromString("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Resources = append(m.Resources, rf)
+
+	if err := ExportManifest(io.Discard, m, testProvider{}, ExportOptions{}); err == nil {
+		t.Fatal("expected export to fail without content")
+	}
+
+	provider := testProvider{digest.FromString("abc"): []byte("abc")}
+	if err := ExportManifest(io.Discard, m, provider, ExportOptions{}); err != nil {
+		t.Fatalf("error exporting manifest: %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Filter selects the paths of a tree with gitignore style patterns. Paths
+// are matched relative to the root, using forward slashes:
+//
+//   - a pattern without a slash, other than a trailing one, matches a name
+//     at any depth, while a pattern containing one is anchored to the root
+//   - "*", "?" and character classes match within a path element, as with
+//     path.Match, and a "**" element matches any number of elements
+//   - a trailing slash only matches directories
+//   - matching a directory also matches everything beneath it
+//
+// A path is selected if it matches any of the include patterns, or there
+// are none, and is not excluded. Exclude patterns are applied in order and
+// an exclude pattern starting with "!" selects matching paths again.
+// Directories which are not selected themselves are kept when they hold a
+// selected path. A nil *Filter selects every path.
+type Filter struct {
+	include []filterPattern
+	exclude []filterPattern
+
+	// negated is set if any exclude pattern selects paths again, in which
+	// case excluded directories may still hold selected paths.
+	negated bool
+}
+
+// filterPattern is a parsed filter pattern.
+type filterPattern struct {
+	elems   []string
+	dirOnly bool
+	negate  bool
+}
+
+// NewFilter returns a Filter selecting paths matching one of the include
+// patterns, or any path if there are none, which do not match the exclude
+// patterns.
+func NewFilter(include, exclude []string) (*Filter, error) {
+	f := &Filter{}
+	for _, pattern := range include {
+		fp, err := parseFilterPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if fp.negate {
+			return nil, fmt.Errorf("include pattern %q cannot be negated", pattern)
+		}
+		f.include = append(f.include, fp)
+	}
+
+	for _, pattern := range exclude {
+		fp, err := parseFilterPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.negated = f.negated || fp.negate
+		f.exclude = append(f.exclude, fp)
+	}
+
+	return f, nil
+}
+
+// ReadFilterPatterns reads patterns from r, one per line, as found in
+// .gitignore and .dockerignore files. Blank lines and lines starting with
+// "#" are skipped.
+func ReadFilterPatterns(r io.Reader) ([]string, error) {
+	var patterns []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return patterns, nil
+}
+
+func parseFilterPattern(pattern string) (filterPattern, error) {
+	var fp filterPattern
+	p := pattern
+	if strings.HasPrefix(p, "!") {
+		fp.negate = true
+		p = p[1:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		fp.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimLeft(p, "/")
+	if p == "" {
+		return fp, fmt.Errorf("invalid filter pattern %q", pattern)
+	}
+
+	if !anchored {
+		fp.elems = []string{"**"}
+	}
+
+	for _, elem := range strings.Split(p, "/") {
+		if elem == "" || elem == "." {
+			continue
+		}
+
+		// validate the element, path.Match only reports malformed
+		// patterns when matching.
+		if _, err := path.Match(elem, ""); err != nil {
+			return fp, fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+		}
+		fp.elems = append(fp.elems, elem)
+	}
+
+	return fp, nil
+}
+
+// Match returns true if the path p, relative to the root, is selected. isDir
+// must be set for directories. Directories holding selected paths are not
+// matched unless selected themselves.
+func (f *Filter) Match(p string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+
+	elems := splitFilterPath(p)
+	return f.included(elems, isDir) && !f.excluded(elems, isDir)
+}
+
+// mayHold returns true if the directory at path p may hold selected paths,
+// whether or not it is selected itself.
+func (f *Filter) mayHold(p string) bool {
+	if f == nil {
+		return true
+	}
+
+	elems := splitFilterPath(p)
+	if !f.negated && f.excluded(elems, true) {
+		return false
+	}
+
+	if len(f.include) == 0 || f.included(elems, true) {
+		return true
+	}
+
+	for _, fp := range f.include {
+		if matchFilterPrefix(fp.elems, elems) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Filter) included(elems []string, isDir bool) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, fp := range f.include {
+		if fp.matches(elems, isDir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Filter) excluded(elems []string, isDir bool) bool {
+	excluded := false
+	for _, fp := range f.exclude {
+		if fp.matches(elems, isDir) {
+			excluded = !fp.negate
+		}
+	}
+
+	return excluded
+}
+
+// matches returns true if the pattern matches the path or one of its
+// parent directories.
+func (fp filterPattern) matches(elems []string, isDir bool) bool {
+	for i := 1; i <= len(elems); i++ {
+		if fp.dirOnly && i == len(elems) && !isDir {
+			continue
+		}
+
+		if matchFilterElems(fp.elems, elems[:i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitFilterPath splits a path relative to the root into its elements.
+func splitFilterPath(p string) []string {
+	p = strings.Trim(filepath.ToSlash(p), "/")
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, "/")
+}
+
+// matchFilterElems returns true if the pattern elements match all of the
+// path elements.
+func matchFilterElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchFilterElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(elems) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+
+		pattern, elems = pattern[1:], elems[1:]
+	}
+
+	return len(elems) == 0
+}
+
+// matchFilterPrefix returns true if the pattern may match a path beneath the
+// path elements.
+func matchFilterPrefix(pattern, elems []string) bool {
+	for len(elems) > 0 {
+		if len(pattern) == 0 {
+			return false
+		}
+
+		if pattern[0] == "**" {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+
+		pattern, elems = pattern[1:], elems[1:]
+	}
+
+	return len(pattern) > 0
+}
+
+// filterResources returns a function passing the resources selected by the
+// filter on to fn, restricted to their selected paths. Directories which are
+// not selected are passed on before the first selected resource they hold.
+// Resources are expected in manifest order.
+func filterResources(filter *Filter, fn func(Resource) error) func(Resource) error {
+	if filter == nil {
+		return fn
+	}
+
+	// pending holds the unselected directories which may hold selected
+	// resources still to come. Paths sorting between a directory and its
+	// entries, such as "/a.b" for "/a", keep it from being a stack.
+	var pending []Resource
+
+	return func(rsrc Resource) error {
+		_, isDir := rsrc.(Directory)
+		var selected []string
+		for _, path := range resourcePaths(rsrc) {
+			if filter.Match(path, isDir) {
+				selected = append(selected, path)
+			}
+		}
+
+		if len(selected) == 0 {
+			if isDir && filter.mayHold(rsrc.Path()) {
+				pending = append(pending, rsrc)
+			}
+			return nil
+		}
+
+		if len(selected) < len(resourcePaths(rsrc)) {
+			var err error
+			if rsrc, err = withPaths(rsrc, selected); err != nil {
+				return err
+			}
+		}
+
+		kept := pending[:0]
+		for _, dir := range pending {
+			if !holdsAny(dir.Path(), selected) {
+				kept = append(kept, dir)
+				continue
+			}
+
+			if err := fn(dir); err != nil {
+				return err
+			}
+		}
+		pending = kept
+
+		return fn(rsrc)
+	}
+}
+
+// filterManifest returns a manifest with the resources of m selected by the
+// filter, or m itself if filter is nil.
+func filterManifest(m *Manifest, filter *Filter) (*Manifest, error) {
+	if filter == nil {
+		return m, nil
+	}
+
+	filtered := &Manifest{Header: m.Header}
+	add := filterResources(filter, func(rsrc Resource) error {
+		filtered.Resources = append(filtered.Resources, rsrc)
+		return nil
+	})
+	for _, rsrc := range m.Resources {
+		if err := add(rsrc); err != nil {
+			return nil, err
+		}
+	}
+
+	return filtered, nil
+}
+
+// holdsAny returns true if the directory dir holds one of the paths.
+func holdsAny(dir string, paths []string) bool {
+	dir = strings.TrimRight(filepath.ToSlash(dir), "/") + "/"
+	for _, p := range paths {
+		if strings.HasPrefix(filepath.ToSlash(p), dir) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,265 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	gocontext "context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	for _, tc := range []struct {
+		include, exclude []string
+		path             string
+		dir              bool
+		match            bool
+	}{
+		{exclude: []string{"proc"}, path: "/proc", dir: true},
+		{exclude: []string{"proc"}, path: "/proc/1/status"},
+		{exclude: []string{"proc"}, path: "/var/proc"},
+		{exclude: []string{"/proc"}, path: "/var/proc", match: true},
+		{exclude: []string{"*.log"}, path: "/var/log/syslog.log"},
+		{exclude: []string{"*.log"}, path: "/var/log/syslog", match: true},
+		{exclude: []string{"tmp/"}, path: "/tmp", match: true},
+		{exclude: []string{"tmp/"}, path: "/tmp", dir: true},
+		{exclude: []string{"tmp/"}, path: "/tmp/a"},
+		{exclude: []string{"tmp/"}, path: "/var/tmp/a"},
+		{exclude: []string{"var/**/*.log"}, path: "/var/a.log"},
+		{exclude: []string{"var/**/*.log"}, path: "/var/log/b/a.log"},
+		{exclude: []string{"var/**/*.log"}, path: "/usr/a.log", match: true},
+		{exclude: []string{"var/log", "!var/log/keep"}, path: "/var/log/a"},
+		{exclude: []string{"var/log", "!var/log/keep"}, path: "/var/log/keep", match: true},
+		{exclude: []string{"!var/log/keep", "var/log"}, path: "/var/log/keep"},
+		{include: []string{"etc"}, path: "/etc/passwd", match: true},
+		{include: []string{"etc"}, path: "/usr/etc", match: true},
+		{include: []string{"etc/"}, path: "/usr/etc"},
+		{include: []string{"/etc"}, path: "/usr/etc", dir: true},
+		{include: []string{"etc"}, exclude: []string{"*.bak"}, path: "/etc/passwd.bak"},
+		{include: []string{"etc"}, path: "/usr/lib"},
+		{path: "/usr/lib", match: true},
+	} {
+		f, err := NewFilter(tc.include, tc.exclude)
+		if err != nil {
+			t.Fatalf("error creating filter: %v", err)
+		}
+
+		if got := f.Match(tc.path, tc.dir); got != tc.match {
+			t.Errorf("include %q exclude %q: match %q (dir %v) = %v, expected %v", tc.include, tc.exclude, tc.path, tc.dir, got, tc.match)
+		}
+	}
+
+	// a nil filter selects every path.
+	var f *Filter
+	if !f.Match("/a", false) || !f.mayHold("/a") {
+		t.Fatal("expected nil filter to select every path")
+	}
+}
+
+func TestFilterMayHold(t *testing.T) {
+	f, err := NewFilter([]string{"var/lib/*/db"}, []string{"tmp"})
+	if err != nil {
+		t.Fatalf("error creating filter: %v", err)
+	}
+
+	for p, expected := range map[string]bool{
+		"/var":           true,
+		"/var/lib":       true,
+		"/var/lib/a":     true,
+		"/var/lib/a/db":  true,
+		"/var/lib/a/log": false,
+		"/usr":           false,
+		"/var/tmp":       false,
+	} {
+		if got := f.mayHold(p); got != expected {
+			t.Errorf("mayHold(%q) = %v, expected %v", p, got, expected)
+		}
+	}
+}
+
+func TestNewFilterInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		include, exclude []string
+	}{
+		{include: []string{"!a"}},
+		{exclude: []string{"/"}},
+		{exclude: []string{"a/["}},
+	} {
+		if _, err := NewFilter(tc.include, tc.exclude); err == nil {
+			t.Errorf("expected error for include %q exclude %q", tc.include, tc.exclude)
+		}
+	}
+}
+
+func TestReadFilterPatterns(t *testing.T) {
+	patterns, err := ReadFilterPatterns(strings.NewReader("# comment\n/proc\n\n  *.log  \n!keep.log\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"/proc", "*.log", "!keep.log"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Fatalf("unexpected patterns: %q != %q", patterns, expected)
+	}
+}
+
+func TestManifestFilter(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			kind: rdirectory,
+			path: "a",
+			mode: 0o755,
+		},
+		{
+			// sorts between a and its entries.
+			path: "a.b",
+			mode: 0o644,
+		},
+		{
+			kind: rdirectory,
+			path: "a/log",
+			mode: 0o755,
+		},
+		{
+			path: "a/log/x.log",
+			mode: 0o644,
+		},
+		{
+			path: "a/log/keep",
+			mode: 0o644,
+		},
+		{
+			kind:   rhardlink,
+			path:   "a/link",
+			target: "a/log/keep",
+		},
+		{
+			kind: rdirectory,
+			path: "tmp",
+			mode: 0o755,
+		},
+		{
+			path: "tmp/t",
+			mode: 0o644,
+		},
+	})
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	f, err := NewFilter([]string{"log"}, []string{"*.log"})
+	if err != nil {
+		t.Fatalf("error creating filter: %v", err)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		m, err := BuildManifestWithOptions(gocontext.Background(), fsContext, BuildOptions{Filter: f, Concurrency: concurrency})
+		if err != nil {
+			t.Fatalf("error building manifest: %v", err)
+		}
+
+		var paths []string
+		for _, rsrc := range m.Resources {
+			paths = append(paths, strings.Join(resourcePaths(rsrc), ","))
+		}
+		expected := []string{"/a", "/a/log", "/a/log/keep"}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("unexpected filtered manifest with concurrency %d: %q != %q", concurrency, paths, expected)
+		}
+	}
+
+	full, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	filtered, err := filterManifest(full, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, rsrc := range filtered.Resources {
+		paths = append(paths, strings.Join(resourcePaths(rsrc), ","))
+	}
+	// the hardlinked file keeps its position, sorted by its first path.
+	expected := []string{"/a", "/a/log/keep", "/a/log"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("unexpected filtered manifest: %q != %q", paths, expected)
+	}
+
+	// changes to paths which are not selected are ignored.
+	if err := os.WriteFile(filepath.Join(root, "tmp/u"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "a.b"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	exclude, err := NewFilter(nil, []string{"tmp/", "a.b"})
+	if err != nil {
+		t.Fatalf("error creating filter: %v", err)
+	}
+
+	report, err := VerifyManifestReportWithOptions(fsContext, full, VerifyOptions{Filter: exclude})
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected mismatches: %v", report.Err())
+	}
+
+	report, err = VerifyManifestReport(fsContext, full)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if len(report.Mismatches) != 2 {
+		t.Fatalf("expected 2 mismatches without a filter: %v", report.Err())
+	}
+
+	// pruning leaves paths which are not selected in place.
+	if err := os.WriteFile(filepath.Join(root, "extra"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, transactional := range []bool{false, true} {
+		if err := ApplyManifestWithOptions(fsContext, full, ApplyOptions{Prune: true, Transactional: transactional, Filter: exclude}); err != nil {
+			t.Fatalf("error applying manifest: %v", err)
+		}
+	}
+
+	for p, exists := range map[string]bool{"tmp/u": true, "extra": false} {
+		if _, err := os.Lstat(filepath.Join(root, p)); (err == nil) != exists {
+			t.Errorf("unexpected state of %q after pruning: %v", p, err)
+		}
+	}
+
+	fi, err := os.Lstat(filepath.Join(root, "a.b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected excluded %q to be left alone, mode is %v", "a.b", fi.Mode())
+	}
+}
@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/Microsoft/go-winio v0.6.2
 	github.com/containerd/log v0.1.0
+	github.com/klauspost/compress v1.17.11
 	github.com/opencontainers/go-digest v1.0.0
 	golang.org/x/sync v0.8.0
 	golang.org/x/sys v0.26.0
@@ -0,0 +1,260 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	pb "github.com/containerd/continuity/proto"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// ManifestVersion is the latest schema version of the manifests written
+	// by this package. Manifests with a later version are rejected when
+	// decoded.
+	ManifestVersion = manifestVersionWhiteouts
+
+	// manifestVersionHeader is the first schema version, which introduced the
+	// header. Manifests are written with this version unless their resources
+	// require a later one, so that older readers still accept them.
+	manifestVersionHeader = 1
+
+	// manifestVersionWhiteouts introduced whiteouts and opaque directories,
+	// which readers of earlier versions would decode as empty regular files
+	// and plain directories.
+	manifestVersionWhiteouts = 2
+)
+
+// ErrUnsupportedVersion is returned when decoding a manifest with a schema
+// version that is not supported.
+var ErrUnsupportedVersion = errors.New("unsupported manifest version")
+
+// Header describes how a manifest was built. Manifests written before the
+// header was introduced have none.
+type Header struct {
+	// Version is the schema version of the manifest.
+	Version uint32
+
+	// Tool identifies the program that built the manifest.
+	Tool string
+
+	// DigestAlgorithms lists the algorithms of the digests of the resources
+	// of the manifest. If set, resources may not use other algorithms.
+	DigestAlgorithms []digest.Algorithm
+
+	// Root describes the root directory of the manifest, if known.
+	Root *RootInfo
+
+	// Annotations holds arbitrary metadata about the manifest.
+	Annotations map[string]string
+}
+
+// RootInfo describes the root directory of a manifest.
+type RootInfo struct {
+	Mode     os.FileMode
+	UID, GID int64
+}
+
+// NewHeader returns the header of a manifest built from fsContext with the
+// given options. The digest algorithms are left to the caller, as they are
+// only known once the resources have been digested. The version allows for
+// the whiteouts and opaque directories of an overlay, as a streamed header is
+// written before the resources.
+func NewHeader(fsContext Context, opts BuildOptions) (*Header, error) {
+	root, err := fsContext.Resource("/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get root resource: %w", err)
+	}
+
+	version := uint32(manifestVersionHeader)
+	if opts.Overlay {
+		version = manifestVersionWhiteouts
+	}
+
+	return &Header{
+		Version:     version,
+		Tool:        opts.Tool,
+		Root:        &RootInfo{Mode: root.Mode(), UID: root.UID(), GID: root.GID()},
+		Annotations: opts.Annotations,
+	}, nil
+}
+
+// digestAlgorithms returns the sorted algorithms of the digests of the
+// resources.
+func digestAlgorithms(resources []Resource) []digest.Algorithm {
+	seen := map[digest.Algorithm]struct{}{}
+	var algorithms []digest.Algorithm
+	for _, rsrc := range resources {
+		rf, ok := rsrc.(RegularFile)
+		if !ok {
+			continue
+		}
+
+		for _, dgst := range rf.Digests() {
+			if _, ok := seen[dgst.Algorithm()]; !ok {
+				seen[dgst.Algorithm()] = struct{}{}
+				algorithms = append(algorithms, dgst.Algorithm())
+			}
+		}
+	}
+	sort.Slice(algorithms, func(i, j int) bool { return algorithms[i] < algorithms[j] })
+
+	return algorithms
+}
+
+// validate checks that the header describes a manifest this package can
+// decode.
+func (h *Header) validate() error {
+	if h.Version == 0 {
+		return errors.New("manifest header has no version")
+	}
+	if h.Version > ManifestVersion {
+		return fmt.Errorf("%w %d, expected at most %d", ErrUnsupportedVersion, h.Version, ManifestVersion)
+	}
+
+	for _, alg := range h.DigestAlgorithms {
+		if !alg.Available() {
+			return fmt.Errorf("manifest uses unsupported digest algorithm %q", alg)
+		}
+	}
+
+	return nil
+}
+
+// validateResource checks that the digests of the resource use the
+// algorithms declared by the header.
+func (h *Header) validateResource(rsrc Resource) error {
+	rf, ok := rsrc.(RegularFile)
+	if !ok || len(h.DigestAlgorithms) == 0 {
+		return nil
+	}
+
+	for _, dgst := range rf.Digests() {
+		declared := false
+		for _, alg := range h.DigestAlgorithms {
+			if dgst.Algorithm() == alg {
+				declared = true
+				break
+			}
+		}
+
+		if !declared {
+			return fmt.Errorf("resource %q uses undeclared digest algorithm %q", rsrc.Path(), dgst.Algorithm())
+		}
+	}
+
+	return nil
+}
+
+// resourceVersion returns the schema version required to describe the
+// resource.
+func resourceVersion(rsrc Resource) uint32 {
+	switch rsrc.(type) {
+	case Whiteout, OpaqueDirectory:
+		return manifestVersionWhiteouts
+	default:
+		return manifestVersionHeader
+	}
+}
+
+// manifestHeader returns the header written for the manifest, with at least
+// the schema version its resources require. A manifest without a header gets
+// one if its resources require a later version than the first, so that older
+// readers reject it rather than misread it.
+func manifestHeader(m *Manifest) *Header {
+	var version uint32
+	for _, rsrc := range m.Resources {
+		if v := resourceVersion(rsrc); v > version {
+			version = v
+		}
+	}
+
+	if m.Header == nil {
+		if version <= manifestVersionHeader {
+			return nil
+		}
+		return &Header{Version: version}
+	}
+	if m.Header.Version >= version {
+		return m.Header
+	}
+
+	h := *m.Header
+	h.Version = version
+	return &h
+}
+
+func toProtoHeader(h *Header) *pb.Header {
+	if h == nil {
+		return nil
+	}
+
+	b := &pb.Header{
+		Version:     h.Version,
+		Tool:        h.Tool,
+		Annotations: h.Annotations,
+	}
+
+	for _, alg := range h.DigestAlgorithms {
+		b.DigestAlgorithm = append(b.DigestAlgorithm, alg.String())
+	}
+
+	if h.Root != nil {
+		b.Root = &pb.Root{
+			Mode: uint32(h.Root.Mode),
+			Uid:  h.Root.UID,
+			Gid:  h.Root.GID,
+		}
+	}
+
+	return b
+}
+
+// fromProtoHeader decodes and validates the header.
+func fromProtoHeader(b *pb.Header) (*Header, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	h := &Header{
+		Version:     b.Version,
+		Tool:        b.Tool,
+		Annotations: b.Annotations,
+	}
+
+	for _, alg := range b.DigestAlgorithm {
+		h.DigestAlgorithms = append(h.DigestAlgorithms, digest.Algorithm(alg))
+	}
+
+	if b.Root != nil {
+		h.Root = &RootInfo{
+			Mode: os.FileMode(b.Root.Mode),
+			UID:  b.Root.Uid,
+			GID:  b.Root.Gid,
+		}
+	}
+
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
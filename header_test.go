@@ -0,0 +1,312 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	gocontext "context"
+	_ "crypto/sha512"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	pb "github.com/containerd/continuity/proto"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestManifestHeader(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Chmod(root, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifestWithOptions(gocontext.Background(), fsContext, BuildOptions{
+		Tool:        "test",
+		Annotations: map[string]string{"org.example": "value"},
+	})
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	expected := &Header{
+		Version:          manifestVersionHeader,
+		Tool:             "test",
+		DigestAlgorithms: []digest.Algorithm{digest.SHA256},
+		Root:             &RootInfo{Mode: os.ModeDir | 0o750, UID: int64(os.Getuid()), GID: m.Header.Root.GID},
+		Annotations:      map[string]string{"org.example": "value"},
+	}
+	if !reflect.DeepEqual(m.Header, expected) {
+		t.Fatalf("unexpected header: %+v != %+v", m.Header, expected)
+	}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Unmarshal(p)
+	if err != nil {
+		t.Fatalf("error unmarshaling manifest: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Header, expected) {
+		t.Fatalf("unexpected header after round trip: %+v != %+v", decoded.Header, expected)
+	}
+
+	var stream bytes.Buffer
+	mw, err := NewManifestWriterWithHeader(&stream, m.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	mr, err := NewManifestReader(&stream)
+	if err != nil {
+		t.Fatalf("error reading manifest stream: %v", err)
+	}
+	if !reflect.DeepEqual(mr.Header(), expected) {
+		t.Fatalf("unexpected stream header: %+v != %+v", mr.Header(), expected)
+	}
+}
+
+func TestManifestHeaderVersion(t *testing.T) {
+	dir := resource{paths: []string{"/o"}, mode: os.ModeDir | 0o755}
+	for _, tc := range []struct {
+		name     string
+		manifest *Manifest
+		version  uint32
+		noHeader bool
+	}{
+		{
+			name:     "plain",
+			manifest: &Manifest{Header: &Header{Version: manifestVersionHeader}, Resources: []Resource{&directory{resource: dir}}},
+			version:  manifestVersionHeader,
+		},
+		{
+			name:     "plain without header",
+			manifest: &Manifest{Resources: []Resource{&directory{resource: dir}}},
+			noHeader: true,
+		},
+		{
+			name:     "whiteout",
+			manifest: &Manifest{Header: &Header{Version: manifestVersionHeader, Tool: "test"}, Resources: []Resource{newWhiteout("/gone")}},
+			version:  manifestVersionWhiteouts,
+		},
+		{
+			name:     "opaque directory without header",
+			manifest: &Manifest{Resources: []Resource{&opaqueDirectory{directory: directory{resource: dir}}}},
+			version:  manifestVersionWhiteouts,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var text bytes.Buffer
+			if err := MarshalText(&text, tc.manifest); err != nil {
+				t.Fatal(err)
+			}
+			p, err := Marshal(tc.manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			j, err := tc.manifest.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fromJSON Manifest
+			if err := fromJSON.UnmarshalJSON(j); err != nil {
+				t.Fatalf("error decoding json: %v", err)
+			}
+			fromText, err := UnmarshalText(text.Bytes())
+			if err != nil {
+				t.Fatalf("error decoding text: %v", err)
+			}
+			fromBinary, err := Unmarshal(p)
+			if err != nil {
+				t.Fatalf("error decoding binary: %v", err)
+			}
+
+			for _, decoded := range []*Manifest{fromBinary, fromText, &fromJSON} {
+				if tc.noHeader {
+					if decoded.Header != nil {
+						t.Fatalf("unexpected header: %+v", decoded.Header)
+					}
+					continue
+				}
+				if decoded.Header == nil || decoded.Header.Version != tc.version {
+					t.Fatalf("unexpected header: %+v, expected version %d", decoded.Header, tc.version)
+				}
+			}
+
+			// the header of the manifest itself is left unchanged.
+			if tc.manifest.Header != nil && tc.manifest.Header.Version != manifestVersionHeader {
+				t.Fatalf("unexpected version of the original header: %d", tc.manifest.Header.Version)
+			}
+
+			dgst, err := tc.manifest.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decodedDigest, err := fromBinary.Digest(); err != nil || decodedDigest != dgst {
+				t.Fatalf("unexpected digest of the decoded manifest: %v != %v (%v)", decodedDigest, dgst, err)
+			}
+		})
+	}
+}
+
+func TestManifestWriterVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		header  *Header
+		invalid bool
+	}{
+		{name: "no header", invalid: true},
+		{name: "first version", header: &Header{Version: manifestVersionHeader}, invalid: true},
+		{name: "whiteout version", header: &Header{Version: manifestVersionWhiteouts}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mw, err := NewManifestWriterWithHeader(io.Discard, tc.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mw.Write(&directory{resource: resource{paths: []string{"/o"}, mode: os.ModeDir | 0o755}}); err != nil {
+				t.Fatalf("error writing directory: %v", err)
+			}
+			if err := mw.Write(newWhiteout("/gone")); tc.invalid != (err != nil) {
+				t.Fatalf("unexpected error writing whiteout: %v", err)
+			}
+		})
+	}
+
+	fsContext, err := NewContext(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, overlay := range []bool{false, true} {
+		h, err := NewHeader(fsContext, BuildOptions{Overlay: overlay})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := uint32(manifestVersionHeader)
+		if overlay {
+			expected = manifestVersionWhiteouts
+		}
+		if h.Version != expected {
+			t.Fatalf("unexpected version of overlay %v header: %d != %d", overlay, h.Version, expected)
+		}
+	}
+}
+
+func TestManifestHeaderValidation(t *testing.T) {
+	sha512 := digest.SHA512.FromString("a")
+	for _, tc := range []struct {
+		name    string
+		header  *pb.Header
+		digest  digest.Digest
+		invalid bool
+	}{
+		{
+			name:   "no header",
+			digest: sha512,
+		},
+		{
+			name:   "current version",
+			header: &pb.Header{Version: ManifestVersion, DigestAlgorithm: []string{"sha512"}},
+			digest: sha512,
+		},
+		{
+			name:    "missing version",
+			header:  &pb.Header{},
+			invalid: true,
+		},
+		{
+			name:    "future version",
+			header:  &pb.Header{Version: ManifestVersion + 1},
+			invalid: true,
+		},
+		{
+			name:    "unknown algorithm",
+			header:  &pb.Header{Version: ManifestVersion, DigestAlgorithm: []string{"md4"}},
+			invalid: true,
+		},
+		{
+			name:    "undeclared algorithm",
+			header:  &pb.Header{Version: ManifestVersion, DigestAlgorithm: []string{"sha256"}},
+			digest:  sha512,
+			invalid: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bm := &pb.Manifest{Header: tc.header}
+			if tc.digest != "" {
+				bm.Resource = []*pb.Resource{{
+					Path:   []string{"/a"},
+					Mode:   0o644,
+					Size:   1,
+					Digest: []string{tc.digest.String()},
+				}}
+			}
+
+			p, err := proto.Marshal(bm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = Unmarshal(p)
+			if tc.invalid != (err != nil) {
+				t.Fatalf("unexpected error unmarshaling manifest: %v", err)
+			}
+
+			// the reader validates both the header and the resources.
+			mr, err := NewManifestReader(bytes.NewReader(p))
+			if err == nil {
+				for err == nil {
+					_, err = mr.Next()
+				}
+				if err == io.EOF {
+					err = nil
+				}
+			}
+			if tc.invalid != (err != nil) {
+				t.Fatalf("unexpected error reading manifest: %v", err)
+			}
+		})
+	}
+
+	p, err := proto.Marshal(&pb.Manifest{Header: &pb.Header{Version: ManifestVersion + 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(p); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IDMap maps a range of user or group ids of a container to ids of the
+// host, like a line of /proc/self/uid_map.
+type IDMap struct {
+	// ContainerID is the first id of the range in the container.
+	ContainerID int64
+
+	// HostID is the first id of the range on the host.
+	HostID int64
+
+	// Size is the number of ids in the range.
+	Size int64
+}
+
+// ParseIDMap parses a range of ids in the form "container:host:size", such
+// as "0:100000:65536".
+func ParseIDMap(s string) (IDMap, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return IDMap{}, fmt.Errorf("invalid id map %q, expected container:host:size", s)
+	}
+
+	return parseIDMapFields(s, fields)
+}
+
+// ReadIDMaps reads ranges of ids in the format of /proc/self/uid_map and
+// /proc/self/gid_map: one range per line, as the container id, host id and
+// size separated by whitespace.
+func ReadIDMaps(r io.Reader) ([]IDMap, error) {
+	var maps []IDMap
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid id map %q, expected container host size", line)
+		}
+
+		m, err := parseIDMapFields(line, fields)
+		if err != nil {
+			return nil, err
+		}
+		maps = append(maps, m)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return maps, nil
+}
+
+func parseIDMapFields(s string, fields []string) (IDMap, error) {
+	var ids [3]int64
+	for i, field := range fields {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return IDMap{}, fmt.Errorf("invalid id map %q: %w", s, err)
+		}
+		ids[i] = int64(id)
+	}
+
+	if ids[2] == 0 {
+		return IDMap{}, fmt.Errorf("invalid id map %q: empty range", s)
+	}
+
+	return IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// idMapping translates the user and group ids of resources, which are ids
+// of the container, to the ids of the host found on the filesystem. Without
+// ranges, ids are the same on both sides.
+type idMapping struct {
+	uids, gids []IDMap
+}
+
+// toHost returns the host id of the container id in the ranges.
+func toHost(maps []IDMap, id int64) (int64, error) {
+	if len(maps) == 0 {
+		return id, nil
+	}
+
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("container id %d is not mapped", id)
+}
+
+// toContainer returns the container id of the host id in the ranges.
+func toContainer(maps []IDMap, id int64) (int64, error) {
+	if len(maps) == 0 {
+		return id, nil
+	}
+
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("host id %d is not mapped", id)
+}
+
+// empty returns true if ids are not translated.
+func (m idMapping) empty() bool {
+	return len(m.uids) == 0 && len(m.gids) == 0
+}
+
+// ownerToHost returns the host ids of the owner of the resource.
+func (m idMapping) ownerToHost(uid, gid int64) (int64, int64, error) {
+	uid, err := toHost(m.uids, uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("uid: %w", err)
+	}
+
+	gid, err = toHost(m.gids, gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("gid: %w", err)
+	}
+
+	return uid, gid, nil
+}
+
+// ownerToContainer returns the container ids of the owner of a file.
+func (m idMapping) ownerToContainer(uid, gid int64) (int64, int64, error) {
+	uid, err := toContainer(m.uids, uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("uid: %w", err)
+	}
+
+	gid, err = toContainer(m.gids, gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("gid: %w", err)
+	}
+
+	return uid, gid, nil
+}
+
+// xattrsToHost returns a copy of xattrs with the root id of the file
+// capabilities and the ids of the ACL entries translated to host ids.
+func (m idMapping) xattrsToHost(xattrs map[string][]byte) (map[string][]byte, error) {
+	return m.mapXAttrs(xattrs, toHost)
+}
+
+// xattrsToContainer returns a copy of xattrs with the root id of the file
+// capabilities and the ids of the ACL entries translated to container ids.
+func (m idMapping) xattrsToContainer(xattrs map[string][]byte) (map[string][]byte, error) {
+	return m.mapXAttrs(xattrs, toContainer)
+}
+
+func (m idMapping) mapXAttrs(xattrs map[string][]byte, mapID func([]IDMap, int64) (int64, error)) (map[string][]byte, error) {
+	if m.empty() {
+		return xattrs, nil
+	}
+
+	mapped := make(map[string][]byte, len(xattrs))
+	for name, value := range xattrs {
+		mapped[name] = value
+	}
+
+	// values which cannot be decoded are left alone, like they are
+	// recorded as is.
+	if value, ok := xattrs[xattrCapability]; ok {
+		if caps, err := decodeCapabilities(value); err == nil && caps.Version == 3 {
+			if caps.RootID, err = mapID(m.uids, caps.RootID); err != nil {
+				return nil, fmt.Errorf("capability root id: %w", err)
+			}
+
+			if mapped[xattrCapability], err = caps.encode(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range []string{xattrACLAccess, xattrACLDefault} {
+		acl, err := decodeACL(xattrs[name])
+		if err != nil || len(acl) == 0 {
+			continue
+		}
+
+		for i, e := range acl {
+			switch e.Tag {
+			case ACLUser:
+				acl[i].ID, err = mapID(m.uids, e.ID)
+			case ACLGroup:
+				acl[i].ID, err = mapID(m.gids, e.ID)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s entry %v: %w", name, e, err)
+			}
+		}
+
+		if mapped[name], err = acl.encode(); err != nil {
+			return nil, err
+		}
+	}
+
+	return mapped, nil
+}
@@ -0,0 +1,213 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/continuity/sysx"
+	"github.com/containerd/continuity/testutil"
+)
+
+func TestReadIDMaps(t *testing.T) {
+	maps, err := ReadIDMaps(strings.NewReader("         0     100000      65536\n\n     65536     1000          1\n"))
+	if err != nil {
+		t.Fatalf("error reading id maps: %v", err)
+	}
+
+	expected := []IDMap{
+		{ContainerID: 0, HostID: 100000, Size: 65536},
+		{ContainerID: 65536, HostID: 1000, Size: 1},
+	}
+	if !reflect.DeepEqual(maps, expected) {
+		t.Fatalf("unexpected id maps: %v != %v", maps, expected)
+	}
+
+	m, err := ParseIDMap("0:100000:65536")
+	if err != nil || m != expected[0] {
+		t.Fatalf("unexpected id map: %v, %v", m, err)
+	}
+
+	for _, s := range []string{"0:100000", "0:-1:10", "0:1:0", "a:b:c"} {
+		if _, err := ParseIDMap(s); err == nil {
+			t.Errorf("expected %q to fail", s)
+		}
+	}
+	if _, err := ReadIDMaps(strings.NewReader("0 1\n")); err == nil {
+		t.Error("expected a line with two fields to fail")
+	}
+}
+
+func TestIDMappingXAttrs(t *testing.T) {
+	ids := idMapping{
+		uids: []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		gids: []IDMap{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+
+	caps, err := (&Capabilities{Version: 3, Permitted: 1 << 10, RootID: 0}).encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := ACL{
+		{Tag: ACLUserObj, Perm: ACLRead},
+		{Tag: ACLUser, ID: 1000, Perm: ACLRead},
+		{Tag: ACLGroup, ID: 10, Perm: ACLRead},
+	}.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs := map[string][]byte{
+		xattrCapability: caps,
+		xattrACLAccess:  acl,
+		"user.a":        []byte("a"),
+	}
+
+	host, err := ids.xattrsToHost(xattrs)
+	if err != nil {
+		t.Fatalf("error mapping xattrs: %v", err)
+	}
+
+	hostCaps, err := decodeCapabilities(host[xattrCapability])
+	if err != nil || hostCaps.RootID != 100000 {
+		t.Fatalf("unexpected capabilities: %v, %v", hostCaps, err)
+	}
+	hostACL, err := decodeACL(host[xattrACLAccess])
+	if err != nil || hostACL.String() != "user::r--,user:101000:r--,group:200010:r--" {
+		t.Fatalf("unexpected ACL: %v, %v", hostACL, err)
+	}
+
+	container, err := ids.xattrsToContainer(host)
+	if err != nil {
+		t.Fatalf("error mapping xattrs: %v", err)
+	}
+	if !reflect.DeepEqual(container, xattrs) {
+		t.Fatalf("unexpected xattrs: %v != %v", container, xattrs)
+	}
+
+	// the host ids are outside of the ranges.
+	if _, err := ids.xattrsToContainer(xattrs); err == nil {
+		t.Fatal("expected unmapped ids to fail")
+	}
+}
+
+func TestIDMappingManifest(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			kind: rdirectory,
+			path: "d",
+			mode: 0o755,
+		},
+		{
+			path: "d/a",
+			mode: 0o755,
+		},
+	})
+
+	for p, owner := range map[string]int{"": 100000, "d": 100000, "d/a": 101000} {
+		if err := os.Lchown(filepath.Join(root, p), owner, owner+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// changing the owner drops file capabilities.
+	caps, err := (&Capabilities{Version: 3, Permitted: 1 << 10, Effective: true, RootID: 100000}).encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sysx.Setxattr(filepath.Join(root, "d", "a"), xattrCapability, caps, 0); err != nil {
+		t.Skipf("file capabilities are not supported: %v", err)
+	}
+
+	options := ContextOptions{
+		UIDMap: []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMap: []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}
+	fsContext, err := NewContextWithOptions(root, options)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	f := m.Resources[1].(RegularFile)
+	if f.UID() != 1000 || f.GID() != 1001 {
+		t.Fatalf("unexpected owner of %q: %d:%d", f.Path(), f.UID(), f.GID())
+	}
+	if c := f.(LinuxAttributer).Capabilities(); c == nil || c.RootID != 0 {
+		t.Fatalf("unexpected capabilities of %q: %v", f.Path(), c)
+	}
+
+	// apply on a host with another range.
+	target := t.TempDir()
+	options.UIDMap = []IDMap{{ContainerID: 0, HostID: 300000, Size: 65536}}
+	options.GIDMap = []IDMap{{ContainerID: 0, HostID: 300000, Size: 65536}}
+	options.Provider = testProviderFrom(t, root, "d/a")
+	tc, err := NewContextWithOptions(target, options)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	if err := ApplyManifest(tc, m); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(target, "d", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 301000 || st.Gid != 301001 {
+		t.Fatalf("unexpected owner: %d:%d", st.Uid, st.Gid)
+	}
+
+	value, err := sysx.Getxattr(filepath.Join(target, "d", "a"), xattrCapability)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := decodeCapabilities(value); err != nil || c.RootID != 300000 {
+		t.Fatalf("unexpected capabilities: %v, %v", c, err)
+	}
+
+	report, err := VerifyManifestReport(tc, m)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected mismatches: %v", report.Err())
+	}
+
+	// ids outside of the ranges cannot be read.
+	if err := os.Lchown(filepath.Join(target, "d"), 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.Resource("/d", nil); err == nil {
+		t.Fatal("expected unmapped owner to fail")
+	}
+}
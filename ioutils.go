@@ -32,7 +32,7 @@ func AtomicWriteFile(filename string, data []byte, perm os.FileMode) error {
 
 // atomicWriteFile writes data to a file by first writing to a temp
 // file and calling rename.
-func atomicWriteFile(filename string, r io.Reader, dataSize int64, perm os.FileMode) error {
+func atomicWriteFile(filename string, r io.Reader, dataSize int64, perm os.FileMode) (err error) {
 	f, err := os.CreateTemp(filepath.Dir(filename), ".tmp-"+filepath.Base(filename))
 	if err != nil {
 		return err
@@ -42,6 +42,9 @@ func atomicWriteFile(filename string, r io.Reader, dataSize int64, perm os.FileM
 		if needClose {
 			f.Close()
 		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
 	}()
 
 	err = os.Chmod(f.Name(), perm)
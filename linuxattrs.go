@@ -0,0 +1,644 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	driverpkg "github.com/containerd/continuity/driver"
+	pb "github.com/containerd/continuity/proto"
+)
+
+// The xattrs holding file capabilities and POSIX ACLs on Linux. Resources
+// keep them with their other xattrs, so that they are applied and verified
+// like any xattr, while protobuf records also hold them decoded.
+const (
+	xattrCapability = "security.capability"
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+)
+
+// LinuxAttributer is an interface that a resource type satisfies if it can
+// carry the file capabilities, POSIX ACLs and inode flags of Linux.
+type LinuxAttributer interface {
+	// Capabilities returns the file capabilities, or nil if none are set.
+	Capabilities() *Capabilities
+
+	// AccessACL returns the entries of the access ACL, if any.
+	AccessACL() ACL
+
+	// DefaultACL returns the entries of the default ACL of a directory, if
+	// any.
+	DefaultACL() ACL
+
+	// InodeFlags returns the inode flags.
+	InodeFlags() InodeFlags
+}
+
+func (r *resource) Capabilities() *Capabilities {
+	value, ok := r.xattrs[xattrCapability]
+	if !ok {
+		return nil
+	}
+
+	caps, err := decodeCapabilities(value)
+	if err != nil {
+		return nil
+	}
+	return caps
+}
+
+func (r *resource) AccessACL() ACL {
+	acl, _ := decodeACL(r.xattrs[xattrACLAccess])
+	return acl
+}
+
+func (r *resource) DefaultACL() ACL {
+	acl, _ := decodeACL(r.xattrs[xattrACLDefault])
+	return acl
+}
+
+func (r *resource) InodeFlags() InodeFlags {
+	return r.flags
+}
+
+// Capabilities are the file capabilities granted to an executable on
+// execution, as set by setcap(8).
+type Capabilities struct {
+	// Version is the version of the VFS capability format, 2 or 3.
+	Version uint32
+
+	// Permitted and Inheritable are the capability sets, as bit masks
+	// indexed by capability number.
+	Permitted, Inheritable uint64
+
+	// Effective raises the permitted capabilities in the effective set on
+	// execution.
+	Effective bool
+
+	// RootID is the user id of root in the user namespace the
+	// capabilities apply to. It is only recorded by version 3.
+	RootID int64
+}
+
+const (
+	vfsCapRevisionMask  = 0xff000000
+	vfsCapRevision2     = 0x02000000
+	vfsCapRevision3     = 0x03000000
+	vfsCapFlagEffective = 0x000001
+)
+
+// capabilityNames holds the names of the capabilities, by number.
+var capabilityNames = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill",
+	"setgid", "setuid", "setpcap", "linux_immutable", "net_bind_service",
+	"net_broadcast", "net_admin", "net_raw", "ipc_lock", "ipc_owner",
+	"sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct",
+	"sys_admin", "sys_boot", "sys_nice", "sys_resource", "sys_time",
+	"sys_tty_config", "mknod", "lease", "audit_write", "audit_control",
+	"setfcap", "mac_override", "mac_admin", "syslog", "wake_alarm",
+	"block_suspend", "audit_read", "perfmon", "bpf", "checkpoint_restore",
+}
+
+// String formats the capabilities like getcap(8), such as
+// "cap_net_bind_service,cap_net_raw=ep".
+func (c *Capabilities) String() string {
+	if c == nil {
+		return ""
+	}
+
+	var (
+		flags []string
+		names = map[string][]string{}
+	)
+	for i := 0; i < 64; i++ {
+		bit := uint64(1) << i
+
+		var f string
+		if c.Effective && c.Permitted&bit != 0 {
+			f += "e"
+		}
+		if c.Inheritable&bit != 0 {
+			f += "i"
+		}
+		if c.Permitted&bit != 0 {
+			f += "p"
+		}
+		if f == "" {
+			continue
+		}
+
+		if _, ok := names[f]; !ok {
+			flags = append(flags, f)
+		}
+
+		name := "cap_" + strconv.Itoa(i)
+		if i < len(capabilityNames) {
+			name = "cap_" + capabilityNames[i]
+		}
+		names[f] = append(names[f], name)
+	}
+
+	var clauses []string
+	for _, f := range flags {
+		clauses = append(clauses, strings.Join(names[f], ",")+"="+f)
+	}
+	if len(clauses) == 0 {
+		// no capability is granted.
+		clauses = []string{"="}
+	}
+
+	s := strings.Join(clauses, " ")
+	if c.Version == 3 && c.RootID != 0 {
+		s += fmt.Sprintf(" [rootid=%d]", c.RootID)
+	}
+	return s
+}
+
+// decodeCapabilities decodes the value of the security.capability xattr.
+// Only versions 2 and 3 of the format are supported.
+func decodeCapabilities(p []byte) (*Capabilities, error) {
+	if len(p) < 4 {
+		return nil, errors.New("capabilities are too short")
+	}
+
+	magic := binary.LittleEndian.Uint32(p)
+	if magic&^(vfsCapRevisionMask|vfsCapFlagEffective) != 0 {
+		return nil, fmt.Errorf("unknown capability flags %#x", magic)
+	}
+
+	c := &Capabilities{Effective: magic&vfsCapFlagEffective != 0}
+	switch magic & vfsCapRevisionMask {
+	case vfsCapRevision2:
+		if len(p) != 20 {
+			return nil, fmt.Errorf("invalid size %d of version 2 capabilities", len(p))
+		}
+		c.Version = 2
+	case vfsCapRevision3:
+		if len(p) != 24 {
+			return nil, fmt.Errorf("invalid size %d of version 3 capabilities", len(p))
+		}
+		c.Version = 3
+		c.RootID = int64(binary.LittleEndian.Uint32(p[20:]))
+	default:
+		return nil, fmt.Errorf("unsupported capability version %#x: %w", magic&vfsCapRevisionMask, ErrNotSupported)
+	}
+
+	c.Permitted = uint64(binary.LittleEndian.Uint32(p[4:])) | uint64(binary.LittleEndian.Uint32(p[12:]))<<32
+	c.Inheritable = uint64(binary.LittleEndian.Uint32(p[8:])) | uint64(binary.LittleEndian.Uint32(p[16:]))<<32
+
+	return c, nil
+}
+
+// encode returns the value of the security.capability xattr for c.
+func (c *Capabilities) encode() ([]byte, error) {
+	var (
+		p     []byte
+		magic uint32
+	)
+	switch c.Version {
+	case 2:
+		if c.RootID != 0 {
+			return nil, errors.New("version 2 capabilities cannot have a root id")
+		}
+		p, magic = make([]byte, 20), vfsCapRevision2
+	case 3:
+		if c.RootID < 0 || c.RootID > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid capability root id %d", c.RootID)
+		}
+		p, magic = make([]byte, 24), vfsCapRevision3
+		binary.LittleEndian.PutUint32(p[20:], uint32(c.RootID))
+	default:
+		return nil, fmt.Errorf("unsupported capability version %d: %w", c.Version, ErrNotSupported)
+	}
+
+	if c.Effective {
+		magic |= vfsCapFlagEffective
+	}
+	binary.LittleEndian.PutUint32(p, magic)
+	binary.LittleEndian.PutUint32(p[4:], uint32(c.Permitted))
+	binary.LittleEndian.PutUint32(p[8:], uint32(c.Inheritable))
+	binary.LittleEndian.PutUint32(p[12:], uint32(c.Permitted>>32))
+	binary.LittleEndian.PutUint32(p[16:], uint32(c.Inheritable>>32))
+
+	return p, nil
+}
+
+// ACLTag is the type of an ACL entry, using the values of Linux.
+type ACLTag uint32
+
+const (
+	// ACLUserObj grants permissions to the owner of the file.
+	ACLUserObj ACLTag = 0x01
+
+	// ACLUser grants permissions to the user with the id of the entry.
+	ACLUser ACLTag = 0x02
+
+	// ACLGroupObj grants permissions to the owning group of the file.
+	ACLGroupObj ACLTag = 0x04
+
+	// ACLGroup grants permissions to the group with the id of the entry.
+	ACLGroup ACLTag = 0x08
+
+	// ACLMask limits the permissions granted to groups and named users.
+	ACLMask ACLTag = 0x10
+
+	// ACLOther grants permissions to everyone else.
+	ACLOther ACLTag = 0x20
+)
+
+var aclTagNames = map[ACLTag]string{
+	ACLUserObj:  "user",
+	ACLUser:     "user",
+	ACLGroupObj: "group",
+	ACLGroup:    "group",
+	ACLMask:     "mask",
+	ACLOther:    "other",
+}
+
+func (t ACLTag) String() string {
+	if name, ok := aclTagNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ACLTag(%d)", uint32(t))
+}
+
+// named returns true if entries with the tag apply to a user or group id.
+func (t ACLTag) named() bool {
+	return t == ACLUser || t == ACLGroup
+}
+
+// ACLPerm holds the permissions of an ACL entry.
+type ACLPerm uint32
+
+const (
+	ACLExecute ACLPerm = 1 << iota
+	ACLWrite
+	ACLRead
+)
+
+// String formats the permissions like ls(1), such as "r-x".
+func (p ACLPerm) String() string {
+	b := []byte("---")
+	if p&ACLRead != 0 {
+		b[0] = 'r'
+	}
+	if p&ACLWrite != 0 {
+		b[1] = 'w'
+	}
+	if p&ACLExecute != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+// ACLEntry is an entry of a POSIX ACL.
+type ACLEntry struct {
+	Tag ACLTag
+
+	// ID is the user or group id of ACLUser and ACLGroup entries.
+	ID int64
+
+	Perm ACLPerm
+}
+
+// String formats the entry like getfacl(1), such as "user:1000:r-x".
+func (e ACLEntry) String() string {
+	var id string
+	if e.Tag.named() {
+		id = strconv.FormatInt(e.ID, 10)
+	}
+	return e.Tag.String() + ":" + id + ":" + e.Perm.String()
+}
+
+// ACL is a POSIX ACL, as set by setfacl(1).
+type ACL []ACLEntry
+
+// String formats the ACL as its comma separated entries.
+func (acl ACL) String() string {
+	entries := make([]string, len(acl))
+	for i, e := range acl {
+		entries[i] = e.String()
+	}
+	return strings.Join(entries, ",")
+}
+
+const (
+	aclXAttrVersion = 2
+	aclUndefinedID  = math.MaxUint32
+)
+
+// decodeACL decodes the value of a system.posix_acl_* xattr. Only entries
+// which encode back to the same value are accepted.
+func decodeACL(p []byte) (ACL, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	if len(p) < 4 || (len(p)-4)%8 != 0 {
+		return nil, fmt.Errorf("invalid ACL size %d", len(p))
+	}
+	if version := binary.LittleEndian.Uint32(p); version != aclXAttrVersion {
+		return nil, fmt.Errorf("unsupported ACL version %d: %w", version, ErrNotSupported)
+	}
+
+	acl := make(ACL, 0, (len(p)-4)/8)
+	for p = p[4:]; len(p) > 0; p = p[8:] {
+		e := ACLEntry{
+			Tag:  ACLTag(binary.LittleEndian.Uint16(p)),
+			Perm: ACLPerm(binary.LittleEndian.Uint16(p[2:])),
+		}
+		id := binary.LittleEndian.Uint32(p[4:])
+
+		if _, ok := aclTagNames[e.Tag]; !ok {
+			return nil, fmt.Errorf("unknown ACL tag %#x", uint32(e.Tag))
+		}
+		if e.Perm&^(ACLRead|ACLWrite|ACLExecute) != 0 {
+			return nil, fmt.Errorf("unknown ACL permissions %#x", uint32(e.Perm))
+		}
+		if e.Tag.named() {
+			e.ID = int64(id)
+		} else if id != aclUndefinedID {
+			return nil, fmt.Errorf("unexpected id %d for %v ACL entry", id, e.Tag)
+		}
+
+		acl = append(acl, e)
+	}
+
+	return acl, nil
+}
+
+// encode returns the value of a system.posix_acl_* xattr for the ACL.
+func (acl ACL) encode() ([]byte, error) {
+	p := make([]byte, 4+8*len(acl))
+	binary.LittleEndian.PutUint32(p, aclXAttrVersion)
+
+	for i, e := range acl {
+		if _, ok := aclTagNames[e.Tag]; !ok {
+			return nil, fmt.Errorf("unknown ACL tag %#x", uint32(e.Tag))
+		}
+		if e.Perm&^(ACLRead|ACLWrite|ACLExecute) != 0 {
+			return nil, fmt.Errorf("unknown ACL permissions %#x", uint32(e.Perm))
+		}
+
+		id := uint32(aclUndefinedID)
+		if e.Tag.named() {
+			if e.ID < 0 || e.ID >= aclUndefinedID {
+				return nil, fmt.Errorf("invalid id %d for %v ACL entry", e.ID, e.Tag)
+			}
+			id = uint32(e.ID)
+		}
+
+		entry := p[4+8*i:]
+		binary.LittleEndian.PutUint16(entry, uint16(e.Tag))
+		binary.LittleEndian.PutUint16(entry[2:], uint16(e.Perm))
+		binary.LittleEndian.PutUint32(entry[4:], id)
+	}
+
+	return p, nil
+}
+
+// InodeFlags are the inode flags of a file on Linux, as set by chattr(1).
+// Only the flags which can be changed on any filesystem supporting them are
+// recorded.
+type InodeFlags uint32
+
+const (
+	// InodeSync writes changes to the file synchronously.
+	InodeSync InodeFlags = 0x00000008
+
+	// InodeImmutable prevents any change to the file.
+	InodeImmutable InodeFlags = 0x00000010
+
+	// InodeAppend only allows the file to be opened for appending.
+	InodeAppend InodeFlags = 0x00000020
+
+	// InodeNoDump excludes the file from backups by dump(8).
+	InodeNoDump InodeFlags = 0x00000040
+
+	// InodeNoAtime does not update the access time of the file.
+	InodeNoAtime InodeFlags = 0x00000080
+
+	// InodeDirSync writes changes to the directory synchronously.
+	InodeDirSync InodeFlags = 0x00010000
+
+	// inodeFlagsMask holds the flags that are recorded.
+	inodeFlagsMask = InodeSync | InodeImmutable | InodeAppend | InodeNoDump | InodeNoAtime | InodeDirSync
+
+	// inodeFlagsLocked holds the flags preventing changes to a file.
+	inodeFlagsLocked = InodeImmutable | InodeAppend
+)
+
+// inodeFlagLetters holds the letters of the flags, in the order of
+// lsattr(1).
+var inodeFlagLetters = []struct {
+	flag   InodeFlags
+	letter byte
+}{
+	{InodeSync, 'S'},
+	{InodeDirSync, 'D'},
+	{InodeImmutable, 'i'},
+	{InodeAppend, 'a'},
+	{InodeNoDump, 'd'},
+	{InodeNoAtime, 'A'},
+}
+
+// String returns the letters of the flags used by chattr(1), such as "ia",
+// or "-" if no flag is set.
+func (f InodeFlags) String() string {
+	var b []byte
+	for _, fl := range inodeFlagLetters {
+		if f&fl.flag != 0 {
+			b = append(b, fl.letter)
+		}
+	}
+
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
+
+// toProtoXAttr records the xattr in the typed field of the protobuf record
+// decoding it, if any. The xattr itself is recorded as well, so that readers
+// predating the typed fields keep it.
+func toProtoXAttr(b *pb.Resource, name string, value []byte) {
+	switch name {
+	case xattrCapability:
+		c, err := decodeCapabilities(value)
+		if err != nil {
+			return
+		}
+
+		b.Capabilities = &pb.Capabilities{
+			Version:     c.Version,
+			Permitted:   c.Permitted,
+			Inheritable: c.Inheritable,
+			Effective:   c.Effective,
+			RootId:      c.RootID,
+		}
+	case xattrACLAccess, xattrACLDefault:
+		acl, err := decodeACL(value)
+		if err != nil || len(acl) == 0 {
+			return
+		}
+
+		entries := make([]*pb.ACLEntry, len(acl))
+		for i, e := range acl {
+			entries[i] = &pb.ACLEntry{Tag: uint32(e.Tag), Id: e.ID, Perm: uint32(e.Perm)}
+		}
+
+		if name == xattrACLAccess {
+			b.Acl = entries
+		} else {
+			b.DefaultAcl = entries
+		}
+	}
+}
+
+// fromProtoLinuxAttrs restores the capabilities and ACLs of the protobuf
+// record as xattrs of base, along with the inode flags. They replace the
+// xattrs recorded next to them.
+func fromProtoLinuxAttrs(b *pb.Resource, base *resource) error {
+	if b.Capabilities != nil {
+		c := Capabilities{
+			Version:     b.Capabilities.Version,
+			Permitted:   b.Capabilities.Permitted,
+			Inheritable: b.Capabilities.Inheritable,
+			Effective:   b.Capabilities.Effective,
+			RootID:      b.Capabilities.RootId,
+		}
+
+		value, err := c.encode()
+		if err != nil {
+			return fmt.Errorf("invalid capabilities for %v: %w", b.Path, err)
+		}
+		base.xattrs[xattrCapability] = value
+	}
+
+	for name, entries := range map[string][]*pb.ACLEntry{
+		xattrACLAccess:  b.Acl,
+		xattrACLDefault: b.DefaultAcl,
+	} {
+		if len(entries) == 0 {
+			continue
+		}
+
+		acl := make(ACL, len(entries))
+		for i, e := range entries {
+			acl[i] = ACLEntry{Tag: ACLTag(e.Tag), ID: e.Id, Perm: ACLPerm(e.Perm)}
+		}
+
+		value, err := acl.encode()
+		if err != nil {
+			return fmt.Errorf("invalid ACL for %v: %w", b.Path, err)
+		}
+		base.xattrs[name] = value
+	}
+
+	if InodeFlags(b.Flags)&^inodeFlagsMask != 0 {
+		return fmt.Errorf("unknown inode flags %#x for %v", b.Flags, b.Path)
+	}
+	base.flags = InodeFlags(b.Flags)
+
+	return nil
+}
+
+// inodeFlagsOf returns the inode flags of the resource.
+func inodeFlagsOf(rsrc Resource) InodeFlags {
+	if la, ok := rsrc.(LinuxAttributer); ok {
+		return la.InodeFlags()
+	}
+	return 0
+}
+
+// withoutInodeFlags returns a copy of the directory without inode flags.
+// Other resources are returned as is.
+func withoutInodeFlags(rsrc Resource) Resource {
+	switch r := rsrc.(type) {
+	case *directory:
+		c := *r
+		c.flags = 0
+		return &c
+	case *opaqueDirectory:
+		c := *r
+		c.flags = 0
+		return &c
+	}
+	return rsrc
+}
+
+// resolveInodeFlags returns the recorded inode flags of the file at fp.
+// Only regular files and directories carry inode flags.
+func (c *context) resolveInodeFlags(fp string, fi os.FileInfo) (InodeFlags, error) {
+	if !fi.Mode().IsRegular() && !fi.Mode().IsDir() {
+		return 0, nil
+	}
+
+	flagsDriver, ok := c.driver.(driverpkg.InodeFlagsDriver)
+	if !ok {
+		return 0, nil
+	}
+
+	flags, err := flagsDriver.GetInodeFlags(fp)
+	if err != nil {
+		return 0, err
+	}
+
+	return InodeFlags(flags) & inodeFlagsMask, nil
+}
+
+// applyInodeFlags sets the recorded inode flags of the file at fp to flags,
+// leaving the others unchanged.
+func (c *context) applyInodeFlags(fp string, flags InodeFlags) error {
+	flagsDriver, ok := c.driver.(driverpkg.InodeFlagsDriver)
+	if !ok {
+		if flags == 0 {
+			return nil
+		}
+		return fmt.Errorf("setting inode flags is not supported: %w", ErrNotSupported)
+	}
+
+	current, err := flagsDriver.GetInodeFlags(fp)
+	if err != nil {
+		return err
+	}
+
+	updated := current&^uint32(inodeFlagsMask) | uint32(flags)
+	if updated == current {
+		return nil
+	}
+
+	return flagsDriver.SetInodeFlags(fp, updated)
+}
+
+// unlockInodeFlags clears the immutable and append-only flags of the
+// existing file at fp, so that it can be modified, removed or replaced.
+// They are set again with the other metadata of the resource, if recorded.
+func (c *context) unlockInodeFlags(fp string, fi os.FileInfo) error {
+	flags, err := c.resolveInodeFlags(fp, fi)
+	if err != nil || flags&inodeFlagsLocked == 0 {
+		return err
+	}
+
+	return c.applyInodeFlags(fp, flags&^inodeFlagsLocked)
+}
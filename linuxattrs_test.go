@@ -0,0 +1,309 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	driverpkg "github.com/containerd/continuity/driver"
+	"github.com/containerd/continuity/testutil"
+)
+
+func TestCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		caps     Capabilities
+		expected string
+	}{
+		{
+			caps:     Capabilities{Version: 2, Permitted: 1<<10 | 1<<13, Effective: true},
+			expected: "cap_net_bind_service,cap_net_raw=ep",
+		},
+		{
+			caps:     Capabilities{Version: 3, Permitted: 1 << 21, Inheritable: 1<<21 | 1<<40, RootID: 100000},
+			expected: "cap_sys_admin=ip cap_checkpoint_restore=i [rootid=100000]",
+		},
+		{
+			caps:     Capabilities{Version: 2, Permitted: 1 << 63},
+			expected: "cap_63=p",
+		},
+		{
+			caps:     Capabilities{Version: 3},
+			expected: "=",
+		},
+	} {
+		p, err := tc.caps.encode()
+		if err != nil {
+			t.Fatalf("error encoding %#v: %v", tc.caps, err)
+		}
+
+		decoded, err := decodeCapabilities(p)
+		if err != nil {
+			t.Fatalf("error decoding %#v: %v", tc.caps, err)
+		}
+		if *decoded != tc.caps {
+			t.Fatalf("unexpected capabilities: %#v != %#v", *decoded, tc.caps)
+		}
+
+		if s := decoded.String(); s != tc.expected {
+			t.Errorf("unexpected string: %q != %q", s, tc.expected)
+		}
+	}
+
+	// version 1 is not supported.
+	if _, err := decodeCapabilities([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Fatal("expected version 1 capabilities to fail")
+	}
+	if _, err := (&Capabilities{Version: 2, RootID: 1}).encode(); err == nil {
+		t.Fatal("expected version 2 capabilities with a root id to fail")
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl := ACL{
+		{Tag: ACLUserObj, Perm: ACLRead | ACLWrite | ACLExecute},
+		{Tag: ACLUser, ID: 1000, Perm: ACLRead | ACLExecute},
+		{Tag: ACLGroupObj, Perm: ACLRead},
+		{Tag: ACLMask, Perm: ACLRead | ACLExecute},
+		{Tag: ACLOther},
+	}
+
+	p, err := acl.encode()
+	if err != nil {
+		t.Fatalf("error encoding ACL: %v", err)
+	}
+
+	decoded, err := decodeACL(p)
+	if err != nil {
+		t.Fatalf("error decoding ACL: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, acl) {
+		t.Fatalf("unexpected ACL: %v != %v", decoded, acl)
+	}
+
+	expected := "user::rwx,user:1000:r-x,group::r--,mask::r-x,other::---"
+	if s := decoded.String(); s != expected {
+		t.Fatalf("unexpected string: %q != %q", s, expected)
+	}
+
+	// the id of unnamed entries must be undefined.
+	p[8] = 0
+	if _, err := decodeACL(p); err == nil {
+		t.Fatal("expected ACL with an id for the owner to fail")
+	}
+}
+
+func TestLinuxAttrsProto(t *testing.T) {
+	caps, err := (&Capabilities{Version: 3, Permitted: 1 << 10, Effective: true, RootID: 1000}).encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := ACL{{Tag: ACLUserObj, Perm: ACLRead}, {Tag: ACLGroup, ID: 10, Perm: ACLRead}}.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs := map[string][]byte{
+		xattrCapability: caps,
+		xattrACLDefault: acl,
+		"user.a":        []byte("a"),
+	}
+	m := &Manifest{Resources: []Resource{
+		&directory{resource: resource{paths: []string{"/d"}, mode: os.ModeDir | 0o755, xattrs: xattrs, flags: InodeImmutable | InodeNoDump}},
+		// capabilities of unknown versions are kept as xattrs.
+		&regularFile{resource: resource{paths: []string{"/f"}, mode: 0o644, xattrs: map[string][]byte{xattrCapability: {1, 2, 3}}}},
+	}}
+
+	// the decoded xattrs are recorded as well, for older readers.
+	b := toProto(m.Resources[0])
+	if b.Capabilities == nil || b.Capabilities.RootId != 1000 || len(b.DefaultAcl) != 2 || len(b.Xattr) != 3 || b.Flags != 0x50 {
+		t.Fatalf("unexpected protobuf record: %v", b)
+	}
+	if b := toProto(m.Resources[1]); b.Capabilities != nil || len(b.Xattr) != 1 {
+		t.Fatalf("unexpected protobuf record: %v", b)
+	}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := decoded.Resources[0].(Directory)
+	if !reflect.DeepEqual(d.XAttrs(), xattrs) {
+		t.Fatalf("unexpected xattrs: %v != %v", d.XAttrs(), xattrs)
+	}
+
+	la := d.(LinuxAttributer)
+	if la.Capabilities().String() != "cap_net_bind_service=ep [rootid=1000]" {
+		t.Fatalf("unexpected capabilities: %v", la.Capabilities())
+	}
+	if la.AccessACL() != nil || la.DefaultACL().String() != "user::r--,group:10:r--" {
+		t.Fatalf("unexpected ACLs: %v, %v", la.AccessACL(), la.DefaultACL())
+	}
+	if la.InodeFlags() != InodeImmutable|InodeNoDump || la.InodeFlags().String() != "id" {
+		t.Fatalf("unexpected inode flags: %v", la.InodeFlags())
+	}
+
+	if f := decoded.Resources[1].(RegularFile); !bytes.Equal(f.XAttrs()[xattrCapability], []byte{1, 2, 3}) {
+		t.Fatalf("unexpected xattrs: %v", f.XAttrs())
+	}
+
+	// the typed fields take precedence over the xattrs recorded next to them.
+	b.Capabilities.RootId = 0
+	b.DefaultAcl = b.DefaultAcl[:1]
+	rsrc, err := fromProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	la = rsrc.(LinuxAttributer)
+	if la.Capabilities().RootID != 0 || la.DefaultACL().String() != "user::r--" {
+		t.Fatalf("unexpected attributes: %v, %v", la.Capabilities(), la.DefaultACL())
+	}
+}
+
+func TestApplyUnreadableInodeFlags(t *testing.T) {
+	if _, ok := driverpkg.LocalDriver.(driverpkg.InodeFlagsDriver); !ok {
+		t.Skip("inode flags are not supported")
+	}
+
+	// without privileges, the inode flags of a directory that may not be
+	// read are looked up without opening it.
+	m := &Manifest{Resources: []Resource{
+		&directory{resource: resource{
+			paths: []string{"/d"},
+			mode:  os.ModeDir | 0o311,
+			uid:   int64(os.Getuid()),
+			gid:   int64(os.Getgid()),
+		}},
+	}}
+
+	root := t.TempDir()
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+	if err := ApplyManifest(fsContext, m); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(root, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsrc, err := fsContext.Resource("/d", fi)
+	if err != nil {
+		t.Fatalf("error getting resource: %v", err)
+	}
+	if flags := inodeFlagsOf(rsrc); flags != 0 {
+		t.Fatalf("unexpected inode flags: %v", flags)
+	}
+}
+
+func TestApplyInodeFlags(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	if _, ok := driverpkg.LocalDriver.(driverpkg.InodeFlagsDriver); !ok {
+		t.Skip("inode flags are not supported")
+	}
+
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			kind: rdirectory,
+			path: "d",
+			mode: 0o755,
+		},
+		{
+			path: "d/a",
+			mode: 0o644,
+		},
+		{
+			path: "f",
+			mode: 0o644,
+		},
+	})
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	// unlock clears the inode flags set under dir, so that it can be
+	// removed.
+	c := fsContext.(*context)
+	unlock := func(dir string) {
+		for _, p := range []string{"d", "f"} {
+			c.applyInodeFlags(filepath.Join(dir, p), 0)
+		}
+	}
+	t.Cleanup(func() { unlock(root) })
+
+	for p, flags := range map[string]InodeFlags{"d": InodeImmutable, "f": InodeAppend | InodeNoDump} {
+		if err := c.applyInodeFlags(filepath.Join(root, p), flags); err != nil {
+			t.Skipf("inode flags are not supported: %v", err)
+		}
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	if flags := inodeFlagsOf(m.Resources[0]); flags != InodeImmutable {
+		t.Fatalf("unexpected flags of %q: %v", m.Resources[0].Path(), flags)
+	}
+
+	for _, opts := range []ApplyOptions{{}, {Transactional: true}} {
+		target := t.TempDir()
+		t.Cleanup(func() { unlock(target) })
+
+		tc, err := NewContextWithOptions(target, ContextOptions{Provider: testProviderFrom(t, root, "d/a", "f")})
+		if err != nil {
+			t.Fatalf("error getting context: %v", err)
+		}
+
+		// the entries of the immutable directory are created first, and
+		// existing immutable entries are changed when applying again.
+		for i := 0; i < 2; i++ {
+			if err := ApplyManifestWithOptions(tc, m, opts); err != nil {
+				t.Fatalf("error applying manifest: %v", err)
+			}
+		}
+
+		report, err := VerifyManifestReport(tc, m)
+		if err != nil {
+			t.Fatalf("error verifying manifest: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("unexpected mismatches: %v", report.Err())
+		}
+
+		if err := os.Remove(filepath.Join(target, "d", "a")); err == nil {
+			t.Fatal("expected the entry of the immutable directory to be kept")
+		}
+	}
+}
@@ -17,12 +17,18 @@
 package continuity
 
 import (
+	"bytes"
+	gocontext "context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
 
 	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 )
@@ -30,10 +36,16 @@ import (
 // Manifest provides the contents of a manifest. Users of this struct should
 // not typically modify any fields directly.
 type Manifest struct {
+	// Header describes the manifest. It is nil for manifests written before
+	// the header was introduced.
+	Header *Header
+
 	// Resources specifies all the resources for a manifest in order by path.
 	Resources []Resource
 }
 
+// Unmarshal decodes a manifest encoded with Marshal. Manifests with a header
+// declaring an unsupported version or digest algorithm are rejected.
 func Unmarshal(p []byte) (*Manifest, error) {
 	var bm pb.Manifest
 
@@ -41,13 +53,52 @@ func Unmarshal(p []byte) (*Manifest, error) {
 		return nil, err
 	}
 
-	var m Manifest
+	return fromProtoManifest(&bm)
+}
+
+// UnmarshalText decodes a manifest encoded with MarshalText.
+func UnmarshalText(p []byte) (*Manifest, error) {
+	var bm pb.Manifest
+
+	if err := prototext.Unmarshal(p, &bm); err != nil {
+		return nil, err
+	}
+
+	return fromProtoManifest(&bm)
+}
+
+func toProtoManifest(m *Manifest) *pb.Manifest {
+	bm := &pb.Manifest{
+		Header: toProtoHeader(manifestHeader(m)),
+	}
+	for _, rsrc := range m.Resources {
+		bm.Resource = append(bm.Resource, toProto(rsrc))
+	}
+
+	return bm
+}
+
+// fromProtoManifest decodes the manifest, rejecting headers that are not
+// supported.
+func fromProtoManifest(bm *pb.Manifest) (*Manifest, error) {
+	header, err := fromProtoHeader(bm.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Manifest{Header: header}
 	for _, b := range bm.Resource {
 		r, err := fromProto(b)
 		if err != nil {
 			return nil, err
 		}
 
+		if header != nil {
+			if err := header.validateResource(r); err != nil {
+				return nil, err
+			}
+		}
+
 		m.Resources = append(m.Resources, r)
 	}
 
@@ -55,21 +106,15 @@ func Unmarshal(p []byte) (*Manifest, error) {
 }
 
 func Marshal(m *Manifest) ([]byte, error) {
-	var bm pb.Manifest
-	for _, rsrc := range m.Resources {
-		bm.Resource = append(bm.Resource, toProto(rsrc))
-	}
+	bm := toProtoManifest(m)
 
-	return proto.Marshal(&bm)
+	return proto.Marshal(bm)
 }
 
 func MarshalText(w io.Writer, m *Manifest) error {
-	var bm pb.Manifest
-	for _, rsrc := range m.Resources {
-		bm.Resource = append(bm.Resource, toProto(rsrc))
-	}
+	bm := toProtoManifest(m)
 
-	b, err := prototext.Marshal(&bm)
+	b, err := prototext.Marshal(bm)
 	if err != nil {
 		return err
 	}
@@ -77,22 +122,154 @@ func MarshalText(w io.Writer, m *Manifest) error {
 	return err
 }
 
+// MarshalJSON encodes the manifest in the canonical proto3 JSON mapping of
+// the Manifest message: fields use their lowerCamelCase JSON names, 64-bit
+// unsigned integers are strings and xattr values are base64 encoded. Unlike
+// protojson, the output is stable, so equal manifests encode identically.
+func (m *Manifest) MarshalJSON() ([]byte, error) {
+	bm := toProtoManifest(m)
+
+	b, err := protojson.Marshal(bm)
+	if err != nil {
+		return nil, err
+	}
+
+	// protojson randomizes whitespace to discourage relying on its output,
+	// compacting it makes the encoding stable.
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON decodes a manifest encoded with MarshalJSON, replacing the
+// resources of m.
+func (m *Manifest) UnmarshalJSON(p []byte) error {
+	var bm pb.Manifest
+
+	if err := protojson.Unmarshal(p, &bm); err != nil {
+		return err
+	}
+
+	decoded, err := fromProtoManifest(&bm)
+	if err != nil {
+		return err
+	}
+
+	*m = *decoded
+	return nil
+}
+
+// BuildOptions configures how a manifest is built.
+type BuildOptions struct {
+	// Concurrency is the number of resources resolved at once. Resolving a
+	// regular file reads and digests its content, so this bounds the number
+	// of files digested in parallel. Values less than two build serially.
+	// The resulting manifest does not depend on the concurrency.
+	Concurrency int
+
+	// Previous is a manifest built earlier from the same context, with the
+	// same Digester. Regular files which are unchanged since Previous was
+	// built reuse its digests rather than being read again. A file is
+	// considered unchanged if its size and cache key (inode and modification
+	// time) match. Only files recorded with a cache key can be reused, so
+	// Previous should have been built with CacheKeys set.
+	Previous *Manifest
+
+	// CacheKeys records a cache key for each regular file, allowing the
+	// manifest to be used as Previous for a later build. Cache keys describe
+	// files on the system they were built on and are not portable. Cache keys
+	// are always recorded when Previous is set.
+	CacheKeys bool
+
+	// StrictCache additionally requires the inode change time of a file to
+	// be unchanged before reusing its digests. This catches modifications
+	// which preserve the modification time, at the cost of reading files
+	// when only their metadata has changed.
+	StrictCache bool
+
+	// Tool identifies the program building the manifest in its header.
+	Tool string
+
+	// Annotations are recorded in the header of the manifest.
+	Annotations map[string]string
+
+	// Overlay reads the context as the upper directory of an overlay
+	// filesystem, so that the manifest describes the changes of the layer:
+	// whiteout devices are recorded as Whiteout resources and directories
+	// marked opaque as OpaqueDirectory resources.
+	Overlay bool
+
+	// Filter selects the paths to include in the manifest. Directories
+	// holding selected paths are always included. Paths which are not
+	// selected are not read and directories which cannot hold selected
+	// paths are not walked.
+	Filter *Filter
+}
+
 // BuildManifest creates the manifest for the given context
 func BuildManifest(fsContext Context) (*Manifest, error) {
-	resourcesByPath := map[string]Resource{}
-	hardLinks := newHardlinkManager()
+	return BuildManifestWithOptions(gocontext.Background(), fsContext, BuildOptions{})
+}
 
-	if err := fsContext.Walk(func(p string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return fmt.Errorf("error walking %s: %w", p, err)
-		}
+// BuildManifestWithOptions creates the manifest for the given context,
+// stopping early if ctx is canceled.
+func BuildManifestWithOptions(ctx gocontext.Context, fsContext Context, opts BuildOptions) (*Manifest, error) {
+	var resources []Resource
+	if err := walkResources(ctx, fsContext, opts, func(rsrc Resource) error {
+		resources = append(resources, rsrc)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
-		if p == string(os.PathSeparator) {
-			// skip root
-			return nil
-		}
+	sort.Stable(ByPath(resources))
+
+	header, err := NewHeader(fsContext, opts)
+	if err != nil {
+		return nil, err
+	}
+	header.DigestAlgorithms = digestAlgorithms(resources)
 
-		rsrc, err := fsContext.Resource(p, fi)
+	return &Manifest{
+		Header:    header,
+		Resources: resources,
+	}, nil
+}
+
+// BuildManifestStream writes the manifest for the given context to w, one
+// resource at a time. Resources are written in the order they are walked,
+// except for hardlinked files which are held back until the walk completes
+// so that they can be merged. Memory use is therefore only proportional to
+// the number of hardlinked files in the context.
+func BuildManifestStream(fsContext Context, w *ManifestWriter) error {
+	return BuildManifestStreamWithOptions(gocontext.Background(), fsContext, w, BuildOptions{})
+}
+
+// BuildManifestStreamWithOptions is like BuildManifestStream, stopping early
+// if ctx is canceled.
+func BuildManifestStreamWithOptions(ctx gocontext.Context, fsContext Context, w *ManifestWriter, opts BuildOptions) error {
+	if err := walkResources(ctx, fsContext, opts, w.Write); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// walkResources walks the context, calling fn for each resource in the order
+// walked. Hardlinked resources are merged and passed to fn, ordered by path,
+// after the walk.
+func walkResources(ctx gocontext.Context, fsContext Context, opts BuildOptions, fn func(Resource) error) error {
+	hardLinks := newHardlinkManager()
+	resolve := resourceResolver(fsContext, opts)
+	if opts.Overlay {
+		resolve = overlayResolver(resolve)
+	}
+	parents := parentResolver(opts.Filter, resolve, fn)
+
+	add := func(p string, fi os.FileInfo, rsrc Resource, err error) error {
 		if err != nil {
 			if err == ErrNotFound {
 				return nil
@@ -100,43 +277,202 @@ func BuildManifest(fsContext Context) (*Manifest, error) {
 			return fmt.Errorf("failed to get resource %q: %w", p, err)
 		}
 
+		if err := parents(p, fi.IsDir()); err != nil {
+			return err
+		}
+
 		// add to the hardlink manager
 		if err := hardLinks.Add(fi, rsrc); err == nil {
-			// Resource has been accepted by hardlink manager so we don't add
-			// it to the resourcesByPath until we merge at the end.
+			// Resource has been accepted by hardlink manager so we don't
+			// pass it on until we merge at the end.
 			return nil
 		} else if err != errNotAHardLink {
 			// handle any other case where we have a proper error.
 			return fmt.Errorf("adding hardlink %s: %w", p, err)
 		}
 
-		resourcesByPath[p] = rsrc
+		return fn(rsrc)
+	}
 
-		return nil
-	}); err != nil {
-		return nil, err
+	var err error
+	if opts.Concurrency > 1 {
+		err = walkResourcesConcurrent(ctx, fsContext, opts.Filter, opts.Concurrency, resolve, add)
+	} else {
+		err = walkFilteredFiles(ctx, fsContext, opts.Filter, func(p string, fi os.FileInfo) error {
+			rsrc, err := resolve(p, fi)
+			return add(p, fi, rsrc, err)
+		})
+	}
+	if err != nil {
+		return err
 	}
 
 	// merge and post-process the hardlinks.
 	hardLinked, err := hardLinks.Merge()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	sort.Stable(ByPath(hardLinked))
 	for _, rsrc := range hardLinked {
-		resourcesByPath[rsrc.Path()] = rsrc
+		if err := fn(rsrc); err != nil {
+			return err
+		}
 	}
 
-	var resources []Resource
-	for _, rsrc := range resourcesByPath {
-		resources = append(resources, rsrc)
+	return nil
+}
+
+// parentResolver returns a function passing the directories holding the
+// path p to fn, when they are not selected by the filter themselves. Each
+// directory is passed once, before the first path it holds. Paths are
+// expected in the order walked. Directories are resolved with resolve, like
+// the selected paths, without an os.FileInfo.
+func parentResolver(filter *Filter, resolve func(p string, fi os.FileInfo) (Resource, error), fn func(Resource) error) func(p string, isDir bool) error {
+	if filter == nil {
+		return func(string, bool) error { return nil }
 	}
 
-	sort.Stable(ByPath(resources))
+	seen := map[string]struct{}{}
+	return func(p string, isDir bool) error {
+		if isDir {
+			seen[p] = struct{}{}
+		}
 
-	return &Manifest{
-		Resources: resources,
-	}, nil
+		var missing []string
+		for dir := filepath.Dir(p); dir != p && dir != string(os.PathSeparator) && dir != "."; dir = filepath.Dir(dir) {
+			if _, ok := seen[dir]; ok {
+				break
+			}
+			missing = append(missing, dir)
+		}
+
+		// outermost first
+		for i := len(missing) - 1; i >= 0; i-- {
+			dir := missing[i]
+			rsrc, err := resolve(dir, nil)
+			if err != nil {
+				return fmt.Errorf("failed to get resource %q: %w", dir, err)
+			}
+			if err := fn(rsrc); err != nil {
+				return err
+			}
+			seen[dir] = struct{}{}
+		}
+
+		return nil
+	}
+}
+
+// walkFilteredFiles walks the context like walkFiles, calling fn only for the
+// paths selected by filter. Directories which cannot hold selected paths are
+// skipped.
+func walkFilteredFiles(ctx gocontext.Context, fsContext Context, filter *Filter, fn func(p string, fi os.FileInfo) error) error {
+	return walkFiles(ctx, fsContext, func(p string, fi os.FileInfo) error {
+		if filter.Match(p, fi.IsDir()) {
+			return fn(p, fi)
+		}
+
+		if fi.IsDir() && !filter.mayHold(p) {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// walkFiles walks the context, calling fn for each path other than the
+// root until ctx is canceled.
+func walkFiles(ctx gocontext.Context, fsContext Context, fn func(p string, fi os.FileInfo) error) error {
+	return fsContext.Walk(func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking %s: %w", p, err)
+		}
+
+		if p == string(os.PathSeparator) {
+			// skip root
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return fn(p, fi)
+	})
+}
+
+// pendingResource is a resource being resolved by a worker.
+type pendingResource struct {
+	p    string
+	fi   os.FileInfo
+	rsrc Resource
+	err  error
+	done chan struct{}
+}
+
+// walkResourcesConcurrent resolves resources on a pool of workers while
+// walking the context, passing them to add in the order walked.
+func walkResourcesConcurrent(ctx gocontext.Context, fsContext Context, filter *Filter, workers int, resolve func(p string, fi os.FileInfo) (Resource, error), add func(p string, fi os.FileInfo, rsrc Resource, err error) error) error {
+	ctx, cancel := gocontext.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		jobs  = make(chan *pendingResource)
+		queue = make(chan *pendingResource, workers)
+		added = make(chan error, 1)
+		wg    sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pr := range jobs {
+				pr.rsrc, pr.err = resolve(pr.p, pr.fi)
+				close(pr.done)
+			}
+		}()
+	}
+
+	// Results are consumed in the order walked, so the output does not
+	// depend on which worker finishes first.
+	go func() {
+		var err error
+		for pr := range queue {
+			<-pr.done
+			if err != nil {
+				continue
+			}
+
+			if err = add(pr.p, pr.fi, pr.rsrc, pr.err); err != nil {
+				cancel()
+			}
+		}
+		added <- err
+	}()
+
+	err := walkFilteredFiles(ctx, fsContext, filter, func(p string, fi os.FileInfo) error {
+		pr := &pendingResource{p: p, fi: fi, done: make(chan struct{})}
+		select {
+		case queue <- pr:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		jobs <- pr
+		return nil
+	})
+
+	close(jobs)
+	close(queue)
+	wg.Wait()
+
+	if addErr := <-added; addErr != nil {
+		return addErr
+	}
+
+	return err
 }
 
 // VerifyManifest verifies all the resources in a manifest
@@ -151,14 +487,252 @@ func VerifyManifest(fsContext Context, manifest *Manifest) error {
 	return nil
 }
 
+// VerifyManifestStream verifies the resources read from r against files
+// from the given context, one at a time.
+func VerifyManifestStream(fsContext Context, r *ManifestReader) error {
+	for {
+		rsrc, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := fsContext.Verify(rsrc); err != nil {
+			return err
+		}
+	}
+}
+
+// ApplyOptions configures how a manifest is applied.
+type ApplyOptions struct {
+	// Prune makes the context match the manifest exactly. Paths not in the
+	// manifest are removed, deepest first, xattrs not defined by a resource
+	// are removed and entries of the wrong type are replaced rather than
+	// causing an error.
+	Prune bool
+
+	// Transactional applies the manifest such that either all changes are
+	// made or, if any operation fails, none are. Content is staged before
+	// the context is modified and replaced entries are kept in a hidden
+	// directory within the context root until the apply completes.
+	// Transactional applies keep the whole manifest in memory.
+	Transactional bool
+
+	// Filter selects the paths of the manifest to apply. Paths which are
+	// not selected are neither applied nor pruned.
+	Filter *Filter
+}
+
 // ApplyManifest applies on the resources in a manifest to
 // the given context.
 func ApplyManifest(fsContext Context, manifest *Manifest) error {
+	return ApplyManifestWithOptions(fsContext, manifest, ApplyOptions{})
+}
+
+// ApplyManifestWithOptions applies the resources in a manifest to the given
+// context.
+func ApplyManifestWithOptions(fsContext Context, manifest *Manifest, opts ApplyOptions) error {
+	if opts.Transactional {
+		filtered, err := filterManifest(manifest, opts.Filter)
+		if err != nil {
+			return err
+		}
+		return applyManifestTransaction(fsContext, filtered, opts)
+	}
+
+	a, err := newManifestApplier(fsContext, opts)
+	if err != nil {
+		return err
+	}
+
+	apply := filterResources(opts.Filter, a.apply)
 	for _, rsrc := range manifest.Resources {
-		if err := fsContext.Apply(rsrc); err != nil {
+		if err := apply(rsrc); err != nil {
+			return err
+		}
+	}
+
+	return a.finish()
+}
+
+// ApplyManifestStream applies the resources read from r to the given
+// context, one at a time. Only directories with recorded times are kept in
+// memory, to be applied again once all resources have been applied.
+func ApplyManifestStream(fsContext Context, r *ManifestReader) error {
+	return ApplyManifestStreamWithOptions(fsContext, r, ApplyOptions{})
+}
+
+// ApplyManifestStreamWithOptions applies the resources read from r to the
+// given context. When pruning, the paths of all resources are kept in memory
+// to find the paths to remove.
+func ApplyManifestStreamWithOptions(fsContext Context, r *ManifestReader, opts ApplyOptions) error {
+	if opts.Transactional {
+		var manifest Manifest
+		add := filterResources(opts.Filter, func(rsrc Resource) error {
+			manifest.Resources = append(manifest.Resources, rsrc)
+			return nil
+		})
+		for {
+			rsrc, err := r.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+
+			if err := add(rsrc); err != nil {
+				return err
+			}
+		}
+
+		return applyManifestTransaction(fsContext, &manifest, opts)
+	}
+
+	a, err := newManifestApplier(fsContext, opts)
+	if err != nil {
+		return err
+	}
+
+	apply := filterResources(opts.Filter, a.apply)
+	for {
+		rsrc, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if err := apply(rsrc); err != nil {
+			return err
+		}
+	}
+
+	return a.finish()
+}
+
+// pruneContext is implemented by contexts which support pruning.
+type pruneContext interface {
+	applyExact(Resource) error
+	remove(p string) error
+}
+
+// manifestApplier applies resources to a context, tracking the state needed
+// once all resources have been applied.
+type manifestApplier struct {
+	fsContext Context
+	pruner    pruneContext
+	filter    *Filter
+
+	// paths holds the paths of all resources applied, when pruning.
+	paths map[string]struct{}
+
+	// deferred holds the directories with recorded times or inode flags.
+	deferred []Resource
+}
+
+func newManifestApplier(fsContext Context, opts ApplyOptions) (*manifestApplier, error) {
+	a := &manifestApplier{fsContext: fsContext, filter: opts.Filter}
+	if opts.Prune {
+		pruner, ok := fsContext.(pruneContext)
+		if !ok {
+			return nil, fmt.Errorf("pruning is not supported by the context: %w", ErrNotSupported)
+		}
+
+		a.pruner = pruner
+		a.paths = map[string]struct{}{}
+	}
+
+	return a, nil
+}
+
+func (a *manifestApplier) apply(rsrc Resource) error {
+	if isDeferredDirectory(rsrc) {
+		a.deferred = append(a.deferred, asDirectory(rsrc))
+
+		// entries cannot be created in an immutable directory.
+		rsrc = withoutInodeFlags(rsrc)
+	}
+
+	if a.pruner == nil {
+		return a.fsContext.Apply(rsrc)
+	}
+
+	for _, p := range resourcePaths(rsrc) {
+		a.paths[p] = struct{}{}
+	}
+
+	return a.pruner.applyExact(rsrc)
+}
+
+// finish removes extraneous paths, when pruning, then applies directories
+// with recorded times or inode flags again. Creating or removing entries in
+// a directory updates its modification time, so these are applied deepest
+// first.
+func (a *manifestApplier) finish() error {
+	if a.pruner != nil {
+		if err := a.prune(); err != nil {
+			return err
+		}
+	}
+
+	for i := len(a.deferred) - 1; i >= 0; i-- {
+		if err := a.fsContext.Apply(a.deferred[i]); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// prune removes all paths selected by the filter from the context which
+// were not applied, deepest first.
+func (a *manifestApplier) prune() error {
+	var extra []string
+	if err := walkFilteredFiles(gocontext.Background(), a.fsContext, a.filter, func(p string, fi os.FileInfo) error {
+		if _, ok := a.paths[p]; !ok {
+			extra = append(extra, p)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Entries always sort after their parent directory.
+	sort.Sort(sort.Reverse(sort.StringSlice(extra)))
+	for _, p := range extra {
+		if err := a.pruner.remove(p); err != nil {
+			return fmt.Errorf("error pruning %q: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+// isDeferredDirectory returns true if the resource is a directory with a
+// recorded modification time or inode flags, which must be applied once its
+// entries are.
+func isDeferredDirectory(rsrc Resource) bool {
+	if _, ok := rsrc.(Directory); !ok {
+		return false
+	}
+
+	if inodeFlagsOf(rsrc) != 0 {
+		return true
+	}
+
+	t, ok := rsrc.(Timestamper)
+	return ok && !t.ModTime().IsZero()
+}
+
+// asDirectory returns the plain directory of an opaque directory, which
+// must not remove the entries applied since when applied again.
+func asDirectory(rsrc Resource) Resource {
+	if od, ok := rsrc.(*opaqueDirectory); ok {
+		return &od.directory
+	}
+	return rsrc
+}
@@ -20,6 +20,7 @@ package continuity
 
 import (
 	"bytes"
+	gocontext "context"
 	_ "crypto/sha256"
 	"errors"
 	"fmt"
@@ -30,8 +31,10 @@ import (
 	"sort"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/containerd/continuity/devices"
+	"github.com/containerd/continuity/sysx"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -189,6 +192,313 @@ func TestWalkFS(t *testing.T) {
 	}
 }
 
+func TestManifestTimestamps(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind: rdirectory,
+			path: "b",
+			mode: 0o755,
+		},
+		{
+			path: "b/c",
+			mode: 0o644,
+		},
+	})
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 678, time.UTC)
+	for _, p := range []string{"a", "b/c", "b"} {
+		if err := os.Chtimes(filepath.Join(root, p), mtime, mtime); err != nil {
+			t.Fatalf("error setting times: %v", err)
+		}
+	}
+
+	ctx, err := NewContextWithOptions(root, ContextOptions{Timestamps: TimestampModify})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatalf("error marshaling manifest: %v", err)
+	}
+
+	m, err = Unmarshal(p)
+	if err != nil {
+		t.Fatalf("error unmarshaling manifest: %v", err)
+	}
+
+	for _, rsrc := range m.Resources {
+		tr := rsrc.(Timestamper)
+		if !tr.ModTime().Equal(mtime) {
+			t.Errorf("unexpected mtime for %q: %v != %v", rsrc.Path(), tr.ModTime(), mtime)
+		}
+		if !tr.AccessTime().IsZero() || !tr.ChangeTime().IsZero() {
+			t.Errorf("unexpected atime or ctime recorded for %q", rsrc.Path())
+		}
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(root, "b/c"), now, now); err != nil {
+		t.Fatalf("error setting times: %v", err)
+	}
+
+	if err := VerifyManifest(ctx, m); err == nil {
+		t.Fatal("expected verification to fail after changing mtime")
+	}
+
+	if err := ApplyManifest(ctx, m); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+}
+
+func TestBuildManifestConcurrency(t *testing.T) {
+	root := t.TempDir()
+	resources := []dresource{
+		{
+			kind: rdirectory,
+			path: "a",
+			mode: 0o755,
+		},
+		{
+			kind: rdirectory,
+			path: "b",
+			mode: 0o755,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "b/link",
+			target: "../a/0",
+		},
+	}
+	for i := 0; i < 16; i++ {
+		resources = append(resources, dresource{
+			path: fmt.Sprintf("a/%d", i),
+			mode: 0o644,
+		})
+	}
+	resources = append(resources, dresource{
+		kind:   rhardlink,
+		path:   "b/hardlink",
+		target: "a/1",
+	})
+	generateTestFiles(t, root, resources)
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	expected, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	m, err := BuildManifestWithOptions(gocontext.Background(), fsContext, BuildOptions{Concurrency: 4})
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("concurrent build differs from serial build:\n%v\n!=\n%v", m.Resources, expected.Resources)
+	}
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+
+	if _, err := BuildManifestWithOptions(ctx, fsContext, BuildOptions{Concurrency: 4}); !errors.Is(err, gocontext.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+}
+
+func TestBuildManifestCache(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			path: "b",
+			mode: 0o644,
+		},
+		{
+			kind:   rhardlink,
+			path:   "b-hardlink",
+			target: "b",
+		},
+	})
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	ctx := gocontext.Background()
+	m, err := BuildManifestWithOptions(ctx, fsContext, BuildOptions{CacheKeys: true})
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	// round trip the manifest to ensure the cache keys are preserved.
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatalf("error marshaling manifest: %v", err)
+	}
+	previous, err := Unmarshal(p)
+	if err != nil {
+		t.Fatalf("error unmarshaling manifest: %v", err)
+	}
+
+	if !reflect.DeepEqual(previous, m) {
+		t.Fatalf("unexpected manifest after round trip:\n%v\n!=\n%v", previous.Resources, m.Resources)
+	}
+
+	digests := func(m *Manifest) map[string]digest.Digest {
+		dgsts := map[string]digest.Digest{}
+		for _, rsrc := range m.Resources {
+			dgsts[rsrc.Path()] = rsrc.(RegularFile).Digests()[0]
+		}
+		return dgsts
+	}
+	before := digests(previous)
+
+	// Change the content of a without moving its modification time, so that
+	// only the change time reveals the modification.
+	fp := filepath.Join(root, "a")
+	fi, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) == 0 {
+		content = []byte{0}
+	}
+	content[0]++
+	if err := os.WriteFile(fp, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fp, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	changed := digest.FromBytes(content)
+
+	m, err = BuildManifestWithOptions(ctx, fsContext, BuildOptions{Previous: previous})
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	if after := digests(m); !reflect.DeepEqual(after, before) {
+		t.Fatalf("expected digests to be reused: %v != %v", after, before)
+	}
+
+	m, err = BuildManifestWithOptions(ctx, fsContext, BuildOptions{Previous: previous, StrictCache: true})
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	after := digests(m)
+	if after["/a"] != changed {
+		t.Fatalf("expected /a to be rehashed in strict mode: %v != %v", after["/a"], changed)
+	}
+	if after["/b"] != before["/b"] {
+		t.Fatalf("unexpected digest for /b: %v != %v", after["/b"], before["/b"])
+	}
+}
+
+func TestApplyManifestPrune(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind: rdirectory,
+			path: "b",
+			mode: 0o755,
+		},
+		{
+			path: "b/c",
+			mode: 0o644,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "b/l",
+			target: "c",
+		},
+	})
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	// replace a symlink with a directory and add extraneous paths.
+	if err := os.Remove(filepath.Join(root, "b/l")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"b/l/d", "e/f/g"} {
+		if err := os.MkdirAll(filepath.Join(root, p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"b/l/d/h", "e/f/i", "j"} {
+		if err := os.WriteFile(filepath.Join(root, p), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	xattrs := true
+	if err := sysx.Setxattr(filepath.Join(root, "a"), "user.stray", []byte("1"), 0); err != nil {
+		t.Logf("xattrs not supported, skipping stray xattr: %v", err)
+		xattrs = false
+	}
+
+	if err := ApplyManifest(fsContext, m); err == nil {
+		t.Fatal("expected apply without pruning to fail on a type mismatch")
+	}
+
+	if err := ApplyManifestWithOptions(fsContext, m, ApplyOptions{Prune: true}); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	report, err := VerifyManifestReport(fsContext, m)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected mismatches after pruning: %v", report.Err())
+	}
+
+	if xattrs {
+		if _, err := sysx.Getxattr(filepath.Join(root, "a"), "user.stray"); err == nil {
+			t.Fatal("expected stray xattr to be removed")
+		}
+	}
+}
+
 // TODO(stevvooe): At this time, we have a nice testing framework to define
 // and build resources. This will likely be a pre-cursor to the packages
 // public interface.
@@ -0,0 +1,284 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// NameDatabase maps the ids of users and groups to their names and back, as
+// listed in the etc/passwd and etc/group files of a tree. A nil
+// *NameDatabase has no entries.
+type NameDatabase struct {
+	users  nameIndex
+	groups nameIndex
+}
+
+// nameIndex maps ids to names and back. The first entry of an id or name
+// takes precedence, like it does for getpwuid and getpwnam.
+type nameIndex struct {
+	byID   map[int64]string
+	byName map[string]int64
+}
+
+func (idx *nameIndex) add(name string, id int64) {
+	if idx.byID == nil {
+		idx.byID = make(map[int64]string)
+		idx.byName = make(map[string]int64)
+	}
+
+	if _, ok := idx.byID[id]; !ok {
+		idx.byID[id] = name
+	}
+	if _, ok := idx.byName[name]; !ok {
+		idx.byName[name] = id
+	}
+}
+
+// ReadNameDatabase reads the users of passwd, in the format of /etc/passwd,
+// and the groups of group, in the format of /etc/group. Either may be nil.
+func ReadNameDatabase(passwd, group io.Reader) (*NameDatabase, error) {
+	var db NameDatabase
+	if passwd != nil {
+		users, err := parsePasswd(passwd)
+		if err != nil {
+			return nil, fmt.Errorf("error reading users: %w", err)
+		}
+		for _, u := range users {
+			db.users.add(u.name, int64(u.uid))
+		}
+	}
+
+	if group != nil {
+		groups, err := parseGroups(group)
+		if err != nil {
+			return nil, fmt.Errorf("error reading groups: %w", err)
+		}
+		for _, g := range groups {
+			db.groups.add(g.name, int64(g.gid))
+		}
+	}
+
+	return &db, nil
+}
+
+// UserName returns the name of the user with the id uid.
+func (db *NameDatabase) UserName(uid int64) (string, bool) {
+	if db == nil {
+		return "", false
+	}
+
+	name, ok := db.users.byID[uid]
+	return name, ok
+}
+
+// GroupName returns the name of the group with the id gid.
+func (db *NameDatabase) GroupName(gid int64) (string, bool) {
+	if db == nil {
+		return "", false
+	}
+
+	name, ok := db.groups.byID[gid]
+	return name, ok
+}
+
+// UserID returns the id of the user named name.
+func (db *NameDatabase) UserID(name string) (int64, bool) {
+	if db == nil {
+		return 0, false
+	}
+
+	id, ok := db.users.byName[name]
+	return id, ok
+}
+
+// GroupID returns the id of the group named name.
+func (db *NameDatabase) GroupID(name string) (int64, bool) {
+	if db == nil {
+		return 0, false
+	}
+
+	id, ok := db.groups.byName[name]
+	return id, ok
+}
+
+// readNameDatabase reads the etc/passwd and etc/group files of the root,
+// rather than those of the host. Symlinks are resolved within the root and
+// missing files have no entries.
+func (c *context) readNameDatabase() (*NameDatabase, error) {
+	var readers [2]io.Reader
+	for i, p := range []string{"/etc/passwd", "/etc/group"} {
+		fp, err := c.resolveInRoot(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		f, err := c.driver.Open(fp)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		defer f.Close()
+
+		readers[i] = f
+	}
+
+	return ReadNameDatabase(readers[0], readers[1])
+}
+
+// resolveInRoot returns the system path of p, a slash separated path in
+// the root, with symlinks resolved as if the root were the filesystem root.
+func (c *context) resolveInRoot(p string) (string, error) {
+	var resolved string
+	components := strings.Split(strings.TrimPrefix(path.Clean("/"+p), "/"), "/")
+	for links := 0; len(components) > 0; {
+		name := components[0]
+		components = components[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			resolved = path.Dir("/" + resolved)[1:]
+			continue
+		}
+
+		next := path.Join(resolved, name)
+		fp := c.pathDriver.Join(c.root, c.pathDriver.FromSlash(next))
+		fi, err := c.driver.Lstat(fp)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many links resolving %q", p)
+		}
+		target, err := c.driver.Readlink(fp)
+		if err != nil {
+			return "", err
+		}
+		target = c.pathDriver.ToSlash(target)
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		components = append(strings.Split(target, "/"), components...)
+	}
+
+	return c.pathDriver.Join(c.root, c.pathDriver.FromSlash(resolved)), nil
+}
+
+type user struct {
+	name string
+	uid  int
+}
+
+type group struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// parsePasswd parses an /etc/passwd file for user names and ids.
+func parsePasswd(rd io.Reader) ([]user, error) {
+	var users []user
+	err := scanEntries(rd, 7, func(parts []string) error {
+		uid, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return fmt.Errorf("bad uid: %q", parts[2])
+		}
+
+		users = append(users, user{
+			name: parts[0],
+			uid:  uid,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// parseGroups parses an /etc/group file for group names, ids and membership.
+// This is unix specific.
+func parseGroups(rd io.Reader) ([]group, error) {
+	var groups []group
+	err := scanEntries(rd, 4, func(parts []string) error {
+		name, _, sgid, smembers := parts[0], parts[1], parts[2], parts[3]
+
+		gid, err := strconv.Atoi(sgid)
+		if err != nil {
+			return fmt.Errorf("bad gid: %q", sgid)
+		}
+
+		var members []string
+		if smembers != "" {
+			members = strings.Split(smembers, ",")
+		}
+
+		groups = append(groups, group{
+			name:    name,
+			gid:     gid,
+			members: members,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// scanEntries calls fn with the n colon separated fields of each entry of an
+// /etc/passwd or /etc/group file. Comments, empty lines and the NIS
+// compatibility entries starting with + or - are skipped.
+func scanEntries(rd io.Reader, n int, fn func(parts []string) error) error {
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", n)
+		if len(parts) != n {
+			return fmt.Errorf("bad entry: %q", line)
+		}
+
+		if err := fn(parts); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
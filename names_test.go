@@ -0,0 +1,219 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/continuity/testutil"
+)
+
+func TestReadNameDatabase(t *testing.T) {
+	passwd := `# users
+root:x:0:0:root:/root:/bin/sh
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+
++@nis::::::
+app:x:1000:1000:app,,,:/home/app:/bin/sh
+toor:x:0:0:root:/root:/bin/sh
+`
+	group := `root:x:0:
+wheel:x:10:root,app
+app:x:1000:
+`
+
+	db, err := ReadNameDatabase(strings.NewReader(passwd), strings.NewReader(group))
+	if err != nil {
+		t.Fatalf("error reading names: %v", err)
+	}
+
+	// the first entry of an id takes precedence.
+	if name, ok := db.UserName(0); !ok || name != "root" {
+		t.Fatalf("unexpected name of uid 0: %q", name)
+	}
+	if id, ok := db.UserID("toor"); !ok || id != 0 {
+		t.Fatalf("unexpected id of toor: %d", id)
+	}
+	if id, ok := db.UserID("app"); !ok || id != 1000 {
+		t.Fatalf("unexpected id of app: %d", id)
+	}
+	if name, ok := db.GroupName(10); !ok || name != "wheel" {
+		t.Fatalf("unexpected name of gid 10: %q", name)
+	}
+	if _, ok := db.UserName(2); ok {
+		t.Fatal("expected uid 2 to have no name")
+	}
+
+	var empty *NameDatabase
+	if _, ok := empty.GroupID("wheel"); ok {
+		t.Fatal("expected no entries in a nil database")
+	}
+
+	if _, err := ReadNameDatabase(strings.NewReader("root:x:zero:0::/:/bin/sh\n"), nil); err == nil {
+		t.Fatal("expected a bad uid to fail")
+	}
+	if _, err := ReadNameDatabase(nil, strings.NewReader("root:x\n")); err == nil {
+		t.Fatal("expected a bad entry to fail")
+	}
+}
+
+func TestNamesManifest(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			kind: rdirectory,
+			path: "etc",
+			mode: 0o755,
+		},
+		{
+			kind: rdirectory,
+			path: "home",
+			mode: 0o755,
+		},
+		{
+			path: "home/a",
+			mode: 0o644,
+		},
+		{
+			path: "home/b",
+			mode: 0o644,
+		},
+	})
+	writeNames(t, root, map[string]int{"app": 1000}, map[string]int{"staff": 50})
+
+	// absolute symlinks are resolved within the root.
+	if err := os.Rename(filepath.Join(root, "etc", "passwd"), filepath.Join(root, "etc", "passwd.real")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd.real", filepath.Join(root, "etc", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Lchown(filepath.Join(root, "home", "a"), 1000, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Lchown(filepath.Join(root, "home", "b"), 2000, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	fsContext, err := NewContextWithOptions(root, ContextOptions{Names: true})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = Unmarshal(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the home directory is applied, the target has its own names.
+	var home []Resource
+	for _, rsrc := range m.Resources {
+		if strings.HasPrefix(rsrc.Path(), "/home") {
+			home = append(home, rsrc)
+		}
+	}
+	if n := home[1].(OwnerNamer); n.User() != "app" || n.Group() != "staff" {
+		t.Fatalf("unexpected names of %q: %q, %q", home[1].Path(), n.User(), n.Group())
+	}
+	if n := home[2].(OwnerNamer); n.User() != "" || n.Group() != "" {
+		t.Fatalf("unexpected names of %q: %q, %q", home[2].Path(), n.User(), n.Group())
+	}
+
+	target := t.TempDir()
+	if err := os.Mkdir(filepath.Join(target, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeNames(t, target, map[string]int{"app": 1500}, map[string]int{"staff": 20})
+
+	tc, err := NewContextWithOptions(target, ContextOptions{
+		Provider: testProviderFrom(t, root, "home/a", "home/b"),
+		Names:    true,
+	})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	layer := &Manifest{Resources: home}
+	if err := ApplyManifest(tc, layer); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	for p, owner := range map[string][2]uint32{"home/a": {1500, 20}, "home/b": {2000, 60}} {
+		fi, err := os.Lstat(filepath.Join(target, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := fi.Sys().(*syscall.Stat_t); st.Uid != owner[0] || st.Gid != owner[1] {
+			t.Fatalf("unexpected owner of %q: %d:%d", p, st.Uid, st.Gid)
+		}
+	}
+
+	for _, rsrc := range home {
+		if err := tc.Verify(rsrc); err != nil {
+			t.Fatalf("unexpected mismatches: %v", err)
+		}
+	}
+
+	// without names, the recorded ids are expected.
+	plain, err := NewContext(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Verify(home[1]); err == nil {
+		t.Fatal("expected the recorded ids to mismatch")
+	}
+}
+
+// writeNames writes the etc/passwd and etc/group files under root, listing
+// the given users and groups.
+func writeNames(t *testing.T, root string, users, groups map[string]int) {
+	t.Helper()
+
+	passwd := "root:x:0:0:root:/root:/bin/sh\n"
+	for name, id := range users {
+		passwd += name + ":x:" + strconv.Itoa(id) + ":" + strconv.Itoa(id) + "::/home/" + name + ":/bin/sh\n"
+	}
+	group := "root:x:0:\n"
+	for name, id := range groups {
+		group += name + ":x:" + strconv.Itoa(id) + ":\n"
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(passwd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "group"), []byte(group), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,433 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// OCILayoutProvider is a ContentProvider reading from a local OCI image
+// layout. Content is provided from the blobs of the layout and, once
+// IndexLayers has been called, from the files within its image layers.
+// Content is verified against its digest as it is read.
+//
+// Files of uncompressed layers are read in place. Compressed layers are read
+// sequentially, continuing from the previous file read from the layer when
+// possible, so reading their files in layer order decompresses each layer
+// once. Close releases the layers kept open.
+type OCILayoutProvider struct {
+	root string
+
+	// files maps the digests of files in image layers to their location.
+	files map[digest.Digest]layerEntry
+
+	mu sync.Mutex
+
+	// cursors holds an idle reader of each compressed layer, positioned
+	// after the last file read from it.
+	cursors map[digest.Digest]*layerCursor
+}
+
+var _ ContentProvider = &OCILayoutProvider{}
+
+// layerEntry locates a regular file within an image layer.
+type layerEntry struct {
+	layer digest.Digest
+	name  string
+
+	// ordinal is the index of the entry in the layer.
+	ordinal int
+
+	// offset is the offset of the content in an uncompressed layer, or -1
+	// if the layer must be read sequentially.
+	offset int64
+	size   int64
+}
+
+// layerCursor reads a layer sequentially.
+type layerCursor struct {
+	layer  digest.Digest
+	tr     *tar.Reader
+	closer io.Closer
+
+	// next is the ordinal of the next entry read.
+	next int
+}
+
+// ociDescriptor holds the fields of an OCI content descriptor used to find
+// image layers.
+type ociDescriptor struct {
+	MediaType string        `json:"mediaType,omitempty"`
+	Digest    digest.Digest `json:"digest"`
+}
+
+// ociManifest holds the fields of an OCI image index or image manifest used
+// to find image layers.
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests,omitempty"`
+	Layers    []ociDescriptor `json:"layers,omitempty"`
+}
+
+// NewOCILayoutProvider returns a ContentProvider for the OCI image layout at
+// root.
+func NewOCILayoutProvider(root string) (*OCILayoutProvider, error) {
+	if _, err := os.Stat(filepath.Join(root, "oci-layout")); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %w", root, err)
+	}
+
+	return &OCILayoutProvider{
+		root:    root,
+		files:   map[digest.Digest]layerEntry{},
+		cursors: map[digest.Digest]*layerCursor{},
+	}, nil
+}
+
+// blobPath returns the path of the blob for dgst in the layout.
+func (p *OCILayoutProvider) blobPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(p.root, "blobs", dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+// Reader returns a reader for the content of dgst, either from the blob
+// with that digest or from a file in an indexed image layer.
+func (p *OCILayoutProvider) Reader(dgst digest.Digest) (io.ReadCloser, error) {
+	bp, err := p.blobPath(dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(bp)
+	if err == nil {
+		return &verifiedReader{ReadCloser: f, dgst: dgst, verifier: dgst.Verifier()}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	entry, ok := p.files[dgst]
+	if !ok {
+		return nil, fmt.Errorf("content %v: %w", dgst, ErrNotFound)
+	}
+
+	r, err := p.openLayerEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifiedReader{ReadCloser: r, dgst: dgst, verifier: dgst.Verifier()}, nil
+}
+
+// IndexLayers reads every image layer referenced from the index of the
+// layout, recording the digest of each regular file so that its content can
+// be provided. Uncompressed, gzip and zstd compressed layers are supported,
+// others are skipped. Files are digested with the canonical algorithm.
+func (p *OCILayoutProvider) IndexLayers() error {
+	layers, err := p.layers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		if err := p.indexLayer(layer); err != nil {
+			return fmt.Errorf("error indexing layer %v: %w", layer, err)
+		}
+	}
+
+	return nil
+}
+
+// layers returns the digests of all image layers referenced from index.json,
+// following nested indexes.
+func (p *OCILayoutProvider) layers() ([]digest.Digest, error) {
+	b, err := os.ReadFile(filepath.Join(p.root, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		layers []digest.Digest
+		seen   = map[digest.Digest]struct{}{}
+		walk   func(b []byte) error
+	)
+	walk = func(b []byte) error {
+		var m ociManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return err
+		}
+
+		for _, layer := range m.Layers {
+			if _, ok := seen[layer.Digest]; ok {
+				continue
+			}
+			seen[layer.Digest] = struct{}{}
+			layers = append(layers, layer.Digest)
+		}
+
+		for _, desc := range m.Manifests {
+			if _, ok := seen[desc.Digest]; ok {
+				continue
+			}
+			seen[desc.Digest] = struct{}{}
+
+			bp, err := p.blobPath(desc.Digest)
+			if err != nil {
+				return err
+			}
+
+			b, err := os.ReadFile(bp)
+			if err != nil {
+				if os.IsNotExist(err) {
+					// layouts may omit manifests for other platforms.
+					continue
+				}
+				return err
+			}
+
+			if err := walk(b); err != nil {
+				return fmt.Errorf("error reading manifest %v: %w", desc.Digest, err)
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(b); err != nil {
+		return nil, err
+	}
+
+	return layers, nil
+}
+
+// Close releases the layers kept open to read their files.
+func (p *OCILayoutProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for layer, c := range p.cursors {
+		if err := c.closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(p.cursors, layer)
+	}
+
+	return errors.Join(errs...)
+}
+
+// indexLayer records the digests of the regular files in the layer.
+func (p *OCILayoutProvider) indexLayer(layer digest.Digest) error {
+	c, counter, err := p.openLayer(layer)
+	if err != nil {
+		if errors.Is(err, errUnsupportedCompression) {
+			return nil
+		}
+		return err
+	}
+	defer c.closer.Close()
+
+	for ; ; c.next++ {
+		hdr, err := c.tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg || strings.HasPrefix(path.Base(hdr.Name), whiteoutPrefix) {
+			continue
+		}
+
+		offset := int64(-1)
+		if counter != nil {
+			offset = counter.n
+		}
+
+		dgst, err := digest.Canonical.FromReader(c.tr)
+		if err != nil {
+			return err
+		}
+
+		// sparse files are not stored contiguously.
+		if counter != nil && counter.n-offset != hdr.Size {
+			offset = -1
+		}
+
+		if _, ok := p.files[dgst]; !ok {
+			p.files[dgst] = layerEntry{
+				layer:   layer,
+				name:    hdr.Name,
+				ordinal: c.next,
+				offset:  offset,
+				size:    hdr.Size,
+			}
+		}
+	}
+}
+
+// openLayerEntry returns a reader for a file within a layer.
+func (p *OCILayoutProvider) openLayerEntry(entry layerEntry) (io.ReadCloser, error) {
+	if entry.offset >= 0 {
+		bp, err := p.blobPath(entry.layer)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := os.Open(bp)
+		if err != nil {
+			return nil, err
+		}
+
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, entry.offset, entry.size), f}, nil
+	}
+
+	c := p.takeCursor(entry.layer, entry.ordinal)
+	if c == nil {
+		var err error
+		c, _, err = p.openLayer(entry.layer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for c.next <= entry.ordinal {
+		hdr, err := c.tr.Next()
+		if err != nil {
+			c.closer.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("%q not found in layer %v: %w", entry.name, entry.layer, ErrNotFound)
+			}
+			return nil, err
+		}
+		c.next++
+
+		if c.next > entry.ordinal && (hdr.Name != entry.name || hdr.Typeflag != tar.TypeReg) {
+			c.closer.Close()
+			return nil, fmt.Errorf("%q not found in layer %v: %w", entry.name, entry.layer, ErrNotFound)
+		}
+	}
+
+	return &cursorReader{Reader: c.tr, p: p, c: c}, nil
+}
+
+// takeCursor returns the idle reader of the layer if it is positioned at or
+// before the entry at ordinal, or nil.
+func (p *OCILayoutProvider) takeCursor(layer digest.Digest, ordinal int) *layerCursor {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.cursors[layer]
+	if !ok || c.next > ordinal {
+		return nil
+	}
+
+	delete(p.cursors, layer)
+	return c
+}
+
+// putCursor keeps c as the idle reader of its layer, replacing the one kept
+// before.
+func (p *OCILayoutProvider) putCursor(c *layerCursor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prev, ok := p.cursors[c.layer]; ok {
+		prev.closer.Close()
+	}
+	p.cursors[c.layer] = c
+}
+
+// cursorReader reads a file from a layer, keeping the layer open once
+// closed so that later files can be read from it.
+type cursorReader struct {
+	io.Reader
+	p *OCILayoutProvider
+	c *layerCursor
+}
+
+func (r *cursorReader) Close() error {
+	if r.c != nil {
+		r.p.putCursor(r.c)
+		r.c = nil
+	}
+	return nil
+}
+
+// openLayer returns a reader of the layer, decompressing it if necessary.
+// For uncompressed layers, the returned counter tracks the offset in the
+// layer.
+func (p *OCILayoutProvider) openLayer(layer digest.Digest) (*layerCursor, *countingReader, error) {
+	bp, err := p.blobPath(layer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(bp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, 512)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if isTarHeader(header[:n]) {
+		// read without buffering, so that offsets are those of the layer.
+		counter := &countingReader{r: f}
+		return &layerCursor{layer: layer, tr: tar.NewReader(counter), closer: f}, counter, nil
+	}
+
+	tr, err := newTarReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &layerCursor{layer: layer, tr: tr, closer: f}, nil, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,289 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// writeBlob writes p as a blob in the OCI layout at root.
+func writeBlob(t *testing.T, root string, p []byte) digest.Digest {
+	t.Helper()
+
+	dgst := digest.FromBytes(p)
+	dir := filepath.Join(root, "blobs", dgst.Algorithm().String())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, dgst.Encoded()), p, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dgst
+}
+
+// writeJSONBlob writes v as a JSON blob in the OCI layout at root.
+func writeJSONBlob(t *testing.T, root string, v interface{}) digest.Digest {
+	t.Helper()
+
+	p, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeBlob(t, root, p)
+}
+
+// tarLayer returns a tar archive of the files, compressed with gzip if
+// compress is set.
+func tarLayer(t *testing.T, files map[string]string, compress bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := &buf
+	var zw *gzip.Writer
+	tw := tar.NewWriter(w)
+	if compress {
+		zw = gzip.NewWriter(w)
+		tw = tar.NewWriter(zw)
+	}
+
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestOCILayoutProvider(t *testing.T) {
+	layout := t.TempDir()
+	if err := os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	layer1 := writeBlob(t, layout, tarLayer(t, map[string]string{
+		"etc/hosts":    "127.0.0.1 localhost\n",
+		"etc/.wh.gone": "",
+	}, true))
+	layer2 := writeBlob(t, layout, tarLayer(t, map[string]string{
+		"usr/bin/tool": "#!/bin/sh\n",
+	}, false))
+	config := writeJSONBlob(t, layout, map[string]string{})
+	manifest := writeJSONBlob(t, layout, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        ociDescriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: config},
+		"layers": []ociDescriptor{
+			{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layer1},
+			{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: layer2},
+		},
+	})
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []ociDescriptor{
+			{MediaType: "application/vnd.oci.image.manifest.v1+json", Digest: manifest},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layout, "index.json"), index, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewOCILayoutProvider(layout)
+	if err != nil {
+		t.Fatalf("error opening layout: %v", err)
+	}
+
+	src := t.TempDir()
+	for p, content := range map[string]string{
+		"etc/hosts":    "127.0.0.1 localhost\n",
+		"usr/bin/tool": "#!/bin/sh\n",
+	} {
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(p)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, p), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcContext, err := NewContext(src)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+	m, err := BuildManifest(srcContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	dst := t.TempDir()
+	dstContext, err := NewContextWithOptions(dst, ContextOptions{Provider: provider})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	if err := ApplyManifest(dstContext, m); err == nil {
+		t.Fatal("expected apply to fail before layers are indexed")
+	}
+
+	if err := provider.IndexLayers(); err != nil {
+		t.Fatalf("error indexing layers: %v", err)
+	}
+
+	if err := ApplyManifest(dstContext, m); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	if err := VerifyManifest(dstContext, m); err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+
+	// blobs are provided directly.
+	r, err := provider.Reader(config)
+	if err != nil {
+		t.Fatalf("error reading blob: %v", err)
+	}
+	r.Close()
+}
+
+func TestOCILayoutProviderLayerEntries(t *testing.T) {
+	type file struct {
+		name, content string
+	}
+	files := []file{
+		{"a", "old"},
+		{"b", "bbb"},
+		{"a", "new"},
+		{"c", "ccc"},
+	}
+
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		var zw *gzip.Writer
+		tw := tar.NewWriter(&buf)
+		if compress {
+			zw = gzip.NewWriter(&buf)
+			tw = tar.NewWriter(zw)
+		}
+		for _, f := range files {
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: 0o644, Size: int64(len(f.content))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(f.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if zw != nil {
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		layout := t.TempDir()
+		if err := os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		layer := writeBlob(t, layout, buf.Bytes())
+		manifest := writeJSONBlob(t, layout, map[string]interface{}{
+			"schemaVersion": 2,
+			"layers":        []ociDescriptor{{Digest: layer}},
+		})
+		index, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"manifests":     []ociDescriptor{{Digest: manifest}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(layout, "index.json"), index, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		provider, err := NewOCILayoutProvider(layout)
+		if err != nil {
+			t.Fatalf("error opening layout: %v", err)
+		}
+		if err := provider.IndexLayers(); err != nil {
+			t.Fatalf("error indexing layers: %v", err)
+		}
+
+		if entry := provider.files[digest.FromString("bbb")]; (entry.offset >= 0) == compress {
+			t.Fatalf("unexpected offset in layer (compressed: %v): %d", compress, entry.offset)
+		}
+
+		// later duplicates are read from their own entry, and earlier
+		// entries can be read again.
+		for _, content := range []string{"bbb", "new", "ccc", "old"} {
+			r, err := provider.Reader(digest.FromString(content))
+			if err != nil {
+				t.Fatalf("error reading %q: %v", content, err)
+			}
+			p, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("error reading %q: %v", content, err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if string(p) != content {
+				t.Fatalf("unexpected content: %q != %q", p, content)
+			}
+
+			if compress && content == "ccc" {
+				// the layer was read once, up to the last file.
+				if c := provider.cursors[layer]; c == nil || c.next != 4 {
+					t.Fatalf("expected the layer to be read sequentially: %+v", c)
+				}
+			}
+		}
+
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
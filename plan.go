@@ -0,0 +1,675 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/containerd/continuity/devices"
+)
+
+// OperationKind is the kind of filesystem operation performed when applying
+// a resource.
+type OperationKind int
+
+const (
+	// OperationCreateFile creates a regular file with content from the
+	// context's ContentProvider.
+	OperationCreateFile OperationKind = iota + 1
+
+	// OperationRewriteFile replaces the content of an existing regular file
+	// with content from the context's ContentProvider.
+	OperationRewriteFile
+
+	// OperationMkdir creates a directory.
+	OperationMkdir
+
+	// OperationSymlink creates a symlink.
+	OperationSymlink
+
+	// OperationReplaceSymlink replaces an existing entry with a symlink.
+	OperationReplaceSymlink
+
+	// OperationMknod creates a device.
+	OperationMknod
+
+	// OperationMkfifo creates a named pipe.
+	OperationMkfifo
+
+	// OperationMksock creates a socket.
+	OperationMksock
+
+	// OperationLink links a path to another path of a hardlinked resource.
+	OperationLink
+
+	// OperationRemove removes an existing entry, including its children.
+	OperationRemove
+
+	// OperationChmod changes the mode of an existing entry.
+	OperationChmod
+
+	// OperationChown changes the owner of an entry.
+	OperationChown
+
+	// OperationSetXAttr sets an extended attribute.
+	OperationSetXAttr
+
+	// OperationRemoveXAttr removes an extended attribute.
+	OperationRemoveXAttr
+
+	// OperationChtimes changes the access and modification times.
+	OperationChtimes
+
+	// OperationChattr changes the inode flags.
+	OperationChattr
+
+	// OperationPlaceholder creates the empty regular file standing in for a
+	// device, named pipe or socket in rootless mode.
+	OperationPlaceholder
+)
+
+var operationKindNames = map[OperationKind]string{
+	OperationCreateFile:     "create",
+	OperationRewriteFile:    "rewrite",
+	OperationMkdir:          "mkdir",
+	OperationSymlink:        "symlink",
+	OperationReplaceSymlink: "replace-symlink",
+	OperationMknod:          "mknod",
+	OperationMkfifo:         "mkfifo",
+	OperationMksock:         "mksock",
+	OperationLink:           "link",
+	OperationRemove:         "remove",
+	OperationChmod:          "chmod",
+	OperationChown:          "chown",
+	OperationSetXAttr:       "setxattr",
+	OperationRemoveXAttr:    "removexattr",
+	OperationChtimes:        "chtimes",
+	OperationChattr:         "chattr",
+	OperationPlaceholder:    "placeholder",
+}
+
+func (k OperationKind) String() string {
+	if name, ok := operationKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("OperationKind(%d)", int(k))
+}
+
+// Operation is a single filesystem operation planned for applying a
+// manifest.
+type Operation struct {
+	Kind OperationKind
+
+	// Path is the path operated on, relative to the context root.
+	Path string
+
+	// Detail describes the operation for display, such as the new mode, the
+	// name of an xattr or the path linked to.
+	Detail string
+}
+
+func (o Operation) String() string {
+	if o.Detail == "" {
+		return fmt.Sprintf("%v %s", o.Kind, o.Path)
+	}
+	return fmt.Sprintf("%v %s (%s)", o.Kind, o.Path, o.Detail)
+}
+
+// PlanManifest returns the operations ApplyManifestWithOptions would perform
+// to apply the manifest to the context, in order, without modifying the
+// context. Operations which would leave an entry unchanged, such as setting
+// a mode it already has, are not included. An error is returned if applying
+// the manifest would fail.
+func PlanManifest(fsContext Context, manifest *Manifest, opts ApplyOptions) ([]Operation, error) {
+	p, err := newManifestPlanner(fsContext, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := filterResources(opts.Filter, p.plan)
+	for _, rsrc := range manifest.Resources {
+		if err := plan(rsrc); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.finish()
+}
+
+// PlanManifestStream is like PlanManifest but reads the resources from r.
+func PlanManifestStream(fsContext Context, r *ManifestReader, opts ApplyOptions) ([]Operation, error) {
+	p, err := newManifestPlanner(fsContext, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := filterResources(opts.Filter, p.plan)
+	for {
+		rsrc, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		if err := plan(rsrc); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.finish()
+}
+
+// planContext is implemented by contexts which can plan the application of
+// resources. If fresh is true, the parent of the resource will have been
+// created or replaced by earlier operations and the existing entry, if any,
+// is ignored.
+type planContext interface {
+	plan(resource Resource, exact, fresh bool) ([]Operation, error)
+}
+
+// manifestPlanner tracks the state of the context as operations are planned.
+type manifestPlanner struct {
+	fsContext Context
+	planner   planContext
+	prune     bool
+	filter    *Filter
+
+	// paths holds the paths of all resources planned, when pruning.
+	paths map[string]struct{}
+
+	// fresh holds the directories created or replaced by the plan.
+	fresh map[string]struct{}
+
+	operations []Operation
+}
+
+func newManifestPlanner(fsContext Context, opts ApplyOptions) (*manifestPlanner, error) {
+	planner, ok := fsContext.(planContext)
+	if !ok {
+		return nil, fmt.Errorf("planning is not supported by the context: %w", ErrNotSupported)
+	}
+
+	return &manifestPlanner{
+		fsContext: fsContext,
+		planner:   planner,
+		prune:     opts.Prune,
+		filter:    opts.Filter,
+		paths:     map[string]struct{}{},
+		fresh:     map[string]struct{}{},
+	}, nil
+}
+
+func (p *manifestPlanner) plan(rsrc Resource) error {
+	if p.prune {
+		for _, rp := range resourcePaths(rsrc) {
+			p.paths[rp] = struct{}{}
+		}
+	}
+
+	// Paths removed by an earlier whiteout or opaque directory are fresh
+	// as well.
+	operations, err := p.planner.plan(rsrc, p.prune, p.isFresh(rsrc.Path()))
+	if err != nil {
+		return err
+	}
+
+	for _, op := range operations {
+		if op.Kind == OperationMkdir || op.Kind == OperationRemove {
+			p.fresh[op.Path] = struct{}{}
+		}
+	}
+
+	p.operations = append(p.operations, operations...)
+
+	return nil
+}
+
+// isFresh returns true if dir or one of its parents is created, replaced or
+// removed by the plan.
+func (p *manifestPlanner) isFresh(dir string) bool {
+	for {
+		if _, ok := p.fresh[dir]; ok {
+			return true
+		}
+
+		parent := path.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// finish plans the removal of extraneous paths, when pruning, and returns
+// the operations.
+func (p *manifestPlanner) finish() ([]Operation, error) {
+	if !p.prune {
+		return p.operations, nil
+	}
+
+	var extra []string
+	if err := walkFilteredFiles(gocontext.Background(), p.fsContext, p.filter, func(fp string, fi os.FileInfo) error {
+		if _, ok := p.paths[fp]; !ok && !p.isFresh(path.Dir(fp)) {
+			extra = append(extra, fp)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Entries always sort after their parent directory.
+	sort.Sort(sort.Reverse(sort.StringSlice(extra)))
+	for _, fp := range extra {
+		p.operations = append(p.operations, Operation{Kind: OperationRemove, Path: fp})
+	}
+
+	return p.operations, nil
+}
+
+// plan returns the operations apply would perform for the resource. The
+// metadata of created or replaced entries is planned as they are expected to
+// be created.
+func (c *context) plan(resource Resource, exact, fresh bool) ([]Operation, error) {
+	fp, err := c.fullpath(resource.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	var fi os.FileInfo
+	if !fresh {
+		fi, err = c.lstat(fp)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+
+	operations, current, err := c.planEntry(resource, fp, fi, exact)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := resource.(Whiteout); ok {
+		return operations, nil
+	}
+
+	metadata, err := c.planMetadata(resource, fp, current, exact)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(operations, metadata...), nil
+}
+
+// planEntry returns the operations creating, replacing or linking the entry
+// of the resource at fp, described by fi, or nil if there is no entry. The
+// returned os.FileInfo describes the entry kept, or is nil if the operations
+// create a new one.
+func (c *context) planEntry(resource Resource, fp string, fi os.FileInfo, exact bool) ([]Operation, os.FileInfo, error) {
+	var operations []Operation
+	op := func(kind OperationKind, p, detail string) {
+		operations = append(operations, Operation{Kind: kind, Path: p, Detail: detail})
+	}
+
+	_, whiteout := resource.(Whiteout)
+	if fi != nil && (whiteout || exact && fi.Mode().Type() != resource.Mode().Type()) {
+		if isTransactionDir(c.root, fp, fi) {
+			return nil, nil, fmt.Errorf("%q may hold the entries of an interrupted transaction and is not removed", resource.Path())
+		}
+
+		// replace the entry, rather than failing below.
+		op(OperationRemove, resource.Path(), "")
+		fi = nil
+	}
+
+	if whiteout {
+		return operations, nil, nil
+	}
+
+	// other paths of the resource are linked to the entry kept.
+	current := fi
+
+	switch r := resource.(type) {
+	case RegularFile:
+		if fi == nil {
+			op(OperationCreateFile, resource.Path(), "")
+		} else {
+			if !fi.Mode().IsRegular() {
+				return nil, nil, fmt.Errorf("file %q should be a regular file, but is not", resource.Path())
+			}
+
+			matches, err := c.contentMatches(fp, fi, r)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !matches {
+				// the content is written to a new file.
+				op(OperationRewriteFile, resource.Path(), "")
+				current = nil
+			}
+		}
+	case Directory:
+		if fi == nil {
+			op(OperationMkdir, resource.Path(), "")
+		} else if !fi.Mode().IsDir() {
+			return nil, nil, fmt.Errorf("%q should be a directory, but is not", resource.Path())
+		} else if _, ok := r.(OpaqueDirectory); ok {
+			names, err := c.readDirNames(fp)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, name := range names {
+				op(OperationRemove, path.Join(resource.Path(), name), "")
+			}
+		}
+	case SymLink:
+		var (
+			target string
+			err    error
+		)
+		if fi != nil && fi.Mode()&os.ModeSymlink != 0 {
+			target, err = c.driver.Readlink(fp)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if target != r.Target() {
+			if fi != nil {
+				op(OperationReplaceSymlink, resource.Path(), r.Target())
+				current = nil
+			} else {
+				op(OperationSymlink, resource.Path(), r.Target())
+			}
+		}
+	case Device:
+		numbers := fmt.Sprintf("%d,%d", r.Major(), r.Minor())
+		if fi == nil {
+			c.planSpecial(op, resource, OperationMknod, numbers)
+		} else if fi.Mode()&os.ModeDevice == 0 {
+			return nil, nil, fmt.Errorf("%q should be a device, but is not", resource.Path())
+		} else {
+			major, minor, err := devices.DeviceInfo(fi)
+			if err != nil {
+				return nil, nil, err
+			}
+			if major != r.Major() || minor != r.Minor() {
+				op(OperationRemove, resource.Path(), "")
+				c.planSpecial(op, resource, OperationMknod, numbers)
+				current = nil
+			}
+		}
+	case NamedPipe:
+		if fi == nil {
+			c.planSpecial(op, resource, OperationMkfifo, "")
+		} else if fi.Mode()&os.ModeNamedPipe == 0 {
+			return nil, nil, fmt.Errorf("%q should be a named pipe, but is not", resource.Path())
+		}
+	case Socket:
+		if fi == nil {
+			c.planSpecial(op, resource, OperationMksock, "")
+		} else if fi.Mode()&os.ModeSocket == 0 {
+			return nil, nil, fmt.Errorf("%q should be a socket, but is not", resource.Path())
+		}
+	}
+
+	if h, isHardlinkable := resource.(Hardlinkable); isHardlinkable {
+		var linked os.FileInfo
+		if current != nil {
+			// compare the entries as the driver reads them, rather than
+			// with the metadata recorded in rootless mode.
+			var err error
+			linked, err = c.driver.Lstat(fp)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		for _, p := range h.Paths() {
+			if p == resource.Path() {
+				continue
+			}
+
+			lfi, err := c.lstatPath(p)
+			if err != nil {
+				return nil, nil, err
+			}
+			if linked != nil && lfi != nil && os.SameFile(linked, lfi) {
+				continue
+			}
+
+			if exact && lfi != nil && lfi.IsDir() {
+				// replace the directory, rather than failing to link.
+				op(OperationRemove, p, "")
+			}
+			op(OperationLink, p, resource.Path())
+		}
+	}
+
+	return operations, current, nil
+}
+
+// planSpecial plans the creation of a device, named pipe or socket with
+// kind, or of the regular file standing in for it in rootless mode.
+func (c *context) planSpecial(op func(kind OperationKind, p, detail string), resource Resource, kind OperationKind, detail string) {
+	if c.rootless {
+		kind = OperationPlaceholder
+	}
+
+	op(kind, resource.Path(), detail)
+}
+
+// planMetadata returns the operations applying the owner, mode, xattrs,
+// times and inode flags of the resource to the entry at fp, described by fi.
+// A nil fi stands for an entry created by earlier operations, owned by the
+// current user, with the mode of the resource and no xattrs, times or flags
+// of its own. In rootless mode, the owner and mode are recorded in
+// xattrOverrideStat instead, which symlinks cannot carry.
+func (c *context) planMetadata(resource Resource, fp string, fi os.FileInfo, exact bool) ([]Operation, error) {
+	var operations []Operation
+	op := func(kind OperationKind, detail string) {
+		operations = append(operations, Operation{Kind: kind, Path: resource.Path(), Detail: detail})
+	}
+
+	_, symlink := resource.(SymLink)
+	uid, gid, err := c.ids.ownerToHost(c.owner(resource))
+	if err != nil {
+		return nil, fmt.Errorf("error mapping owner of %q: %w", resource.Path(), err)
+	}
+
+	switch {
+	case c.rootless:
+		if symlink {
+			break
+		}
+
+		var recorded []byte
+		if fi != nil {
+			raw, err := c.driver.Lstat(fp)
+			if err != nil {
+				return nil, err
+			}
+			if mode := rootlessMode(resource.Mode()); raw.Mode()&^os.ModeType != mode {
+				op(OperationChmod, fmt.Sprintf("%v -> %v", raw.Mode(), raw.Mode().Type()|mode))
+			}
+
+			recorded, err = c.recordedOverrideStat(fp)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !bytes.Equal(recorded, overrideStatOf(resource, uid, gid).encode()) {
+			op(OperationSetXAttr, xattrOverrideStat)
+		}
+	case fi == nil:
+		if int64(os.Getuid()) != uid || int64(os.Getgid()) != gid {
+			op(OperationChown, fmt.Sprintf("%d:%d", uid, gid))
+		}
+	default:
+		base, err := newBaseResource(resource.Path(), fi)
+		if err != nil {
+			return nil, err
+		}
+
+		if base.UID() != uid || base.GID() != gid {
+			op(OperationChown, fmt.Sprintf("%d:%d -> %d:%d", base.UID(), base.GID(), uid, gid))
+		}
+
+		// symlinks do not have a mode of their own on all platforms.
+		if !symlink && base.Mode() != resource.Mode() {
+			op(OperationChmod, fmt.Sprintf("%v -> %v", base.Mode(), resource.Mode()))
+		}
+	}
+
+	var current map[string][]byte
+	if fi != nil {
+		current, err = c.resolveXAttrs(fp, fi, nil)
+		if err != nil && !errors.Is(err, ErrNotSupported) {
+			return nil, err
+		}
+	}
+
+	var xattrs map[string][]byte
+	if xattrer, ok := resource.(XAttrer); ok {
+		xattrs = xattrer.XAttrs()
+	}
+
+	for _, attr := range sortedXAttrNames(xattrs) {
+		if value, ok := current[attr]; !ok || !bytes.Equal(value, xattrs[attr]) {
+			op(OperationSetXAttr, attr)
+		}
+	}
+
+	if exact {
+		for _, attr := range sortedXAttrNames(current) {
+			if _, ok := xattrs[attr]; !ok {
+				op(OperationRemoveXAttr, attr)
+			}
+		}
+	}
+
+	// Times are restored after the operations above, which may update them.
+	if t, ok := resource.(Timestamper); ok {
+		changed := !t.ModTime().IsZero() || !t.AccessTime().IsZero()
+		if fi != nil {
+			changed = !t.ModTime().IsZero() && !t.ModTime().Equal(fi.ModTime())
+			if !t.AccessTime().IsZero() {
+				atime, _, err := statTimes(fi)
+				if err != nil {
+					return nil, err
+				}
+				changed = changed || !t.AccessTime().Equal(atime)
+			}
+		}
+
+		if changed {
+			op(OperationChtimes, "")
+		}
+	}
+
+	// Inode flags come after the times, since an immutable file cannot be
+	// changed at all.
+	switch resource.(type) {
+	case RegularFile, Directory:
+		var flags InodeFlags
+		if fi != nil {
+			flags, err = c.resolveInodeFlags(fp, fi)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if desired := inodeFlagsOf(resource); desired != flags {
+			if fi == nil {
+				op(OperationChattr, desired.String())
+			} else {
+				op(OperationChattr, fmt.Sprintf("%v -> %v", flags, desired))
+			}
+		}
+	}
+
+	return operations, nil
+}
+
+// contentMatches returns true if the regular file at fp, described by fi,
+// has the size and digests of the resource.
+func (c *context) contentMatches(fp string, fi os.FileInfo, r RegularFile) (bool, error) {
+	if fi.Size() != r.Size() {
+		return false, nil
+	}
+
+	for _, dgst := range r.Digests() {
+		f, err := c.driver.Open(fp)
+		if err != nil {
+			return false, fmt.Errorf("failure opening file for read %q: %w", r.Path(), err)
+		}
+
+		compared, err := dgst.Algorithm().FromReader(f)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return false, fmt.Errorf("error checking digest for %q: %w", r.Path(), err)
+		}
+
+		if dgst != compared {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// lstatPath returns the os.FileInfo of the entry at the path p, or nil if
+// there is none.
+func (c *context) lstatPath(p string) (os.FileInfo, error) {
+	fp, err := c.fullpath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := c.driver.Lstat(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+// sortedXAttrNames returns the names of xattrs in order.
+func sortedXAttrNames(xattrs map[string][]byte) []string {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
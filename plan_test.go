@@ -0,0 +1,189 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/continuity/sysx"
+)
+
+func TestPlanManifest(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind: rdirectory,
+			path: "b",
+			mode: 0o755,
+		},
+		{
+			path: "b/c",
+			mode: 0o644,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "b/l",
+			target: "c",
+		},
+		{
+			kind: rdirectory,
+			path: "d",
+			mode: 0o755,
+		},
+		{
+			path: "d/e",
+			mode: 0o644,
+		},
+	})
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	operations, err := PlanManifest(fsContext, m, ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("error planning manifest: %v", err)
+	}
+	if len(operations) != 0 {
+		t.Fatalf("expected no operations for an unchanged root: %v", operations)
+	}
+
+	if err := os.Chmod(filepath.Join(root, "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "b/l")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("x", filepath.Join(root, "b/l")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "f"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs := true
+	if err := sysx.Setxattr(filepath.Join(root, "a"), "user.stray", []byte("1"), 0); err != nil {
+		t.Logf("xattrs not supported, skipping stray xattr: %v", err)
+		xattrs = false
+	}
+
+	operations, err = PlanManifest(fsContext, m, ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("error planning manifest: %v", err)
+	}
+
+	expected := []Operation{
+		{Kind: OperationChmod, Path: "/a", Detail: "-rw------- -> -rw-r--r--"},
+	}
+	if xattrs {
+		expected = append(expected, Operation{Kind: OperationRemoveXAttr, Path: "/a", Detail: "user.stray"})
+	}
+	expected = append(expected,
+		Operation{Kind: OperationReplaceSymlink, Path: "/b/l", Detail: "c"},
+		Operation{Kind: OperationMkdir, Path: "/d"},
+		Operation{Kind: OperationCreateFile, Path: "/d/e"},
+		Operation{Kind: OperationRemove, Path: "/f"},
+	)
+
+	if !reflect.DeepEqual(operations, expected) {
+		t.Fatalf("unexpected operations:\n%v\n!=\n%v", operations, expected)
+	}
+
+	// without pruning, stray xattrs and extraneous files are left alone.
+	operations, err = PlanManifest(fsContext, m, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("error planning manifest: %v", err)
+	}
+
+	for _, op := range operations {
+		if op.Kind == OperationRemove || op.Kind == OperationRemoveXAttr {
+			t.Fatalf("unexpected operation without pruning: %v", op)
+		}
+	}
+}
+
+func TestPlanManifestHardlinks(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind:   rhardlink,
+			path:   "a-hardlink",
+			target: "a",
+		},
+	})
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	// the links still share an inode, which apply replaces.
+	fi, err := os.Stat(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a"), make([]byte, fi.Size()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	operations, err := PlanManifest(fsContext, m, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("error planning manifest: %v", err)
+	}
+
+	var planned []Operation
+	for _, op := range operations {
+		if op.Kind == OperationRewriteFile || op.Kind == OperationLink {
+			planned = append(planned, op)
+		}
+	}
+
+	expected := []Operation{
+		{Kind: OperationRewriteFile, Path: "/a"},
+		{Kind: OperationLink, Path: "/a-hardlink", Detail: "/a"},
+	}
+	if !reflect.DeepEqual(planned, expected) {
+		t.Fatalf("unexpected operations:\n%v\n!=\n%v", planned, expected)
+	}
+}
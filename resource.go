@@ -22,6 +22,7 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"time"
 
 	pb "github.com/containerd/continuity/proto"
 	"github.com/opencontainers/go-digest"
@@ -58,6 +59,23 @@ type XAttrer interface {
 	XAttrs() map[string][]byte
 }
 
+// Timestamper is an interface that a resource type satisfies if it can carry
+// file times. A zero time.Time is returned for times that were not recorded.
+type Timestamper interface {
+	ModTime() time.Time
+	AccessTime() time.Time
+	ChangeTime() time.Time
+}
+
+// OwnerNamer is an interface that a resource type satisfies if it can carry
+// the names of its owning user and group, as resolved against the tree it
+// was recorded from. An empty string is returned for names that were not
+// recorded.
+type OwnerNamer interface {
+	User() string
+	Group() string
+}
+
 // Hardlinkable is an interface that a resource type satisfies if it can be a
 // hardlink target.
 type Hardlinkable interface {
@@ -169,6 +187,11 @@ func Merge(fs ...Resource) (Resource, error) {
 			if !prototypeIsNamedPipe {
 				return nil, errors.New("prototype is not a named pipe")
 			}
+		} else if _, isSocket := f.(Socket); isSocket {
+			_, prototypeIsSocket := prototype.(Socket)
+			if !prototypeIsSocket {
+				return nil, errors.New("prototype is not a socket")
+			}
 		} else {
 			return nil, errNotAHardLink
 		}
@@ -189,6 +212,18 @@ func Merge(fs ...Resource) (Resource, error) {
 		xattrs: xattrs,
 	}
 
+	// Hardlinks share an inode, so the times are not compared above. Reading
+	// the content of one of the paths may have moved the access time.
+	if t, ok := first.(Timestamper); ok {
+		resource.mtime, resource.atime, resource.ctime = t.ModTime(), t.AccessTime(), t.ChangeTime()
+	}
+	if la, ok := first.(LinuxAttributer); ok {
+		resource.flags = la.InodeFlags()
+	}
+	if n, ok := first.(OwnerNamer); ok {
+		resource.user, resource.group = n.User(), n.Group()
+	}
+
 	switch typedF := first.(type) {
 	case RegularFile:
 		var err error
@@ -197,11 +232,18 @@ func Merge(fs ...Resource) (Resource, error) {
 			return nil, err
 		}
 
-		return &regularFile{
+		rf := &regularFile{
 			resource: resource,
 			size:     typedF.Size(),
 			digests:  digests,
-		}, nil
+		}
+
+		// Every path shares the inode, so any cache key describes them all.
+		if first, ok := first.(*regularFile); ok {
+			rf.key = first.key
+		}
+
+		return rf, nil
 	case Device:
 		return &device{
 			resource: resource,
@@ -214,11 +256,68 @@ func Merge(fs ...Resource) (Resource, error) {
 			resource: resource,
 		}, nil
 
+	case Socket:
+		return &socket{
+			resource: resource,
+		}, nil
+
 	default:
 		return nil, errNotAHardLink
 	}
 }
 
+// withPaths returns a copy of the resource with the given paths. Only
+// hardlinkable resources may have more than one path.
+func withPaths(rsrc Resource, paths []string) (Resource, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no paths for %q", rsrc.Path())
+	}
+
+	switch r := rsrc.(type) {
+	case *regularFile:
+		c := *r
+		c.paths = paths
+		return &c, nil
+	case *device:
+		c := *r
+		c.paths = paths
+		return &c, nil
+	case *namedPipe:
+		c := *r
+		c.paths = paths
+		return &c, nil
+	case *socket:
+		c := *r
+		c.paths = paths
+		return &c, nil
+	}
+
+	if len(paths) > 1 {
+		return nil, fmt.Errorf("resource %q cannot have multiple paths: %w", rsrc.Path(), errNotAHardLink)
+	}
+
+	switch r := rsrc.(type) {
+	case *directory:
+		c := *r
+		c.paths = paths
+		return &c, nil
+	case *opaqueDirectory:
+		c := *r
+		c.paths = paths
+		return &c, nil
+	case *symLink:
+		c := *r
+		c.paths = paths
+		return &c, nil
+	case *whiteout:
+		c := *r
+		c.paths = paths
+		return &c, nil
+	default:
+		return nil, fmt.Errorf("cannot change the paths of %q: %w", rsrc.Path(), ErrNotSupported)
+	}
+}
+
 type Directory interface {
 	Resource
 	XAttrer
@@ -227,6 +326,25 @@ type Directory interface {
 	Directory()
 }
 
+// OpaqueDirectory is a directory hiding the entries of the directory at the
+// same path in the layers below the manifest, as marked by an opaque whiteout.
+type OpaqueDirectory interface {
+	Directory
+
+	// Opaque is a no-op method to identify opaque directories by interface.
+	Opaque()
+}
+
+// Whiteout marks the removal of a path, and everything beneath it, from the
+// layers below the manifest. A whiteout has no attributes other than its
+// path.
+type Whiteout interface {
+	Resource
+
+	// Whiteout is a no-op method to identify whiteouts by interface.
+	Whiteout()
+}
+
 type SymLink interface {
 	Resource
 
@@ -244,6 +362,17 @@ type NamedPipe interface {
 	Pipe()
 }
 
+// Socket is a unix domain socket node. Only the node is recorded, applying
+// it creates a socket which no process listens on.
+type Socket interface {
+	Resource
+	Hardlinkable
+	XAttrer
+
+	// Socket is a no-op method to identify sockets by interface.
+	Socket()
+}
+
 type Device interface {
 	Resource
 	Hardlinkable
@@ -258,6 +387,14 @@ type resource struct {
 	mode     os.FileMode
 	uid, gid int64
 	xattrs   map[string][]byte
+
+	mtime, atime, ctime time.Time
+
+	// flags holds the inode flags, which are not kept with the xattrs.
+	flags InodeFlags
+
+	// user and group hold the names of the owners, if recorded.
+	user, group string
 }
 
 var _ Resource = &resource{}
@@ -282,10 +419,33 @@ func (r *resource) GID() int64 {
 	return r.gid
 }
 
+func (r *resource) User() string {
+	return r.user
+}
+
+func (r *resource) Group() string {
+	return r.group
+}
+
+func (r *resource) ModTime() time.Time {
+	return r.mtime
+}
+
+func (r *resource) AccessTime() time.Time {
+	return r.atime
+}
+
+func (r *resource) ChangeTime() time.Time {
+	return r.ctime
+}
+
 type regularFile struct {
 	resource
 	size    int64
 	digests []digest.Digest
+
+	// key is the cache key recorded when the file was digested, if any.
+	key *cacheKey
 }
 
 var _ RegularFile = &regularFile{}
@@ -365,6 +525,38 @@ func (d *directory) XAttrs() map[string][]byte {
 	return xattrs
 }
 
+type opaqueDirectory struct {
+	directory
+}
+
+var _ OpaqueDirectory = &opaqueDirectory{}
+
+func newOpaqueDirectory(base resource) (OpaqueDirectory, error) {
+	if !base.Mode().IsDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+
+	return &opaqueDirectory{
+		directory: directory{resource: base},
+	}, nil
+}
+
+func (d *opaqueDirectory) Opaque() {}
+
+type whiteout struct {
+	resource
+}
+
+var _ Whiteout = &whiteout{}
+
+func newWhiteout(p string) Whiteout {
+	return &whiteout{
+		resource: resource{paths: []string{p}},
+	}
+}
+
+func (w *whiteout) Whiteout() {}
+
 type symLink struct {
 	resource
 	target string
@@ -424,6 +616,43 @@ func (np *namedPipe) XAttrs() map[string][]byte {
 	return xattrs
 }
 
+type socket struct {
+	resource
+}
+
+var _ Socket = &socket{}
+
+func newSocket(base resource, paths []string) (Socket, error) {
+	if base.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("not a socket")
+	}
+
+	base.paths = make([]string, len(paths))
+	copy(base.paths, paths)
+
+	return &socket{
+		resource: base,
+	}, nil
+}
+
+func (s *socket) Socket() {}
+
+func (s *socket) Paths() []string {
+	paths := make([]string, len(s.paths))
+	copy(paths, s.paths)
+	return paths
+}
+
+func (s *socket) XAttrs() map[string][]byte {
+	xattrs := make(map[string][]byte, len(s.xattrs))
+
+	for attr, value := range s.xattrs {
+		xattrs[attr] = append(xattrs[attr], value...)
+	}
+
+	return xattrs
+}
+
 type device struct {
 	resource
 	major, minor uint64
@@ -481,6 +710,10 @@ func toProto(resource Resource) *pb.Resource {
 		Gid:  resource.GID(),
 	}
 
+	if n, ok := resource.(OwnerNamer); ok {
+		b.User, b.Group = n.User(), n.Group()
+	}
+
 	if xattrer, ok := resource.(XAttrer); ok {
 		// Sorts the XAttrs by name for consistent ordering.
 		keys := []string{}
@@ -491,10 +724,21 @@ func toProto(resource Resource) *pb.Resource {
 		sort.Strings(keys)
 
 		for _, k := range keys {
+			toProtoXAttr(b, k, xattrs[k])
 			b.Xattr = append(b.Xattr, &pb.XAttr{Name: k, Data: xattrs[k]})
 		}
 	}
 
+	if la, ok := resource.(LinuxAttributer); ok {
+		b.Flags = uint32(la.InodeFlags())
+	}
+
+	if t, ok := resource.(Timestamper); ok {
+		b.Mtime = toProtoTimestamp(t.ModTime())
+		b.Atime = toProtoTimestamp(t.AccessTime())
+		b.Ctime = toProtoTimestamp(t.ChangeTime())
+	}
+
 	switch r := resource.(type) {
 	case RegularFile:
 		b.Path = r.Paths()
@@ -503,6 +747,14 @@ func toProto(resource Resource) *pb.Resource {
 		for _, dgst := range r.Digests() {
 			b.Digest = append(b.Digest, dgst.String())
 		}
+
+		if rf, ok := r.(*regularFile); ok && rf.key != nil {
+			b.CacheKey = &pb.CacheKey{
+				Inode: rf.key.inode,
+				Mtime: toProtoTimestamp(rf.key.mtime),
+				Ctime: toProtoTimestamp(rf.key.ctime),
+			}
+		}
 	case SymLink:
 		b.Target = r.Target()
 	case Device:
@@ -510,6 +762,12 @@ func toProto(resource Resource) *pb.Resource {
 		b.Path = r.Paths()
 	case NamedPipe:
 		b.Path = r.Paths()
+	case Socket:
+		b.Path = r.Paths()
+	case OpaqueDirectory:
+		b.Opaque = true
+	case Whiteout:
+		b.Whiteout = true
 	}
 
 	// enforce a few stability guarantees that may not be provided by the
@@ -526,6 +784,12 @@ func fromProto(b *pb.Resource) (Resource, error) {
 		mode:  os.FileMode(b.Mode),
 		uid:   b.Uid,
 		gid:   b.Gid,
+		user:  b.User,
+		group: b.Group,
+
+		mtime: fromProtoTimestamp(b.Mtime),
+		atime: fromProtoTimestamp(b.Atime),
+		ctime: fromProtoTimestamp(b.Ctime),
 	}
 
 	base.xattrs = make(map[string][]byte, len(b.Xattr))
@@ -534,6 +798,21 @@ func fromProto(b *pb.Resource) (Resource, error) {
 		base.xattrs[attr.Name] = attr.Data
 	}
 
+	if err := fromProtoLinuxAttrs(b, base); err != nil {
+		return nil, err
+	}
+
+	if b.Whiteout {
+		if len(b.Path) != 1 {
+			return nil, fmt.Errorf("whiteout must have a single path: %v", b.Path)
+		}
+		return newWhiteout(b.Path[0]), nil
+	}
+
+	if b.Opaque {
+		return newOpaqueDirectory(*base)
+	}
+
 	switch {
 	case base.Mode().IsRegular():
 		dgsts := make([]digest.Digest, len(b.Digest))
@@ -542,13 +821,28 @@ func fromProto(b *pb.Resource) (Resource, error) {
 			dgsts[i] = digest.Digest(dgst)
 		}
 
-		return newRegularFile(*base, b.Path, int64(b.Size), dgsts...)
+		rf, err := newRegularFile(*base, b.Path, int64(b.Size), dgsts...)
+		if err != nil {
+			return nil, err
+		}
+
+		if b.CacheKey != nil {
+			rf.(*regularFile).key = &cacheKey{
+				inode: b.CacheKey.Inode,
+				mtime: fromProtoTimestamp(b.CacheKey.Mtime),
+				ctime: fromProtoTimestamp(b.CacheKey.Ctime),
+			}
+		}
+
+		return rf, nil
 	case base.Mode().IsDir():
 		return newDirectory(*base)
 	case base.Mode()&os.ModeSymlink != 0:
 		return newSymLink(*base, b.Target)
 	case base.Mode()&os.ModeNamedPipe != 0:
 		return newNamedPipe(*base, b.Path)
+	case base.Mode()&os.ModeSocket != 0:
+		return newSocket(*base, b.Path)
 	case base.Mode()&os.ModeDevice != 0:
 		return newDevice(*base, b.Path, b.Major, b.Minor)
 	}
@@ -556,6 +850,29 @@ func fromProto(b *pb.Resource) (Resource, error) {
 	return nil, fmt.Errorf("unknown resource record (%#v): %s", b, base.Mode())
 }
 
+// toProtoTimestamp converts t to a protobuf timestamp. The zero time, which
+// marks an unrecorded time, is converted to nil.
+func toProtoTimestamp(t time.Time) *pb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &pb.Timestamp{
+		Seconds: t.Unix(),
+		Nanos:   int32(t.Nanosecond()),
+	}
+}
+
+// fromProtoTimestamp converts a protobuf timestamp to a time.Time, returning
+// the zero time if ts is nil.
+func fromProtoTimestamp(ts *pb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+
+	return time.Unix(ts.Seconds, int64(ts.Nanos))
+}
+
 // NOTE(stevvooe): An alternative model that supports inline declaration.
 // Convenient for unit testing where inline declarations may be desirable but
 // creates an awkward API for the standard use case.
@@ -0,0 +1,251 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	driverpkg "github.com/containerd/continuity/driver"
+)
+
+// xattrOverrideStat records the owner, mode and type of files in rootless
+// mode, in the format used by fuse-overlayfs and containers/storage:
+// "uid:gid:mode[:type]", with the mode in octal and the type one of file,
+// dir, symlink, pipe, socket, block-<major>-<minor> or char-<major>-<minor>.
+const xattrOverrideStat = "user.containers.override_stat"
+
+// overrideStat holds the metadata recorded in xattrOverrideStat.
+type overrideStat struct {
+	uid, gid int64
+
+	// mode holds the permissions and, if the type was recorded, the type
+	// of the file.
+	mode         os.FileMode
+	major, minor uint64
+}
+
+// decodeOverrideStat parses the value of xattrOverrideStat.
+func decodeOverrideStat(value []byte) (overrideStat, error) {
+	fields := strings.Split(string(value), ":")
+	if len(fields) < 3 {
+		return overrideStat{}, fmt.Errorf("invalid override stat %q", value)
+	}
+
+	var s overrideStat
+	uid, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return overrideStat{}, fmt.Errorf("invalid uid in override stat %q: %w", value, err)
+	}
+	gid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return overrideStat{}, fmt.Errorf("invalid gid in override stat %q: %w", value, err)
+	}
+	mode, err := strconv.ParseUint(fields[2], 8, 32)
+	if err != nil {
+		return overrideStat{}, fmt.Errorf("invalid mode in override stat %q: %w", value, err)
+	}
+	s.uid, s.gid = int64(uid), int64(gid)
+
+	s.mode = os.FileMode(mode) & os.ModePerm
+	if mode&0o4000 != 0 {
+		s.mode |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		s.mode |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		s.mode |= os.ModeSticky
+	}
+
+	if len(fields) == 3 {
+		return s, nil
+	}
+
+	// further fields are ignored, to be forward compatible.
+	typ := strings.Split(fields[3], "-")
+	switch typ[0] {
+	case "file":
+	case "dir":
+		s.mode |= os.ModeDir
+	case "symlink":
+		s.mode |= os.ModeSymlink
+	case "pipe":
+		s.mode |= os.ModeNamedPipe
+	case "socket":
+		s.mode |= os.ModeSocket
+	case "block", "char":
+		if len(typ) < 3 {
+			return overrideStat{}, fmt.Errorf("invalid device in override stat %q", value)
+		}
+		if s.major, err = strconv.ParseUint(typ[1], 10, 32); err != nil {
+			return overrideStat{}, fmt.Errorf("invalid device in override stat %q: %w", value, err)
+		}
+		if s.minor, err = strconv.ParseUint(typ[2], 10, 32); err != nil {
+			return overrideStat{}, fmt.Errorf("invalid device in override stat %q: %w", value, err)
+		}
+
+		s.mode |= os.ModeDevice
+		if typ[0] == "char" {
+			s.mode |= os.ModeCharDevice
+		}
+	default:
+		return overrideStat{}, fmt.Errorf("invalid type in override stat %q", value)
+	}
+
+	return s, nil
+}
+
+// encode returns the value of xattrOverrideStat for s.
+func (s overrideStat) encode() []byte {
+	var typ string
+	switch s.mode.Type() {
+	case os.ModeDir:
+		typ = "dir"
+	case os.ModeSymlink:
+		typ = "symlink"
+	case os.ModeNamedPipe:
+		typ = "pipe"
+	case os.ModeSocket:
+		typ = "socket"
+	case os.ModeDevice:
+		typ = fmt.Sprintf("block-%d-%d", s.major, s.minor)
+	case os.ModeDevice | os.ModeCharDevice:
+		typ = fmt.Sprintf("char-%d-%d", s.major, s.minor)
+	default:
+		typ = "file"
+	}
+
+	return []byte(fmt.Sprintf("%d:%d:0%o:%s", s.uid, s.gid, tarMode(s.mode), typ))
+}
+
+// rootlessMode returns the mode of the files under the root in rootless
+// mode, for entries recorded with mode. The owner keeps access to the file
+// and its xattrs, and no setuid or setgid bits are set.
+func rootlessMode(mode os.FileMode) os.FileMode {
+	if mode.IsDir() {
+		return mode.Perm() | 0o700
+	}
+
+	return mode.Perm() | 0o600
+}
+
+// lstat returns the os.FileInfo of the entry at fp, like Lstat, with the
+// owner, mode and type recorded in rootless mode.
+func (c *context) lstat(fp string) (os.FileInfo, error) {
+	fi, err := c.driver.Lstat(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.overrideFileInfo(fp, fi)
+}
+
+// overrideFileInfo returns fi, the os.FileInfo of the entry at fp, with the
+// owner, mode and type recorded in xattrOverrideStat. Outside of rootless
+// mode, or without the xattr, fi is returned as is. Only regular files and
+// directories carry the xattr; regular files stand in for the devices, named
+// pipes and sockets created in rootless mode.
+func (c *context) overrideFileInfo(fp string, fi os.FileInfo) (os.FileInfo, error) {
+	if !c.rootless || !(fi.Mode().IsRegular() || fi.Mode().IsDir()) {
+		return fi, nil
+	}
+
+	xattrDriver, ok := c.driver.(driverpkg.XAttrDriver)
+	if !ok {
+		return nil, fmt.Errorf("reading the owner of %q in rootless mode: %w", fp, ErrNotSupported)
+	}
+
+	xattrs, err := xattrDriver.Getxattr(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := xattrs[xattrOverrideStat]
+	if !ok {
+		return fi, nil
+	}
+
+	s, err := decodeOverrideStat(value)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %w", fp, err)
+	}
+
+	// only regular files stand in for entries of other types.
+	if s.mode.Type() == 0 || !fi.Mode().IsRegular() {
+		s.mode |= fi.Mode().Type()
+	}
+
+	return newOverrideFileInfo(fi, s)
+}
+
+// createPlaceholder creates the empty regular file standing in for a
+// device, named pipe or socket at fp in rootless mode.
+func (c *context) createPlaceholder(fp string, mode os.FileMode) error {
+	f, err := c.driver.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// overrideStatOf returns the metadata recorded in xattrOverrideStat for the
+// resource, owned by the host ids uid and gid.
+func overrideStatOf(resource Resource, uid, gid int64) overrideStat {
+	s := overrideStat{uid: uid, gid: gid, mode: resource.Mode()}
+	if d, ok := resource.(Device); ok {
+		s.major, s.minor = d.Major(), d.Minor()
+	}
+
+	return s
+}
+
+// recordedOverrideStat returns the value of xattrOverrideStat of the file at
+// fp, or nil if it is not set.
+func (c *context) recordedOverrideStat(fp string) ([]byte, error) {
+	xattrDriver, ok := c.driver.(driverpkg.XAttrDriver)
+	if !ok {
+		return nil, fmt.Errorf("reading the owner of %q in rootless mode: %w", fp, ErrNotSupported)
+	}
+
+	xattrs, err := xattrDriver.Getxattr(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	return xattrs[xattrOverrideStat], nil
+}
+
+// applyOverrideStat records the owner, mode and type of the resource in
+// xattrOverrideStat of the file at fp, rather than applying them, in
+// rootless mode.
+func (c *context) applyOverrideStat(fp string, resource Resource) error {
+	uid, gid, err := c.ids.ownerToHost(c.owner(resource))
+	if err != nil {
+		return err
+	}
+
+	xattrDriver, ok := c.driver.(driverpkg.XAttrDriver)
+	if !ok {
+		return fmt.Errorf("recording the owner of %q in rootless mode: %w", resource.Path(), ErrNotSupported)
+	}
+
+	return xattrDriver.Setxattr(fp, map[string][]byte{xattrOverrideStat: overrideStatOf(resource, uid, gid).encode()})
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// overrideFileInfo is an os.FileInfo with the owner, mode, type and device
+// numbers recorded in rootless mode. Sys returns a copy of the
+// *syscall.Stat_t of the file holding them.
+type overrideFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+	sys  *syscall.Stat_t
+}
+
+func (fi *overrideFileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+func (fi *overrideFileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *overrideFileInfo) Sys() interface{} {
+	return fi.sys
+}
+
+func newOverrideFileInfo(fi os.FileInfo, s overrideStat) (os.FileInfo, error) {
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("unable to resolve syscall.Stat_t from (os.FileInfo).Sys(): %#v", fi)
+	}
+
+	st := *sys
+	st.Uid, st.Gid = uint32(s.uid), uint32(s.gid)
+	setRdev(&st.Rdev, unix.Mkdev(uint32(s.major), uint32(s.minor)))
+
+	return &overrideFileInfo{FileInfo: fi, mode: s.mode, sys: &st}, nil
+}
+
+// setRdev sets the device number of a syscall.Stat_t, whose type depends on
+// the architecture.
+func setRdev[T uint32 | uint64](rdev *T, dev uint64) {
+	*rdev = T(dev)
+}
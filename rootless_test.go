@@ -0,0 +1,334 @@
+//go:build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/continuity/sysx"
+	"github.com/containerd/continuity/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestOverrideStat(t *testing.T) {
+	for _, tc := range []struct {
+		stat  overrideStat
+		value string
+	}{
+		{
+			stat:  overrideStat{uid: 0, gid: 0, mode: 0o644},
+			value: "0:0:0644:file",
+		},
+		{
+			stat:  overrideStat{uid: 1000, gid: 100, mode: os.ModeDir | os.ModeSticky | 0o777},
+			value: "1000:100:01777:dir",
+		},
+		{
+			stat:  overrideStat{mode: os.ModeSetuid | 0o755},
+			value: "0:0:04755:file",
+		},
+		{
+			stat:  overrideStat{mode: os.ModeDevice | os.ModeCharDevice | 0o666, major: 1, minor: 3},
+			value: "0:0:0666:char-1-3",
+		},
+		{
+			stat:  overrideStat{mode: os.ModeDevice | 0o660, major: 8, minor: 1},
+			value: "0:0:0660:block-8-1",
+		},
+		{
+			stat:  overrideStat{mode: os.ModeNamedPipe | 0o600},
+			value: "0:0:0600:pipe",
+		},
+	} {
+		if value := string(tc.stat.encode()); value != tc.value {
+			t.Errorf("unexpected value: %q != %q", value, tc.value)
+		}
+
+		s, err := decodeOverrideStat([]byte(tc.value))
+		if err != nil {
+			t.Fatalf("error decoding %q: %v", tc.value, err)
+		}
+		if s != tc.stat {
+			t.Errorf("unexpected override stat of %q: %#v != %#v", tc.value, s, tc.stat)
+		}
+	}
+
+	// the type is optional.
+	if s, err := decodeOverrideStat([]byte("10:20:0700")); err != nil || s != (overrideStat{uid: 10, gid: 20, mode: 0o700}) {
+		t.Fatalf("unexpected override stat: %#v, %v", s, err)
+	}
+
+	for _, value := range []string{"0:0", "0:0:0999", "0:0:0644:door", "0:0:0644:char-1"} {
+		if _, err := decodeOverrideStat([]byte(value)); err == nil {
+			t.Errorf("expected %q to fail", value)
+		}
+	}
+}
+
+func TestApplyRootless(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			kind: rdirectory,
+			path: "d",
+			mode: 0o555,
+		},
+		{
+			path: "d/a",
+			mode: 0o4755,
+		},
+		{
+			kind:  rchardev,
+			path:  "null",
+			mode:  os.ModeDevice | os.ModeCharDevice | 0o666,
+			major: 1,
+			minor: 3,
+		},
+		{
+			kind: rnamedpipe,
+			path: "fifo",
+			mode: os.ModeNamedPipe | 0o600,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "link",
+			target: "d/a",
+		},
+	})
+	for _, p := range []string{"d", "d/a", "null"} {
+		if err := os.Lchown(filepath.Join(root, p), 1000, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// chown clears the setuid bit, and devices are created with the umask.
+	if err := os.Chmod(filepath.Join(root, "d", "a"), 0o755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "null"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	for _, opts := range []ApplyOptions{{}, {Transactional: true}} {
+		target := t.TempDir()
+		if err := sysx.Setxattr(target, "user.test", []byte("1"), 0); err != nil {
+			t.Skipf("user xattrs are not supported: %v", err)
+		}
+
+		options := ContextOptions{Provider: testProviderFrom(t, root, "d/a"), Rootless: true}
+		tc, err := NewContextWithOptions(target, options)
+		if err != nil {
+			t.Fatalf("error getting context: %v", err)
+		}
+
+		if err := ApplyManifestWithOptions(tc, m, opts); err != nil {
+			t.Fatalf("error applying manifest: %v", err)
+		}
+
+		// devices are regular files, owned by the user applying the
+		// manifest.
+		fi, err := os.Lstat(filepath.Join(target, "null"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0o666 {
+			t.Fatalf("unexpected placeholder: %v", fi.Mode())
+		}
+		value, err := sysx.Getxattr(filepath.Join(target, "null"), xattrOverrideStat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "1000:1000:0666:char-1-3" {
+			t.Fatalf("unexpected override stat: %q", value)
+		}
+
+		// the directory stays writable by its owner.
+		if fi, err := os.Lstat(filepath.Join(target, "d")); err != nil || fi.Mode() != os.ModeDir|0o755 {
+			t.Fatalf("unexpected mode of directory: %v, %v", fi.Mode(), err)
+		}
+
+		report, err := VerifyManifestReport(tc, m)
+		if err != nil {
+			t.Fatalf("error verifying manifest: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("unexpected mismatches: %v", report.Err())
+		}
+
+		rebuilt, err := BuildManifest(tc)
+		if err != nil {
+			t.Fatalf("error building manifest: %v", err)
+		}
+		if changes := DiffManifests(m, rebuilt); len(changes) != 0 {
+			t.Fatalf("unexpected changes: %v", changes)
+		}
+
+		// without rootless mode, the placeholders are read as they are.
+		plain, err := NewContext(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsrc, err := plain.Resource("/null", nil); err != nil {
+			t.Fatal(err)
+		} else if _, ok := rsrc.(RegularFile); !ok {
+			t.Fatalf("expected a regular file, got %#v", rsrc)
+		}
+	}
+}
+
+func TestApplyRootlessUnprivileged(t *testing.T) {
+	if os.Getuid() == 0 {
+		runUnprivileged(t)
+		return
+	}
+
+	content := []byte("rootless")
+	dgst := digest.FromBytes(content)
+
+	var resources []Resource
+	add := func(rsrc Resource, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, rsrc)
+	}
+	add(newDirectory(resource{paths: []string{"/d"}, mode: os.ModeDir | 0o555}))
+	add(newRegularFile(resource{paths: []string{"/d/a"}, mode: os.ModeSetuid | 0o755, uid: 1000, gid: 1000}, []string{"/d/a"}, int64(len(content)), dgst))
+	add(newDevice(resource{paths: []string{"/null"}, mode: os.ModeDevice | os.ModeCharDevice | 0o666}, []string{"/null"}, 1, 3))
+	add(newNamedPipe(resource{paths: []string{"/fifo"}, mode: os.ModeNamedPipe | 0o600}, []string{"/fifo"}))
+	// symlinks keep the owner of the user applying the manifest.
+	add(newSymLink(resource{paths: []string{"/link"}, mode: os.ModeSymlink | 0o777, uid: int64(os.Getuid()), gid: int64(os.Getgid())}, "d/a"))
+	m := &Manifest{Resources: resources}
+
+	target := t.TempDir()
+	if err := sysx.Setxattr(target, "user.test", []byte("1"), 0); err != nil {
+		t.Skipf("user xattrs are not supported: %v", err)
+	}
+
+	tc, err := NewContextWithOptions(target, ContextOptions{Provider: testProvider{dgst: content}, Rootless: true})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	operations, err := PlanManifest(tc, m, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("error planning manifest: %v", err)
+	}
+	placeholders := 0
+	for _, op := range operations {
+		switch op.Kind {
+		case OperationMknod, OperationMkfifo, OperationChown, OperationChmod:
+			t.Errorf("unexpected operation in rootless mode: %v", op)
+		case OperationPlaceholder:
+			placeholders++
+		}
+	}
+	if placeholders != 2 {
+		t.Fatalf("expected placeholders for the device and named pipe: %v", operations)
+	}
+
+	if err := ApplyManifest(tc, m); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	report, err := VerifyManifestReport(tc, m)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected mismatches: %v", report.Err())
+	}
+
+	rebuilt, err := BuildManifest(tc)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+	if changes := DiffManifests(m, rebuilt); len(changes) != 0 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	if operations, err := PlanManifest(tc, m, ApplyOptions{}); err != nil || len(operations) != 0 {
+		t.Fatalf("unexpected operations after applying: %v, %v", operations, err)
+	}
+
+	// the owner of symlinks is not verified.
+	link, err := newSymLink(resource{paths: []string{"/link"}, mode: os.ModeSymlink | 0o777}, "d/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Verify(link); err != nil {
+		t.Fatalf("unexpected mismatch of symlink: %v", err)
+	}
+}
+
+// runUnprivileged runs the test again as nobody, from a copy of the test
+// binary the user can execute.
+func runUnprivileged(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "continuity-unprivileged-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, filepath.Base(exe))
+	if err := os.WriteFile(bin, content, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bin, "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TMPDIR="+dir, "HOME="+dir)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running as nobody: %v\n%s", err, out)
+	}
+	if bytes.Contains(out, []byte("--- SKIP")) {
+		t.Skipf("skipped as nobody:\n%s", out)
+	}
+}
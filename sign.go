@@ -0,0 +1,239 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrInvalidSignature is returned when a manifest signature does not verify.
+var ErrInvalidSignature = errors.New("invalid manifest signature")
+
+// Signature is a detached signature of a manifest. It signs the digest of
+// the manifest, as returned by Manifest.Digest, so it remains valid
+// regardless of how the manifest is encoded.
+type Signature struct {
+	// Digest is the digest of the signed manifest.
+	Digest digest.Digest `json:"digest"`
+
+	// Algorithm is the signature algorithm, such as "ed25519".
+	Algorithm string `json:"algorithm"`
+
+	// KeyID identifies the key that made the signature.
+	KeyID string `json:"keyid,omitempty"`
+
+	// Signature is the signature of the digest string.
+	Signature []byte `json:"signature"`
+}
+
+// Signer signs manifest digests. Implementations may keep their keys
+// elsewhere, such as in a hardware token or a remote service.
+type Signer interface {
+	// Algorithm returns the signature algorithm used by the signer.
+	Algorithm() string
+
+	// KeyID identifies the signing key.
+	KeyID() string
+
+	// Sign returns the signature of payload.
+	Sign(payload []byte) ([]byte, error)
+}
+
+// SignatureVerifier verifies signatures made by a Signer.
+type SignatureVerifier interface {
+	// Verify returns an error wrapping ErrInvalidSignature if sig is not a
+	// valid signature of payload.
+	Verify(payload []byte, sig *Signature) error
+}
+
+// SignManifest returns a detached signature of the manifest made by signer.
+func SignManifest(m *Manifest, signer Signer) (*Signature, error) {
+	dgst, err := m.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := signer.Sign([]byte(dgst.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error signing manifest: %w", err)
+	}
+
+	return &Signature{
+		Digest:    dgst,
+		Algorithm: signer.Algorithm(),
+		KeyID:     signer.KeyID(),
+		Signature: p,
+	}, nil
+}
+
+// VerifyManifestSignature checks that sig is a valid signature of the
+// manifest, returning an error wrapping ErrInvalidSignature if it is not.
+func VerifyManifestSignature(m *Manifest, sig *Signature, verifier SignatureVerifier) error {
+	dgst, err := m.Digest()
+	if err != nil {
+		return err
+	}
+
+	if sig.Digest != dgst {
+		return fmt.Errorf("%w: signature is for manifest %v, not %v", ErrInvalidSignature, sig.Digest, dgst)
+	}
+
+	return verifier.Verify([]byte(dgst.String()), sig)
+}
+
+// ed25519Algorithm is the name of the ed25519 signature algorithm.
+const ed25519Algorithm = "ed25519"
+
+// ed25519Signer is a Signer using an ed25519 private key.
+type ed25519Signer struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+var _ Signer = &ed25519Signer{}
+
+// NewEd25519Signer returns a Signer using the ed25519 private key.
+func NewEd25519Signer(key ed25519.PrivateKey) (Signer, error) {
+	keyID, err := ed25519KeyID(key.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ed25519Signer{key: key, keyID: keyID}, nil
+}
+
+// NewEd25519SignerFromPEM returns a Signer using the PEM encoded PKCS #8
+// ed25519 private key, as generated by
+// "openssl genpkey -algorithm ed25519".
+func NewEd25519SignerFromPEM(p []byte) (Signer, error) {
+	der, err := decodePEM(p, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is a %T, not an ed25519 key: %w", key, ErrNotSupported)
+	}
+
+	return NewEd25519Signer(edKey)
+}
+
+func (s *ed25519Signer) Algorithm() string {
+	return ed25519Algorithm
+}
+
+func (s *ed25519Signer) KeyID() string {
+	return s.keyID
+}
+
+func (s *ed25519Signer) Sign(payload []byte) ([]byte, error) {
+	return s.key.Sign(nil, payload, crypto.Hash(0))
+}
+
+// ed25519Verifier is a SignatureVerifier using an ed25519 public key.
+type ed25519Verifier struct {
+	key   ed25519.PublicKey
+	keyID string
+}
+
+var _ SignatureVerifier = &ed25519Verifier{}
+
+// NewEd25519Verifier returns a SignatureVerifier for signatures made with
+// the private key of the ed25519 public key.
+func NewEd25519Verifier(key ed25519.PublicKey) (SignatureVerifier, error) {
+	keyID, err := ed25519KeyID(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ed25519Verifier{key: key, keyID: keyID}, nil
+}
+
+// NewEd25519VerifierFromPEM returns a SignatureVerifier using the PEM encoded
+// PKIX ed25519 public key, as generated by "openssl pkey -pubout".
+func NewEd25519VerifierFromPEM(p []byte) (SignatureVerifier, error) {
+	der, err := decodePEM(p, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is a %T, not an ed25519 key: %w", key, ErrNotSupported)
+	}
+
+	return NewEd25519Verifier(edKey)
+}
+
+func (v *ed25519Verifier) Verify(payload []byte, sig *Signature) error {
+	if sig.Algorithm != ed25519Algorithm {
+		return fmt.Errorf("%w: unexpected algorithm %q", ErrInvalidSignature, sig.Algorithm)
+	}
+
+	if sig.KeyID != "" && sig.KeyID != v.keyID {
+		return fmt.Errorf("%w: signed by key %s, not %s", ErrInvalidSignature, sig.KeyID, v.keyID)
+	}
+
+	if !ed25519.Verify(v.key, payload, sig.Signature) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// ed25519KeyID identifies the public key by the digest of its PKIX encoding.
+func ed25519KeyID(key ed25519.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return digest.FromBytes(der).String(), nil
+}
+
+// decodePEM returns the content of the first PEM block of the given type.
+func decodePEM(p []byte, blockType string) ([]byte, error) {
+	for {
+		var block *pem.Block
+		block, p = pem.Decode(p)
+		if block == nil {
+			return nil, fmt.Errorf("no %q PEM block found", blockType)
+		}
+
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
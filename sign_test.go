@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"testing"
+)
+
+// generateEd25519PEM returns a new ed25519 key pair, PEM encoded.
+func generateEd25519PEM(t *testing.T) (private, public []byte) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+}
+
+func TestManifestSignature(t *testing.T) {
+	m := formatTestManifest(t)
+
+	private, public := generateEd25519PEM(t)
+	signer, err := NewEd25519SignerFromPEM(private)
+	if err != nil {
+		t.Fatalf("error loading private key: %v", err)
+	}
+	verifier, err := NewEd25519VerifierFromPEM(public)
+	if err != nil {
+		t.Fatalf("error loading public key: %v", err)
+	}
+
+	sig, err := SignManifest(m, signer)
+	if err != nil {
+		t.Fatalf("error signing manifest: %v", err)
+	}
+
+	if err := VerifyManifestSignature(m, sig, verifier); err != nil {
+		t.Fatalf("error verifying signature: %v", err)
+	}
+
+	// the signature covers the manifest, not its encoding.
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifestSignature(decoded, sig, verifier); err != nil {
+		t.Fatalf("error verifying signature of decoded manifest: %v", err)
+	}
+
+	tampered := formatTestManifest(t)
+	tampered.Resources[0].(*directory).mode = os.ModeDir | 0o777
+	if err := VerifyManifestSignature(tampered, sig, verifier); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected tampered manifest to fail verification, got %v", err)
+	}
+
+	_, otherPublic := generateEd25519PEM(t)
+	other, err := NewEd25519VerifierFromPEM(otherPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifestSignature(m, sig, other); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected verification with another key to fail, got %v", err)
+	}
+
+	forged := *sig
+	forged.KeyID = ""
+	forged.Signature = append([]byte(nil), sig.Signature...)
+	forged.Signature[0] ^= 0xff
+	if err := VerifyManifestSignature(m, &forged, verifier); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected forged signature to fail verification, got %v", err)
+	}
+}
+
+func TestEd25519PEMErrors(t *testing.T) {
+	private, public := generateEd25519PEM(t)
+
+	if _, err := NewEd25519SignerFromPEM(public); err == nil {
+		t.Fatal("expected public key to be rejected as a private key")
+	}
+	if _, err := NewEd25519VerifierFromPEM(private); err == nil {
+		t.Fatal("expected private key to be rejected as a public key")
+	}
+	if _, err := NewEd25519VerifierFromPEM([]byte("not a key")); err == nil {
+		t.Fatal("expected garbage to be rejected")
+	}
+}
@@ -0,0 +1,132 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	driverpkg "github.com/containerd/continuity/driver"
+)
+
+func TestSocketManifest(t *testing.T) {
+	// the second socket path is too long for a socket address.
+	long := filepath.Join("run", strings.Repeat("d", 120))
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			kind: rdirectory,
+			path: "run",
+			mode: 0o755,
+		},
+		{
+			kind: rdirectory,
+			path: long,
+			mode: 0o755,
+		},
+	})
+
+	socketDriver := driverpkg.LocalDriver.(driverpkg.SocketDriver)
+	for _, p := range []string{"run/a.sock", filepath.Join(long, "b.sock")} {
+		if err := socketDriver.Mksock(filepath.Join(root, p), 0o600); err != nil {
+			t.Fatalf("error creating socket: %v", err)
+		}
+	}
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	var sockets []string
+	for _, rsrc := range m.Resources {
+		if _, ok := rsrc.(Socket); ok {
+			if rsrc.Mode() != os.ModeSocket|0o600 {
+				t.Fatalf("unexpected mode of %q: %v", rsrc.Path(), rsrc.Mode())
+			}
+			sockets = append(sockets, rsrc.Path())
+		}
+	}
+	expected := []string{"/run/a.sock", "/" + filepath.Join(long, "b.sock")}
+	if !reflect.DeepEqual(sockets, expected) {
+		t.Fatalf("unexpected sockets: %q != %q", sockets, expected)
+	}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = Unmarshal(p); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []ApplyOptions{{}, {Transactional: true}} {
+		target := t.TempDir()
+		tc, err := NewContext(target)
+		if err != nil {
+			t.Fatalf("error getting context: %v", err)
+		}
+
+		operations, err := PlanManifest(tc, m, opts)
+		if err != nil {
+			t.Fatalf("error planning manifest: %v", err)
+		}
+		var created []string
+		for _, op := range operations {
+			if op.Kind == OperationMksock {
+				created = append(created, op.Path)
+			}
+		}
+		if !reflect.DeepEqual(created, expected) {
+			t.Fatalf("unexpected operations: %v", operations)
+		}
+
+		if err := ApplyManifestWithOptions(tc, m, opts); err != nil {
+			t.Fatalf("error applying manifest: %v", err)
+		}
+
+		report, err := VerifyManifestReport(tc, m)
+		if err != nil {
+			t.Fatalf("error verifying manifest: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("unexpected mismatches: %v", report.Err())
+		}
+	}
+
+	// sockets missing from the manifest are extra.
+	if err := socketDriver.Mksock(filepath.Join(root, "run/c.sock"), 0o600); err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	report, err := VerifyManifestReport(fsContext, m)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].Kind != MismatchExtra {
+		t.Fatalf("expected the new socket to be extra: %v", report.Err())
+	}
+}
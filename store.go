@@ -0,0 +1,174 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ContentStore is a ContentProvider backed by a local directory of blobs,
+// stored by digest as blobs/<algorithm>/<encoded>. Content is verified
+// against its digest as it is read.
+//
+// A ContentStore is populated by using its Digester when building a
+// manifest, storing the content of each file as it is digested. Files whose
+// digests are reused from BuildOptions.Previous are not read, so their
+// content is not added.
+type ContentStore struct {
+	root string
+}
+
+var _ ContentProvider = &ContentStore{}
+
+// NewContentStore returns a ContentStore using the directory root, which is
+// created when content is first added.
+func NewContentStore(root string) (*ContentStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContentStore{root: root}, nil
+}
+
+// BlobPath returns the path of the blob for dgst in the store.
+func (s *ContentStore) BlobPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.root, "blobs", dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+// Reader returns a reader for the content of dgst. An error is returned by
+// Read if the content does not match the digest once read completely.
+func (s *ContentStore) Reader(dgst digest.Digest) (io.ReadCloser, error) {
+	p, err := s.BlobPath(dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("content %v: %w", dgst, ErrNotFound)
+		}
+		return nil, err
+	}
+
+	return &verifiedReader{
+		ReadCloser: f,
+		dgst:       dgst,
+		verifier:   dgst.Verifier(),
+	}, nil
+}
+
+// Has returns true if the store holds the content of dgst.
+func (s *ContentStore) Has(dgst digest.Digest) bool {
+	p, err := s.BlobPath(dgst)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// Digester returns a Digester using the given algorithm, which adds the
+// content it digests to the store.
+func (s *ContentStore) Digester(algorithm digest.Algorithm) Digester {
+	return storeDigester{store: s, algorithm: algorithm}
+}
+
+// add writes the content from r to the store, returning its digest.
+func (s *ContentStore) add(algorithm digest.Algorithm, r io.Reader) (digest.Digest, error) {
+	dir := filepath.Join(s.root, "blobs", algorithm.String())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	digester := algorithm.Digester()
+	if _, err := io.Copy(io.MultiWriter(f, digester.Hash()), r); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	dgst := digester.Digest()
+	p, err := s.BlobPath(dgst)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(p); err == nil {
+		// already present
+		return dgst, nil
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		return "", err
+	}
+
+	return dgst, nil
+}
+
+type storeDigester struct {
+	store     *ContentStore
+	algorithm digest.Algorithm
+}
+
+func (sd storeDigester) Digest(r io.Reader) (digest.Digest, error) {
+	return sd.store.add(sd.algorithm, r)
+}
+
+// verifiedReader verifies the content read against dgst, returning an error
+// in place of io.EOF if it does not match.
+type verifiedReader struct {
+	io.ReadCloser
+	dgst     digest.Digest
+	verifier digest.Verifier
+}
+
+func (vr *verifiedReader) Read(p []byte) (int, error) {
+	n, err := vr.ReadCloser.Read(p)
+	vr.verifier.Write(p[:n])
+
+	if err == io.EOF && !vr.verifier.Verified() {
+		return n, fmt.Errorf("content for %v does not match its digest", vr.dgst)
+	}
+
+	return n, err
+}
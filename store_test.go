@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestContentStore(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "a", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for p, content := range map[string]string{
+		"a/b/c": "content of c",
+		"a/d":   "content of d",
+		"e":     "content of c",
+	} {
+		if err := os.WriteFile(filepath.Join(src, p), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := NewContentStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+
+	srcContext, err := NewContextWithOptions(src, ContextOptions{Digester: store.Digester(digest.Canonical)})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(srcContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	for _, rsrc := range m.Resources {
+		if rf, ok := rsrc.(RegularFile); ok && !store.Has(rf.Digests()[0]) {
+			t.Fatalf("expected content of %q to be stored", rsrc.Path())
+		}
+	}
+
+	dst := t.TempDir()
+	dstContext, err := NewContextWithOptions(dst, ContextOptions{Provider: store})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	if err := ApplyManifest(dstContext, m); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	if err := VerifyManifest(dstContext, m); err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+
+	// corrupt the content of /a/d and ensure it is rejected on apply.
+	dgst := digest.FromString("content of d")
+	p, err := store.BlobPath(dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("corrupted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dst, "a", "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyManifest(dstContext, m); err == nil {
+		t.Fatal("expected apply to fail with corrupted content")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only /a/b after failed apply, got %v", entries)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// streamMagic starts a streamed manifest. The leading zero byte can never
+// start a protobuf encoded Manifest, which allows readers to tell both
+// encodings apart.
+var streamMagic = []byte("\x00continuity-stream\n")
+
+// ManifestWriter writes a manifest as a stream of resources, without holding
+// the entire manifest in memory.
+//
+// A streamed manifest starts with a magic string followed by a header, which
+// is a length-delimited Manifest message with no resources. It is followed by
+// one length-delimited Resource message for each resource. Unlike Marshal,
+// the resources are written in the order they are provided.
+//
+// As the header is written first, it must declare the schema version the
+// resources require: whiteouts and opaque directories are rejected unless the
+// header allows for them, as NewHeader does for overlays.
+type ManifestWriter struct {
+	w *bufio.Writer
+
+	// version is the schema version declared by the header, zero if there is
+	// none.
+	version uint32
+}
+
+// NewManifestWriter returns a ManifestWriter writing to w, after writing the
+// stream header. Flush must be called once all resources have been written.
+func NewManifestWriter(w io.Writer) (*ManifestWriter, error) {
+	return NewManifestWriterWithHeader(w, nil)
+}
+
+// NewManifestWriterWithHeader returns a ManifestWriter like
+// NewManifestWriter, recording the manifest header in the stream header.
+func NewManifestWriterWithHeader(w io.Writer, header *Header) (*ManifestWriter, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(streamMagic); err != nil {
+		return nil, err
+	}
+
+	if _, err := protodelim.MarshalTo(bw, &pb.Manifest{Header: toProtoHeader(header)}); err != nil {
+		return nil, err
+	}
+
+	mw := &ManifestWriter{w: bw}
+	if header != nil {
+		mw.version = header.Version
+	}
+
+	return mw, nil
+}
+
+// Write writes the resource to the stream.
+func (mw *ManifestWriter) Write(rsrc Resource) error {
+	if v := resourceVersion(rsrc); v > manifestVersionHeader && v > mw.version {
+		return fmt.Errorf("resource %q requires manifest version %d, the stream header declares %d", rsrc.Path(), v, mw.version)
+	}
+
+	_, err := protodelim.MarshalTo(mw.w, toProto(rsrc))
+	return err
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (mw *ManifestWriter) Flush() error {
+	return mw.w.Flush()
+}
+
+// ManifestReader reads the resources of a manifest one at a time. Streamed
+// manifests, as written by ManifestWriter, are decoded incrementally. For
+// compatibility, a manifest encoded with Marshal, MarshalText or
+// Manifest.MarshalJSON is also accepted, although it has to be read into
+// memory in its entirety.
+type ManifestReader struct {
+	r      *bufio.Reader
+	header *Header
+
+	// resources holds the remaining records of a manifest that was not
+	// streamed.
+	resources []*pb.Resource
+	streamed  bool
+}
+
+// NewManifestReader returns a ManifestReader reading from r.
+func NewManifestReader(r io.Reader) (*ManifestReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(streamMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(magic, streamMagic) {
+		p, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+
+		bm, err := decodeManifest(p)
+		if err != nil {
+			return nil, err
+		}
+
+		header, err := fromProtoHeader(bm.Header)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ManifestReader{header: header, resources: bm.Resource}, nil
+	}
+
+	if _, err := br.Discard(len(streamMagic)); err != nil {
+		return nil, err
+	}
+
+	var header pb.Manifest
+	if err := protodelim.UnmarshalFrom(br, &header); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("error reading manifest stream header: %w", err)
+	}
+
+	if len(header.Resource) > 0 {
+		return nil, errors.New("manifest stream header must not contain resources")
+	}
+
+	h, err := fromProtoHeader(header.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ManifestReader{r: br, header: h, streamed: true}, nil
+}
+
+// Header returns the header of the manifest, or nil if it has none.
+func (mr *ManifestReader) Header() *Header {
+	return mr.header
+}
+
+// Next returns the next resource of the manifest. At the end of the manifest,
+// io.EOF is returned.
+func (mr *ManifestReader) Next() (Resource, error) {
+	var b *pb.Resource
+	if mr.streamed {
+		b = &pb.Resource{}
+		if err := protodelim.UnmarshalFrom(mr.r, b); err != nil {
+			return nil, err
+		}
+	} else {
+		if len(mr.resources) == 0 {
+			return nil, io.EOF
+		}
+
+		b = mr.resources[0]
+		mr.resources = mr.resources[1:]
+	}
+
+	rsrc, err := fromProto(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if mr.header != nil {
+		if err := mr.header.validateResource(rsrc); err != nil {
+			return nil, err
+		}
+	}
+
+	return rsrc, nil
+}
+
+// decodeManifest decodes a manifest encoded in the binary, text or JSON
+// format. The binary encoding of a manifest always contains control
+// characters, which tells it apart from the text formats, and JSON manifests
+// are objects.
+func decodeManifest(p []byte) (*pb.Manifest, error) {
+	var (
+		bm  pb.Manifest
+		err error
+	)
+
+	switch {
+	case !isText(p):
+		err = proto.Unmarshal(p, &bm)
+	case bytes.HasPrefix(bytes.TrimLeft(p, " \t\r\n"), []byte("{")):
+		err = protojson.Unmarshal(p, &bm)
+	default:
+		err = prototext.Unmarshal(p, &bm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &bm, nil
+}
+
+// isText returns true if p is UTF-8 without control characters other than
+// whitespace.
+func isText(p []byte) bool {
+	if !utf8.Valid(p) {
+		return false
+	}
+
+	for _, c := range p {
+		if c < 0x20 && c != '\t' && c != '\r' && c != '\n' {
+			return false
+		}
+	}
+
+	return true
+}
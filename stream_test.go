@@ -0,0 +1,236 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestManifestStream(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind:   rhardlink,
+			path:   "a-hardlink",
+			target: "a",
+		},
+		{
+			kind: rdirectory,
+			path: "b",
+			mode: 0o755,
+		},
+		{
+			path: "b/a",
+			mode: 0o600,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "b/a-relsymlink",
+			mode:   0o600,
+			target: "../a",
+		},
+		{
+			kind: rnamedpipe,
+			path: "fifo",
+			mode: 0o666 | os.ModeNamedPipe,
+		},
+	})
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	expected, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	var b bytes.Buffer
+	mw, err := NewManifestWriter(&b)
+	if err != nil {
+		t.Fatalf("error creating manifest writer: %v", err)
+	}
+
+	if err := BuildManifestStream(ctx, mw); err != nil {
+		t.Fatalf("error building manifest stream: %v", err)
+	}
+
+	streamed := b.Bytes()
+	resources := readManifestStream(t, bytes.NewReader(streamed))
+	sort.Stable(ByPath(resources))
+
+	if diff := diffResourceList(expected.Resources, resources); diff.HasDiff() {
+		t.Fatalf("streamed manifest differs from built manifest: %+v", diff)
+	}
+
+	mr, err := NewManifestReader(bytes.NewReader(streamed))
+	if err != nil {
+		t.Fatalf("error creating manifest reader: %v", err)
+	}
+
+	if err := VerifyManifestStream(ctx, mr); err != nil {
+		t.Fatalf("error verifying manifest stream: %v", err)
+	}
+
+	// Manifests encoded with Marshal must be readable as well.
+	p, err := Marshal(expected)
+	if err != nil {
+		t.Fatalf("error marshaling manifest: %v", err)
+	}
+
+	if diff := diffResourceList(expected.Resources, readManifestStream(t, bytes.NewReader(p))); diff.HasDiff() {
+		t.Fatalf("unexpected resources reading marshaled manifest: %+v", diff)
+	}
+
+	// A truncated header is an error rather than an empty manifest.
+	if _, err := NewManifestReader(bytes.NewReader(streamMagic)); err == nil {
+		t.Fatal("expected error reading truncated stream")
+	}
+}
+
+func readManifestStream(t *testing.T, r io.Reader) []Resource {
+	t.Helper()
+
+	mr, err := NewManifestReader(r)
+	if err != nil {
+		t.Fatalf("error creating manifest reader: %v", err)
+	}
+
+	var resources []Resource
+	for {
+		rsrc, err := mr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("error reading resource: %v", err)
+		}
+
+		resources = append(resources, rsrc)
+	}
+
+	return resources
+}
+
+func TestManifestJSON(t *testing.T) {
+	m := formatTestManifest(t)
+
+	p, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatalf("error marshaling manifest: %v", err)
+	}
+
+	again, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatalf("error marshaling manifest: %v", err)
+	}
+	if !bytes.Equal(p, again) {
+		t.Fatalf("JSON encoding is not stable: %s != %s", p, again)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte{0x01, 0x00, 0x00, 0x02, 0xff})
+	if !bytes.Contains(p, []byte(`"data":"`+encoded+`"`)) {
+		t.Fatalf("expected base64 xattr value %q in %s", encoded, p)
+	}
+
+	var decoded Manifest
+	if err := decoded.UnmarshalJSON(p); err != nil {
+		t.Fatalf("error unmarshaling manifest: %v", err)
+	}
+
+	if changes := DiffManifests(m, &decoded); len(changes) > 0 {
+		t.Fatalf("unexpected changes after round trip: %v", changes)
+	}
+}
+
+func TestManifestReaderFormats(t *testing.T) {
+	m := formatTestManifest(t)
+
+	binary, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	if err := MarshalText(&text, m); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonBytes, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	mw, err := NewManifestWriter(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rsrc := range m.Resources {
+		if err := mw.Write(rsrc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		p    []byte
+	}{
+		{"pb", binary},
+		{"text", text.Bytes()},
+		{"json", jsonBytes},
+		{"indented json", append([]byte("\n  "), jsonBytes...)},
+		{"stream", stream.Bytes()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mr, err := NewManifestReader(bytes.NewReader(tc.p))
+			if err != nil {
+				t.Fatalf("error reading manifest: %v", err)
+			}
+
+			var decoded Manifest
+			for {
+				rsrc, err := mr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("error reading resource: %v", err)
+				}
+				decoded.Resources = append(decoded.Resources, rsrc)
+			}
+
+			if changes := DiffManifests(m, &decoded); len(changes) > 0 {
+				t.Fatalf("unexpected changes: %v", changes)
+			}
+		})
+	}
+}
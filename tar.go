@@ -0,0 +1,386 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	gocontext "context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// TarOptions configures how a manifest is built from a tar archive.
+type TarOptions struct {
+	// Digester digests the content of regular files. The canonical
+	// algorithm is used if nil.
+	Digester Digester
+
+	// Timestamps selects the file times recorded from the archive headers.
+	Timestamps Timestamps
+
+	// Tool identifies the program building the manifest in its header.
+	Tool string
+
+	// Annotations are recorded in the header of the manifest.
+	Annotations map[string]string
+
+	// Filter selects the paths to include in the manifest, as with
+	// BuildOptions. Entries which are not selected are still read, as
+	// hardlinks may refer to them.
+	Filter *Filter
+}
+
+// BuildManifestFromTar builds a manifest of the tree described by the tar
+// archive read from r, without extracting it. See
+// BuildManifestFromTarWithOptions.
+func BuildManifestFromTar(r io.Reader) (*Manifest, error) {
+	return BuildManifestFromTarWithOptions(gocontext.Background(), r, TarOptions{})
+}
+
+// BuildManifestFromTarWithOptions builds a manifest of the tree described by
+// the tar archive read from r, matching the manifest BuildManifest would
+// produce for the extracted tree. The archive may be uncompressed, gzip or
+// zstd compressed.
+//
+// Hardlinks are merged with their target, xattrs are read from PAX
+// "SCHILY.xattr." records and later entries replace earlier entries at the
+// same path, as they would when extracted. Parent directories without an
+// entry of their own are not recorded, as their attributes depend on the
+// extraction.
+func BuildManifestFromTarWithOptions(ctx gocontext.Context, r io.Reader, opts TarOptions) (*Manifest, error) {
+	tr, err := newTarReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	digester := opts.Digester
+	if digester == nil {
+		digester = simpleDigester{digest.Canonical}
+	}
+
+	tb := tarBuilder{
+		digester:   digester,
+		timestamps: opts.Timestamps,
+		inodes:     map[string]int{},
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		if err := tb.add(hdr, tr); err != nil {
+			return nil, fmt.Errorf("failed to get resource %q: %w", hdr.Name, err)
+		}
+	}
+
+	resources, err := tb.resources()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered, err := filterManifest(&Manifest{Resources: resources}, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	resources = filtered.Resources
+
+	return &Manifest{
+		Header: &Header{
+			Version:          manifestVersionHeader,
+			Tool:             opts.Tool,
+			DigestAlgorithms: digestAlgorithms(resources),
+			Root:             tb.root,
+			Annotations:      opts.Annotations,
+		},
+		Resources: resources,
+	}, nil
+}
+
+// tarBuilder collects the resources of a tar archive. Every entry other than
+// a hardlink creates a new inode, hardlinks share the inode of their target.
+type tarBuilder struct {
+	digester   Digester
+	timestamps Timestamps
+
+	// inodes maps each path to the index of its inode.
+	inodes map[string]int
+
+	// builders creates the resource of each inode for its paths.
+	builders []func(paths []string) (Resource, error)
+
+	// root describes the root directory, if the archive has an entry for it.
+	root *RootInfo
+}
+
+// add records the entry described by hdr, reading its content from r.
+func (tb *tarBuilder) add(hdr *tar.Header, r io.Reader) error {
+	p, err := tarPath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if p == "/" {
+		// the root is only described by the header of a manifest.
+		if hdr.Typeflag == tar.TypeDir {
+			tb.root = &RootInfo{
+				Mode: hdr.FileInfo().Mode(),
+				UID:  int64(hdr.Uid),
+				GID:  int64(hdr.Gid),
+			}
+		}
+		return nil
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		target, err := tarPath(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+
+		inode, ok := tb.inodes[target]
+		if !ok {
+			return fmt.Errorf("hardlink target %q not found", hdr.Linkname)
+		}
+		tb.inodes[p] = inode
+
+		return nil
+	}
+
+	build, err := tb.builder(hdr, r)
+	if err != nil {
+		return err
+	}
+	if build == nil {
+		return nil
+	}
+
+	tb.inodes[p] = len(tb.builders)
+	tb.builders = append(tb.builders, build)
+
+	return nil
+}
+
+// builder returns a function creating the resource described by hdr for a
+// set of paths, or nil if the entry does not describe a file.
+func (tb *tarBuilder) builder(hdr *tar.Header, r io.Reader) (func(paths []string) (Resource, error), error) {
+	base := resource{
+		mode: hdr.FileInfo().Mode(),
+		uid:  int64(hdr.Uid),
+		gid:  int64(hdr.Gid),
+	}
+
+	if tb.timestamps&TimestampModify != 0 {
+		base.mtime = hdr.ModTime
+	}
+	if tb.timestamps&TimestampAccess != 0 {
+		base.atime = hdr.AccessTime
+	}
+	if tb.timestamps&TimestampChange != 0 {
+		base.ctime = hdr.ChangeTime
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		base.xattrs = tarXAttrs(hdr)
+
+		dgst, err := tb.digester.Digest(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(paths []string) (Resource, error) {
+			return newRegularFile(base, paths, hdr.Size, dgst)
+		}, nil
+	case tar.TypeDir:
+		base.xattrs = tarXAttrs(hdr)
+
+		return func(paths []string) (Resource, error) {
+			base.paths = paths
+			return newDirectory(base)
+		}, nil
+	case tar.TypeSymlink:
+		base.xattrs = tarXAttrs(hdr)
+
+		return func(paths []string) (Resource, error) {
+			base.paths = paths
+			return newSymLink(base, hdr.Linkname)
+		}, nil
+	case tar.TypeFifo:
+		return func(paths []string) (Resource, error) {
+			return newNamedPipe(base, paths)
+		}, nil
+	case tar.TypeChar, tar.TypeBlock:
+		return func(paths []string) (Resource, error) {
+			return newDevice(base, paths, uint64(hdr.Devmajor), uint64(hdr.Devminor))
+		}, nil
+	case tar.TypeXGlobalHeader:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("tar entry type %q is not supported: %w", hdr.Typeflag, ErrNotSupported)
+	}
+}
+
+// resources returns the resources of the archive, ordered by path. Inodes
+// with several paths become a single hardlinked resource if the type allows
+// it and a resource per path otherwise.
+func (tb *tarBuilder) resources() ([]Resource, error) {
+	paths := make([][]string, len(tb.builders))
+	for p, inode := range tb.inodes {
+		paths[inode] = append(paths[inode], p)
+	}
+
+	var resources []Resource
+	for inode, build := range tb.builders {
+		linked := paths[inode]
+		if len(linked) == 0 {
+			// replaced by a later entry.
+			continue
+		}
+		sort.Strings(linked)
+
+		rsrc, err := build(linked[:1])
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := rsrc.(Hardlinkable); ok && len(linked) > 1 {
+			rsrc, err = build(linked)
+			if err != nil {
+				return nil, err
+			}
+		}
+		resources = append(resources, rsrc)
+
+		if _, ok := rsrc.(Hardlinkable); ok {
+			continue
+		}
+
+		for _, p := range linked[1:] {
+			rsrc, err := build([]string{p})
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, rsrc)
+		}
+	}
+
+	sort.Stable(ByPath(resources))
+
+	return resources, nil
+}
+
+// tarPath converts the name of a tar entry to a manifest path.
+func tarPath(name string) (string, error) {
+	p := path.Clean("/" + name)
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("path %q escapes the root", name)
+		}
+	}
+
+	return p, nil
+}
+
+// paxXAttrPrefix prefixes PAX records holding extended attributes.
+const paxXAttrPrefix = "SCHILY.xattr."
+
+// tarXAttrs returns the extended attributes recorded for the entry.
+func tarXAttrs(hdr *tar.Header) map[string][]byte {
+	var xattrs map[string][]byte
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxXAttrPrefix) {
+			continue
+		}
+
+		if xattrs == nil {
+			xattrs = map[string][]byte{}
+		}
+		xattrs[strings.TrimPrefix(k, paxXAttrPrefix)] = []byte(v)
+	}
+
+	return xattrs
+}
+
+var (
+	errUnsupportedCompression = fmt.Errorf("unsupported archive compression: %w", ErrNotSupported)
+
+	// gzipMagic starts every gzip stream.
+	gzipMagic = []byte{0x1f, 0x8b}
+
+	// zstdMagic starts every zstd frame.
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// newTarReader returns a tar reader for the archive read from r, detecting
+// and decompressing gzip and zstd compressed archives. Other compressions
+// return an error wrapping errUnsupportedCompression.
+func newTarReader(r io.Reader) (*tar.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(zr), nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		// a single decoder decodes synchronously, without goroutines to
+		// release once the archive is read.
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(zr), nil
+	case !isTarHeader(magic):
+		return nil, errUnsupportedCompression
+	}
+
+	return tar.NewReader(br), nil
+}
+
+// isTarHeader returns true if b starts with a tar header.
+func isTarHeader(b []byte) bool {
+	if len(b) < 512 {
+		// an empty archive is only end of archive markers.
+		return len(b) == 0
+	}
+
+	_, err := tar.NewReader(bytes.NewReader(b)).Next()
+	return err == nil || err == io.EOF
+}
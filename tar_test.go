@@ -0,0 +1,268 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestBuildManifestFromTar(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind:   rhardlink,
+			path:   "a-hardlink",
+			target: "a",
+		},
+		{
+			kind: rdirectory,
+			path: "b",
+			mode: 0o750,
+		},
+		{
+			kind:   rhardlink,
+			path:   "b/a-hardlink",
+			target: "a",
+		},
+		{
+			path: "b/c",
+			mode: 0o600 | os.ModeSticky,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "b/c-symlink",
+			target: "c",
+		},
+		{
+			kind: rnamedpipe,
+			path: "b/fifo",
+			mode: os.ModeNamedPipe | 0o640,
+		},
+	})
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	expected, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	archive := writeTestTar(t, root)
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zstdWriter, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdCompressed := zstdWriter.EncodeAll(archive, nil)
+
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+	}{
+		{"plain", archive},
+		{"gzip", compressed.Bytes()},
+		{"zstd", zstdCompressed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := BuildManifestFromTar(bytes.NewReader(tc.archive))
+			if err != nil {
+				t.Fatalf("error building manifest from tar: %v", err)
+			}
+
+			if changes := DiffManifests(expected, m); len(changes) > 0 {
+				t.Fatalf("manifest from tar differs from the extracted tree: %v", changes)
+			}
+		})
+	}
+}
+
+func TestBuildManifestFromTarEntries(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o755}},
+		{
+			hdr: tar.Header{
+				Typeflag:   tar.TypeReg,
+				Name:       "./etc/passwd",
+				Mode:       0o644,
+				PAXRecords: map[string]string{"SCHILY.xattr.user.test": "value"},
+			},
+			content: "root:x:0:0::/root:/bin/sh\n",
+		},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/replaced", Mode: 0o600}, content: "old"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/replaced", Mode: 0o644}, content: "new"},
+		{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}},
+	} {
+		entry.hdr.Size = int64(len(entry.content))
+		if err := tw.WriteHeader(&entry.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := BuildManifestFromTar(&buf)
+	if err != nil {
+		t.Fatalf("error building manifest from tar: %v", err)
+	}
+
+	if len(m.Resources) != 3 {
+		t.Fatalf("unexpected resources: %v", m.Resources)
+	}
+
+	dev, ok := m.Resources[0].(Device)
+	if !ok || dev.Path() != "/dev/null" || dev.Major() != 1 || dev.Minor() != 3 {
+		t.Fatalf("unexpected device: %#v", m.Resources[0])
+	}
+	if dev.Mode() != os.ModeDevice|os.ModeCharDevice|0o666 {
+		t.Fatalf("unexpected device mode: %v", dev.Mode())
+	}
+
+	passwd, ok := m.Resources[1].(RegularFile)
+	if !ok || passwd.Path() != "/etc/passwd" {
+		t.Fatalf("unexpected resource: %#v", m.Resources[1])
+	}
+	if string(passwd.XAttrs()["user.test"]) != "value" {
+		t.Fatalf("unexpected xattrs: %v", passwd.XAttrs())
+	}
+	if passwd.Digests()[0] != digest.FromString("root:x:0:0::/root:/bin/sh\n") {
+		t.Fatalf("unexpected digests: %v", passwd.Digests())
+	}
+
+	replaced := m.Resources[2].(RegularFile)
+	if replaced.Mode() != 0o644 || replaced.Digests()[0] != digest.FromString("new") {
+		t.Fatalf("later entry did not replace earlier entry: %v %v", replaced.Mode(), replaced.Digests())
+	}
+}
+
+func TestBuildManifestFromTarCompression(t *testing.T) {
+	_, err := BuildManifestFromTar(bytes.NewReader([]byte("BZh91AY&SY")))
+	if !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected bzip2 archives to be unsupported, got %v", err)
+	}
+}
+
+// writeTestTar returns a tar archive of the tree at root, recording
+// hardlinks as link entries.
+func writeTestTar(t *testing.T, root string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	inodes := map[uint64]string{}
+
+	if err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		st := fi.Sys().(*syscall.Stat_t)
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := inodes[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				inodes[st.Ino] = name
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatalf("error writing tar: %v", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
@@ -22,6 +22,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
 )
 
 func tree(w io.Writer, dir string) error {
@@ -70,3 +73,31 @@ func _tree(w io.Writer, dir string, indent string) error {
 	}
 	return nil
 }
+
+// formatTestManifest returns a manifest with binary xattrs.
+func formatTestManifest(t *testing.T) *Manifest {
+	t.Helper()
+
+	dir, err := newDirectory(resource{paths: []string{"/a"}, mode: os.ModeDir | 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := newRegularFile(resource{
+		paths:  []string{"/a/b"},
+		mode:   0o644,
+		uid:    1000,
+		gid:    1000,
+		xattrs: map[string][]byte{"security.capability": {0x01, 0x00, 0x00, 0x02, 0xff}},
+	}, []string{"/a/b", "/a/c"}, 3, digest.FromString("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := newSymLink(resource{paths: []string{"/d"}, mode: os.ModeSymlink | 0o777}, "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Manifest{Resources: []Resource{dir, rf, link}}
+}
@@ -0,0 +1,35 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// statTimes returns the access time from fi. Windows does not expose an inode
+// change time, so ctime is always zero.
+func statTimes(fi os.FileInfo) (atime, ctime time.Time, err error) {
+	sys, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to resolve syscall.Win32FileAttributeData from (os.FileInfo).Sys(): %#v", fi)
+	}
+
+	return time.Unix(0, sys.LastAccessTime.Nanoseconds()), time.Time{}, nil
+}
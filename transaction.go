@@ -0,0 +1,526 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/continuity/devices"
+	"github.com/opencontainers/go-digest"
+)
+
+// transactionContext is implemented by contexts which support transactional
+// apply.
+type transactionContext interface {
+	planContext
+	beginTransaction() (*transaction, error)
+}
+
+// applyManifestTransaction applies the manifest to the context such that
+// either all changes are made or none are. All content required from the
+// ContentProvider is staged before the context is modified. Entries are then
+// changed in manifest order, moving replaced entries aside and recording the
+// metadata of modified entries, so that a failure can be rolled back.
+//
+// The staged content and replaced entries are kept in a hidden directory
+// within the context root, named ".continuity-" followed by a random suffix,
+// which is removed once the transaction completes. If the process is
+// interrupted, this directory is left behind, holding the original entries
+// moved aside, numbered in the order they were moved. Walk skips such
+// directories, so that they are neither recorded nor verified, and they are
+// never pruned or removed. Once the root has been checked, or its entries
+// restored from the directory by hand, the directory can be removed.
+func applyManifestTransaction(fsContext Context, manifest *Manifest, opts ApplyOptions) (err error) {
+	tc, ok := fsContext.(transactionContext)
+	if !ok {
+		return fmt.Errorf("transactional apply is not supported by the context: %w", ErrNotSupported)
+	}
+
+	planner, err := newManifestPlanner(fsContext, opts)
+	if err != nil {
+		return err
+	}
+
+	plans := make([][]Operation, len(manifest.Resources))
+	for i, rsrc := range manifest.Resources {
+		n := len(planner.operations)
+		if err := planner.plan(rsrc); err != nil {
+			return err
+		}
+		plans[i] = planner.operations[n:]
+	}
+
+	n := len(planner.operations)
+	operations, err := planner.finish()
+	if err != nil {
+		return err
+	}
+	removals := operations[n:]
+
+	tx, err := tc.beginTransaction()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if rerr := tx.rollback(); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("error rolling back: %w", rerr))
+		}
+	}()
+
+	// Stage content first, so that a failure to provide content leaves the
+	// context untouched.
+	for i, rsrc := range manifest.Resources {
+		rf, ok := rsrc.(RegularFile)
+		if !ok || !needsContent(plans[i]) {
+			continue
+		}
+
+		if err := tx.stage(rf); err != nil {
+			return fmt.Errorf("error staging %q: %w", rsrc.Path(), err)
+		}
+	}
+
+	var deferred []Resource
+	for i, rsrc := range manifest.Resources {
+		if isDeferredDirectory(rsrc) {
+			deferred = append(deferred, asDirectory(rsrc))
+			rsrc = withoutInodeFlags(rsrc)
+		}
+
+		if len(plans[i]) == 0 {
+			continue
+		}
+
+		if err := tx.apply(rsrc, opts.Prune); err != nil {
+			return err
+		}
+	}
+
+	removed := map[string]struct{}{}
+	for _, op := range removals {
+		removed[op.Path] = struct{}{}
+	}
+	for _, op := range removals {
+		if _, ok := removed[path.Dir(op.Path)]; ok {
+			// moved aside with the parent.
+			continue
+		}
+
+		if err := tx.remove(op.Path); err != nil {
+			return fmt.Errorf("error pruning %q: %w", op.Path, err)
+		}
+	}
+
+	for i := len(deferred) - 1; i >= 0; i-- {
+		if err := tx.apply(deferred[i], false); err != nil {
+			return err
+		}
+	}
+
+	return tx.commit()
+}
+
+// needsContent returns true if the operations read content from the
+// ContentProvider.
+func needsContent(operations []Operation) bool {
+	for _, op := range operations {
+		if op.Kind == OperationCreateFile || op.Kind == OperationRewriteFile {
+			return true
+		}
+	}
+	return false
+}
+
+// transactionDirPrefix starts the name of the directory of a transaction,
+// within the context root.
+const transactionDirPrefix = ".continuity-"
+
+// isTransactionDir returns true if the entry at fp, described by fi, is the
+// directory of a transaction within root. After an interruption, it holds
+// the original entries.
+func isTransactionDir(root, fp string, fi os.FileInfo) bool {
+	return fi.IsDir() && filepath.Dir(fp) == root && strings.HasPrefix(fi.Name(), transactionDirPrefix)
+}
+
+type journalKind int
+
+const (
+	// journalCreated records an entry created by the transaction.
+	journalCreated journalKind = iota
+
+	// journalMoved records an existing entry moved aside.
+	journalMoved
+
+	// journalMetadata records the metadata of an existing entry.
+	journalMetadata
+)
+
+type journalEntry struct {
+	kind journalKind
+
+	// fp is the full path of the entry.
+	fp string
+
+	// backup is where a moved entry was moved to.
+	backup string
+
+	// metadata is a snapshot of the entry before it was modified.
+	metadata Resource
+}
+
+// transaction stages content for and journals changes made to a context so
+// that they can be rolled back.
+type transaction struct {
+	// c applies resources using the staged content.
+	c *context
+
+	// provider is the context's original content provider.
+	provider ContentProvider
+
+	// dir holds the staged content and the entries moved aside.
+	dir string
+
+	staged  map[digest.Digest]string
+	journal []journalEntry
+
+	// recorded holds the full paths of entries already journaled.
+	recorded map[string]struct{}
+
+	n int
+}
+
+func (c *context) beginTransaction() (*transaction, error) {
+	// Staging within the root keeps the entries moved aside on the same
+	// filesystem, and does not require the parent of the root to be
+	// writable. The times of the root are kept.
+	fi, err := c.driver.Lstat(c.root)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(c.root, transactionDirPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error creating transaction directory in %q: %w", c.root, err)
+	}
+
+	if err := c.restoreTimes(c.root, fi); err != nil {
+		return nil, errors.Join(err, os.RemoveAll(dir))
+	}
+
+	tx := &transaction{
+		provider: c.provider,
+		dir:      dir,
+		staged:   map[digest.Digest]string{},
+		recorded: map[string]struct{}{},
+	}
+
+	// The transaction provides the staged content when applying.
+	tc := *c
+	tc.provider = tx
+	tx.c = &tc
+
+	return tx, nil
+}
+
+// next returns a new path in the transaction directory.
+func (tx *transaction) next() string {
+	tx.n++
+	return filepath.Join(tx.dir, strconv.Itoa(tx.n))
+}
+
+// stage copies the content of the regular file from the context's provider
+// into the transaction, verifying it against the digest provided.
+func (tx *transaction) stage(rf RegularFile) error {
+	for _, dgst := range rf.Digests() {
+		if _, ok := tx.staged[dgst]; ok {
+			return nil
+		}
+	}
+
+	if tx.provider == nil {
+		return fmt.Errorf("no file provider")
+	}
+
+	var (
+		r    io.ReadCloser
+		dgst digest.Digest
+		err  error
+	)
+	for _, dgst = range rf.Digests() {
+		r, err = tx.provider.Reader(dgst)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("file content could not be provided: %w", err)
+	}
+	defer r.Close()
+
+	verifier := dgst.Verifier()
+	fp := tx.next()
+	if err := atomicWriteFile(fp, io.TeeReader(r, verifier), rf.Size(), 0o600); err != nil {
+		return err
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("content provided for %v does not match", dgst)
+	}
+
+	for _, dgst := range rf.Digests() {
+		tx.staged[dgst] = fp
+	}
+
+	return nil
+}
+
+// Reader provides the staged content for dgst.
+func (tx *transaction) Reader(dgst digest.Digest) (io.ReadCloser, error) {
+	fp, ok := tx.staged[dgst]
+	if !ok {
+		return nil, fmt.Errorf("content %v was not staged: %w", dgst, ErrNotFound)
+	}
+
+	return os.Open(fp)
+}
+
+// apply applies the resource, journaling the entry affected by each
+// operation before it is run.
+func (tx *transaction) apply(rsrc Resource, exact bool) error {
+	return tx.c.applyOperations(rsrc, exact, tx.record)
+}
+
+// remove moves the entry at p aside.
+func (tx *transaction) remove(p string) error {
+	return tx.record(Operation{Kind: OperationRemove, Path: p})
+}
+
+// record journals the entry affected by op, so that it can be restored.
+// Entries replaced by op are moved aside.
+func (tx *transaction) record(op Operation) error {
+	fp, err := tx.c.fullpath(op.Path)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := tx.recorded[fp]; ok && !replaces(op.Kind) {
+		return nil
+	}
+
+	fi, err := tx.c.lstat(fp)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		fi = nil
+	}
+
+	if fi != nil && replaces(op.Kind) {
+		if err := tx.recordParent(op.Path); err != nil {
+			return err
+		}
+
+		backup := tx.next()
+		if err := os.Rename(fp, backup); err != nil {
+			return err
+		}
+
+		tx.journal = append(tx.journal, journalEntry{kind: journalMoved, fp: fp, backup: backup})
+		tx.recorded[fp] = struct{}{}
+		return nil
+	}
+
+	if _, ok := tx.recorded[fp]; ok {
+		return nil
+	}
+
+	if fi == nil {
+		if err := tx.recordParent(op.Path); err != nil {
+			return err
+		}
+
+		tx.journal = append(tx.journal, journalEntry{kind: journalCreated, fp: fp})
+		tx.recorded[fp] = struct{}{}
+		return nil
+	}
+
+	metadata, err := tx.c.snapshot(op.Path, fp, fi)
+	if err != nil {
+		return err
+	}
+
+	tx.journal = append(tx.journal, journalEntry{kind: journalMetadata, fp: fp, metadata: metadata})
+	tx.recorded[fp] = struct{}{}
+	return nil
+}
+
+// recordParent journals the metadata of the parent of p, which changes when
+// entries are created or removed.
+func (tx *transaction) recordParent(p string) error {
+	if p == "/" {
+		return nil
+	}
+
+	return tx.record(Operation{Kind: OperationChtimes, Path: path.Dir(p)})
+}
+
+// replaces returns true if an operation of kind replaces an existing entry.
+func replaces(kind OperationKind) bool {
+	switch kind {
+	case OperationRewriteFile, OperationReplaceSymlink, OperationRemove, OperationMknod, OperationLink:
+		return true
+	}
+	return false
+}
+
+// commit completes the transaction, removing the staged content and the
+// entries moved aside.
+func (tx *transaction) commit() error {
+	return tx.removeDir()
+}
+
+// removeDir removes the transaction directory, keeping the times of the
+// root.
+func (tx *transaction) removeDir() error {
+	fi, err := tx.c.driver.Lstat(tx.c.root)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(tx.dir); err != nil {
+		return err
+	}
+
+	return tx.c.restoreTimes(tx.c.root, fi)
+}
+
+// rollback undoes the journaled changes, in reverse order.
+func (tx *transaction) rollback() error {
+	var errs []error
+
+	// Entries made immutable or append-only cannot be restored or removed.
+	for i := len(tx.journal) - 1; i >= 0; i-- {
+		fp := tx.journal[i].fp
+		if fi, err := tx.c.driver.Lstat(fp); err == nil {
+			if err := tx.c.unlockInodeFlags(fp, fi); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for i := len(tx.journal) - 1; i >= 0; i-- {
+		entry := tx.journal[i]
+		switch entry.kind {
+		case journalCreated:
+			if err := os.RemoveAll(entry.fp); err != nil {
+				errs = append(errs, err)
+			}
+		case journalMoved:
+			if err := os.RemoveAll(entry.fp); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if err := os.Rename(entry.backup, entry.fp); err != nil {
+				errs = append(errs, err)
+			}
+		case journalMetadata:
+			if err := tx.c.applyMetadata(entry.fp, entry.metadata, true); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		// keep the entries moved aside, they may not have been restored.
+		return errors.Join(errs...)
+	}
+
+	return tx.removeDir()
+}
+
+// restoreTimes sets the access and modification times of the entry at fp to
+// those of fi, where the driver supports it.
+func (c *context) restoreTimes(fp string, fi os.FileInfo) error {
+	atime, _, err := statTimes(fi)
+	if err != nil {
+		return err
+	}
+
+	err = c.applyTimes(fp, &resource{mtime: fi.ModTime(), atime: atime})
+	if errors.Is(err, ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// snapshot returns a resource holding the metadata of the entry at fp,
+// including its times, without reading its content.
+func (c *context) snapshot(p, fp string, fi os.FileInfo) (Resource, error) {
+	base, err := c.baseResource(p, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	base.xattrs, err = c.resolveXAttrs(fp, fi, base)
+	if err != nil && !errors.Is(err, ErrNotSupported) {
+		return nil, err
+	}
+
+	base.flags, err = c.resolveInodeFlags(fp, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	base.mtime = fi.ModTime()
+	base.atime, _, err = statTimes(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		return newRegularFile(*base, base.paths, fi.Size())
+	case fi.Mode().IsDir():
+		return newDirectory(*base)
+	case fi.Mode()&os.ModeSymlink != 0:
+		return newSymLink(*base, "")
+	case fi.Mode()&os.ModeNamedPipe != 0:
+		return newNamedPipe(*base, base.paths)
+	case fi.Mode()&os.ModeSocket != 0:
+		return newSocket(*base, base.paths)
+	case fi.Mode()&os.ModeDevice != 0:
+		// the device numbers are recorded in rootless mode.
+		major, minor, err := devices.DeviceInfo(fi)
+		if err != nil {
+			return nil, err
+		}
+		return newDevice(*base, base.paths, major, minor)
+	}
+
+	return nil, fmt.Errorf("%q (%v) is not supported: %w", fp, fi.Mode(), ErrNotFound)
+}
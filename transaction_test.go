@@ -0,0 +1,342 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// testProvider provides content from memory.
+type testProvider map[digest.Digest][]byte
+
+func (tp testProvider) Reader(dgst digest.Digest) (io.ReadCloser, error) {
+	p, ok := tp[dgst]
+	if !ok {
+		return nil, fmt.Errorf("content %v: %w", dgst, ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(p)), nil
+}
+
+func TestApplyManifestTransactional(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind: rdirectory,
+			path: "b",
+			mode: 0o755,
+		},
+		{
+			path: "b/c",
+			mode: 0o644,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "b/l",
+			target: "c",
+		},
+		{
+			path: "z",
+			mode: 0o644,
+		},
+	})
+
+	provider := testProvider{}
+	for _, p := range []string{"a", "b/c", "z"} {
+		content, err := os.ReadFile(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider[digest.FromBytes(content)] = content
+	}
+
+	fsContext, err := NewContextWithOptions(root, ContextOptions{Provider: provider})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	// modify the root.
+	if err := os.Chmod(filepath.Join(root, "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b/c"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "b/l")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "x/y"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot the modified root, including modification times.
+	timedContext, err := NewContextWithOptions(root, ContextOptions{Timestamps: TimestampModify})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+	snapshot := func() *Manifest {
+		t.Helper()
+		m, err := BuildManifest(timedContext)
+		if err != nil {
+			t.Fatalf("error building manifest: %v", err)
+		}
+		return m
+	}
+	before := snapshot()
+
+	checkUnchanged := func() {
+		t.Helper()
+		if after := snapshot(); !reflect.DeepEqual(after, before) {
+			t.Fatalf("root changed after failed apply:\n%v\n!=\n%v", after.Resources, before.Resources)
+		}
+
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if strings.Contains(entry.Name(), ".continuity-") {
+				t.Fatalf("transaction directory %q was not removed", entry.Name())
+			}
+		}
+	}
+
+	// the transaction does not require the parent to be writable.
+	if err := os.Chmod(parent, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(parent, 0o755) })
+
+	opts := ApplyOptions{Prune: true, Transactional: true}
+
+	// content which cannot be provided fails before the root is modified.
+	var missing digest.Digest
+	for _, rsrc := range m.Resources {
+		if rsrc.Path() == "/b/c" {
+			missing = rsrc.(RegularFile).Digests()[0]
+		}
+	}
+	content := provider[missing]
+	delete(provider, missing)
+
+	if err := ApplyManifestWithOptions(fsContext, m, opts); err == nil {
+		t.Fatal("expected apply to fail with missing content")
+	}
+	checkUnchanged()
+	provider[missing] = content
+
+	// a failure after the root has been modified is rolled back.
+	last := m.Resources[len(m.Resources)-1].(*regularFile)
+	last.xattrs = map[string][]byte{"invalid.xattr": []byte("1")}
+
+	if err := ApplyManifestWithOptions(fsContext, m, opts); err == nil {
+		t.Fatal("expected apply to fail setting an invalid xattr")
+	}
+	checkUnchanged()
+	last.xattrs = nil
+
+	if err := ApplyManifestWithOptions(fsContext, m, opts); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+
+	report, err := VerifyManifestReport(fsContext, m)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected mismatches after apply: %v", report.Err())
+	}
+}
+
+func TestApplyManifestTransactionalHardlinks(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			kind:   rhardlink,
+			path:   "a-hardlink",
+			target: "a",
+		},
+		{
+			path: "z",
+			mode: 0o644,
+		},
+	})
+
+	provider := testProvider{}
+	for _, p := range []string{"a", "z"} {
+		content, err := os.ReadFile(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider[digest.FromBytes(content)] = content
+	}
+
+	fsContext, err := NewContextWithOptions(root, ContextOptions{Provider: provider})
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	// change the content of the hardlink group, of the same size.
+	fi, err := os.Stat(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Repeat([]byte("x"), int(fi.Size()))
+	if err := os.WriteFile(filepath.Join(root, "a"), changed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// fail after the hardlink group has been rewritten.
+	last := m.Resources[len(m.Resources)-1].(*regularFile)
+	last.xattrs = map[string][]byte{"invalid.xattr": []byte("1")}
+
+	if err := ApplyManifestWithOptions(fsContext, m, ApplyOptions{Transactional: true}); err == nil {
+		t.Fatal("expected apply to fail setting an invalid xattr")
+	}
+
+	a, err := os.Stat(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a", "a-hardlink"} {
+		content, err := os.ReadFile(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, changed) {
+			t.Fatalf("content of %q was not restored: %q", p, content)
+		}
+	}
+
+	l, err := os.Stat(filepath.Join(root, "a-hardlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, l) {
+		t.Fatal("hardlink was not restored")
+	}
+}
+
+func TestApplyManifestInterruptedTransaction(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+	})
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	// an interrupted transaction leaves the entries moved aside.
+	dir := filepath.Join(root, ".continuity-123")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1"), []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+	if changes := DiffManifests(m, rebuilt); len(changes) != 0 {
+		t.Fatalf("transaction directory was recorded: %v", changes)
+	}
+
+	report, err := VerifyManifestReport(fsContext, m)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected mismatches: %v", report.Err())
+	}
+
+	if err := ApplyManifestWithOptions(fsContext, m, ApplyOptions{Prune: true}); err != nil {
+		t.Fatalf("error applying manifest: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1")); err != nil {
+		t.Fatalf("transaction directory was pruned: %v", err)
+	}
+
+	link, err := newSymLink(resource{
+		paths: []string{"/.continuity-123"},
+		mode:  os.ModeSymlink | 0o777,
+		uid:   int64(os.Getuid()),
+		gid:   int64(os.Getgid()),
+	}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced := &Manifest{Resources: []Resource{link}}
+	if err := ApplyManifestWithOptions(fsContext, replaced, ApplyOptions{Prune: true}); err == nil {
+		t.Fatal("expected the transaction directory not to be replaced")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1")); err != nil {
+		t.Fatalf("transaction directory was replaced: %v", err)
+	}
+
+	whiteout := &Manifest{Resources: []Resource{newWhiteout("/.continuity-123")}}
+	if err := ApplyManifest(fsContext, whiteout); err == nil {
+		t.Fatal("expected the transaction directory not to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1")); err != nil {
+		t.Fatalf("transaction directory was removed: %v", err)
+	}
+}
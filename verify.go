@@ -0,0 +1,350 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MismatchKind identifies the kind of discrepancy found between a manifest
+// and the filesystem.
+type MismatchKind int
+
+const (
+	// MismatchMissing indicates a resource in the manifest is not present
+	// on the filesystem.
+	MismatchMissing MismatchKind = iota + 1
+
+	// MismatchExtra indicates a path on the filesystem is not present in the
+	// manifest.
+	MismatchExtra
+
+	// MismatchType indicates the file type differs.
+	MismatchType
+
+	// MismatchMode indicates the file mode differs.
+	MismatchMode
+
+	// MismatchUID indicates the owning user differs.
+	MismatchUID
+
+	// MismatchGID indicates the owning group differs.
+	MismatchGID
+
+	// MismatchSize indicates the size of a regular file differs.
+	MismatchSize
+
+	// MismatchDigest indicates the content of a regular file differs.
+	MismatchDigest
+
+	// MismatchXAttr indicates an extended attribute is missing or differs.
+	MismatchXAttr
+
+	// MismatchTarget indicates the target of a symlink differs.
+	MismatchTarget
+
+	// MismatchDevice indicates the major or minor numbers of a device differ.
+	MismatchDevice
+
+	// MismatchHardlink indicates a path is not linked to the resource it
+	// should be linked to.
+	MismatchHardlink
+
+	// MismatchTime indicates a recorded file time differs.
+	MismatchTime
+
+	// MismatchFlags indicates the inode flags differ.
+	MismatchFlags
+)
+
+var mismatchKindNames = map[MismatchKind]string{
+	MismatchMissing:  "missing",
+	MismatchExtra:    "extra",
+	MismatchType:     "type",
+	MismatchMode:     "mode",
+	MismatchUID:      "uid",
+	MismatchGID:      "gid",
+	MismatchSize:     "size",
+	MismatchDigest:   "digest",
+	MismatchXAttr:    "xattr",
+	MismatchTarget:   "target",
+	MismatchDevice:   "device",
+	MismatchHardlink: "hardlink",
+	MismatchTime:     "time",
+	MismatchFlags:    "flags",
+}
+
+func (k MismatchKind) String() string {
+	if name, ok := mismatchKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("MismatchKind(%d)", int(k))
+}
+
+// Mismatch describes a single discrepancy between a resource and the
+// filesystem. It is returned as an error from Context.Verify.
+type Mismatch struct {
+	Kind MismatchKind
+
+	// Path is the path of the resource, relative to the context root.
+	Path string
+
+	// Name qualifies the mismatch, such as the name of an xattr or the
+	// time ("mtime", "atime", "ctime") that differs.
+	Name string
+
+	// Expected is the value recorded in the manifest and Actual is the value
+	// found on the filesystem. Either may be nil when not applicable.
+	Expected, Actual interface{}
+}
+
+func (m *Mismatch) Error() string {
+	switch m.Kind {
+	case MismatchMissing:
+		return fmt.Sprintf("resource %q is missing", m.Path)
+	case MismatchExtra:
+		return fmt.Sprintf("resource %q is not in the manifest", m.Path)
+	case MismatchXAttr:
+		if m.Actual == nil {
+			return fmt.Sprintf("resource %q target missing xattr %q", m.Path, m.Name)
+		}
+		return fmt.Sprintf("xattr %q value differs for resource %q", m.Name, m.Path)
+	case MismatchDigest:
+		return fmt.Sprintf("digests for resource %q do not match: %v != %v", m.Path, m.Actual, m.Expected)
+	case MismatchHardlink:
+		return fmt.Sprintf("%q is not a hardlink to %q", m.Path, m.Expected)
+	case MismatchTime:
+		return fmt.Sprintf("resource %q has mismatched %s: %v != %v", m.Path, m.Name, m.Actual, m.Expected)
+	default:
+		return fmt.Sprintf("resource %q has incorrect %v: %v != %v", m.Path, m.Kind, m.Actual, m.Expected)
+	}
+}
+
+// joinMismatches returns the mismatches as a single error, or nil if there
+// are none.
+func joinMismatches(mismatches []*Mismatch) error {
+	switch len(mismatches) {
+	case 0:
+		return nil
+	case 1:
+		return mismatches[0]
+	}
+
+	errs := make([]error, len(mismatches))
+	for i, m := range mismatches {
+		errs[i] = m
+	}
+	return errors.Join(errs...)
+}
+
+// mismatchesOf extracts the mismatches reported by err. A file that could
+// not be found is reported as missing. If err contains anything other than
+// mismatches, ok is false.
+func mismatchesOf(p string, err error) (mismatches []*Mismatch, ok bool) {
+	var m *Mismatch
+	if joined, isJoined := err.(interface{ Unwrap() []error }); isJoined {
+		for _, err := range joined.Unwrap() {
+			if !errors.As(err, &m) {
+				return nil, false
+			}
+			mismatches = append(mismatches, m)
+		}
+		return mismatches, true
+	}
+
+	if errors.As(err, &m) {
+		return []*Mismatch{m}, true
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Mismatch{{Kind: MismatchMissing, Path: p}}, true
+	}
+
+	return nil, false
+}
+
+// VerifyReport collects every discrepancy found when verifying a manifest
+// against a filesystem.
+type VerifyReport struct {
+	// Mismatches holds all discrepancies, sorted by path.
+	Mismatches []*Mismatch
+}
+
+// OK returns true if no discrepancies were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// ByKind groups the mismatches by kind.
+func (r *VerifyReport) ByKind() map[MismatchKind][]*Mismatch {
+	groups := map[MismatchKind][]*Mismatch{}
+	for _, m := range r.Mismatches {
+		groups[m.Kind] = append(groups[m.Kind], m)
+	}
+	return groups
+}
+
+// Err returns the mismatches as a single error, or nil if there are none.
+func (r *VerifyReport) Err() error {
+	return joinMismatches(r.Mismatches)
+}
+
+// VerifyManifestReport verifies all resources in the manifest against the
+// given context, reporting every discrepancy rather than stopping at the
+// first. Paths in the context which are not part of the manifest are
+// reported as extra. An error is returned only if verification could not be
+// carried out.
+func VerifyManifestReport(fsContext Context, manifest *Manifest) (*VerifyReport, error) {
+	return VerifyManifestReportWithOptions(fsContext, manifest, VerifyOptions{})
+}
+
+// VerifyOptions configures how a manifest is verified.
+type VerifyOptions struct {
+	// Filter selects the paths to verify. Resources which are not selected
+	// are ignored and paths of the context which are not selected are not
+	// reported as extra.
+	Filter *Filter
+}
+
+// VerifyManifestReportWithOptions is like VerifyManifestReport, verifying
+// only the paths selected by the options.
+func VerifyManifestReportWithOptions(fsContext Context, manifest *Manifest, opts VerifyOptions) (*VerifyReport, error) {
+	v := newReportVerifier(fsContext, opts.Filter)
+	verify := filterResources(opts.Filter, v.verify)
+	for _, rsrc := range manifest.Resources {
+		if err := verify(rsrc); err != nil {
+			return nil, err
+		}
+	}
+
+	return v.report()
+}
+
+// VerifyManifestStreamReport is like VerifyManifestReport but reads the
+// resources from r.
+func VerifyManifestStreamReport(fsContext Context, r *ManifestReader) (*VerifyReport, error) {
+	return VerifyManifestStreamReportWithOptions(fsContext, r, VerifyOptions{})
+}
+
+// VerifyManifestStreamReportWithOptions is like
+// VerifyManifestReportWithOptions but reads the resources from r. The paths
+// of all resources are kept in memory to find the extra paths in the context.
+func VerifyManifestStreamReportWithOptions(fsContext Context, r *ManifestReader, opts VerifyOptions) (*VerifyReport, error) {
+	v := newReportVerifier(fsContext, opts.Filter)
+	verify := filterResources(opts.Filter, v.verify)
+	for {
+		rsrc, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		if err := verify(rsrc); err != nil {
+			return nil, err
+		}
+	}
+
+	return v.report()
+}
+
+// reportVerifier collects the mismatches of resources against a context.
+type reportVerifier struct {
+	fsContext Context
+	filter    *Filter
+
+	// paths holds the paths of all resources verified, which the report
+	// needs to find extra paths, so memory grows with the manifest.
+	paths map[string]struct{}
+
+	mismatches []*Mismatch
+}
+
+func newReportVerifier(fsContext Context, filter *Filter) *reportVerifier {
+	return &reportVerifier{
+		fsContext: fsContext,
+		filter:    filter,
+		paths:     map[string]struct{}{},
+	}
+}
+
+func (v *reportVerifier) verify(rsrc Resource) error {
+	for _, p := range resourcePaths(rsrc) {
+		v.paths[p] = struct{}{}
+	}
+
+	err := v.fsContext.Verify(rsrc)
+	if err == nil {
+		return nil
+	}
+
+	mismatches, ok := mismatchesOf(rsrc.Path(), err)
+	if !ok {
+		return err
+	}
+	v.mismatches = append(v.mismatches, mismatches...)
+
+	return nil
+}
+
+// report walks the context for paths not in the manifest and returns the
+// collected mismatches. Only the top-most extra path is reported for an
+// extra directory.
+func (v *reportVerifier) report() (*VerifyReport, error) {
+	if err := v.fsContext.Walk(func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking %s: %w", p, err)
+		}
+
+		if p == string(os.PathSeparator) {
+			// skip root
+			return nil
+		}
+
+		if _, ok := v.paths[p]; ok {
+			return nil
+		}
+
+		if !v.filter.Match(p, fi.IsDir()) {
+			if fi.IsDir() && !v.filter.mayHold(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		v.mismatches = append(v.mismatches, &Mismatch{Kind: MismatchExtra, Path: p})
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(v.mismatches, func(i, j int) bool {
+		return v.mismatches[i].Path < v.mismatches[j].Path
+	})
+
+	return &VerifyReport{Mismatches: v.mismatches}, nil
+}
@@ -0,0 +1,159 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyManifestReport(t *testing.T) {
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			path: "a",
+			mode: 0o644,
+		},
+		{
+			path: "b",
+			mode: 0o644,
+		},
+		{
+			kind:   rhardlink,
+			path:   "b-link",
+			target: "b",
+		},
+		{
+			kind: rdirectory,
+			path: "c",
+			mode: 0o755,
+		},
+		{
+			path: "c/d",
+			mode: 0o644,
+		},
+		{
+			kind:   rrelsymlink,
+			path:   "c/e",
+			target: "d",
+		},
+	})
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	report, err := VerifyManifestReport(ctx, m)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected mismatches: %v", report.Err())
+	}
+
+	// mode and content of a, keeping the size the same.
+	if err := os.Chmod(filepath.Join(root, "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := os.ReadFile(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) == 0 {
+		p = []byte{0}
+	}
+	p[0]++
+	if err := os.WriteFile(filepath.Join(root, "a"), p, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// break the hardlink, then remove a file and retarget a symlink.
+	if err := os.Remove(filepath.Join(root, "b-link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "c/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "c/e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("f", filepath.Join(root, "c/e")); err != nil {
+		t.Fatal(err)
+	}
+
+	// extra files, only the top-most path of an extra directory is reported.
+	if err := os.WriteFile(filepath.Join(root, "x"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "y/z"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = VerifyManifestReport(ctx, m)
+	if err != nil {
+		t.Fatalf("error verifying manifest: %v", err)
+	}
+
+	type mismatch struct {
+		kind MismatchKind
+		path string
+	}
+
+	var actual []mismatch
+	for _, m := range report.Mismatches {
+		actual = append(actual, mismatch{m.Kind, m.Path})
+	}
+
+	expected := []mismatch{
+		{MismatchMode, "/a"},
+		{MismatchDigest, "/a"},
+		{MismatchMissing, "/b-link"},
+		{MismatchMissing, "/c/d"},
+		{MismatchTarget, "/c/e"},
+		{MismatchExtra, "/x"},
+		{MismatchExtra, "/y"},
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("unexpected mismatches:\n%v\n!=\n%v", actual, expected)
+	}
+
+	if n := len(report.ByKind()[MismatchExtra]); n != 2 {
+		t.Fatalf("expected 2 extra paths, got %d", n)
+	}
+
+	// Verify reports all mismatches for a single resource.
+	err = ctx.Verify(m.Resources[0])
+	var mm *Mismatch
+	if !errors.As(err, &mm) || mm.Kind != MismatchMode {
+		t.Fatalf("expected mode mismatch from verify, got %v", err)
+	}
+	if mismatches, ok := mismatchesOf("/a", err); !ok || len(mismatches) != 2 {
+		t.Fatalf("expected two mismatches from verify, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+)
+
+const (
+	// whiteoutPrefix marks a file of an OCI image layer which removes the
+	// path named by the rest of its name from the layers below.
+	//
+	// See https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaqueDir marks a directory of an OCI image layer which hides
+	// the entries of the directory in the layers below.
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// overlayOpaqueXAttrs are the xattrs marking opaque directories in the upper
+// directory of an overlay filesystem. The user namespace is used by
+// unprivileged mounts.
+var overlayOpaqueXAttrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// overlayResolver returns a function resolving resources like resolve, but
+// reading the context as the upper directory of an overlay filesystem.
+// Character devices with device number 0/0 are resolved as whiteouts and
+// directories with an opaque xattr set to "y" as opaque directories, without
+// the xattr.
+//
+// See https://www.kernel.org/doc/Documentation/filesystems/overlayfs.txt
+func overlayResolver(resolve func(p string, fi os.FileInfo) (Resource, error)) func(p string, fi os.FileInfo) (Resource, error) {
+	return func(p string, fi os.FileInfo) (Resource, error) {
+		rsrc, err := resolve(p, fi)
+		if err != nil {
+			return nil, err
+		}
+
+		switch r := rsrc.(type) {
+		case *device:
+			if r.Mode()&os.ModeCharDevice != 0 && r.major == 0 && r.minor == 0 {
+				return newWhiteout(p), nil
+			}
+		case *directory:
+			opaque := false
+			for _, name := range overlayOpaqueXAttrs {
+				if string(r.xattrs[name]) == "y" {
+					opaque = true
+				}
+			}
+			if !opaque {
+				break
+			}
+
+			base := r.resource
+			base.xattrs = make(map[string][]byte, len(r.xattrs))
+			for name, value := range r.xattrs {
+				base.xattrs[name] = value
+			}
+			for _, name := range overlayOpaqueXAttrs {
+				delete(base.xattrs, name)
+			}
+
+			return newOpaqueDirectory(base)
+		}
+
+		return rsrc, nil
+	}
+}
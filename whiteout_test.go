@@ -0,0 +1,281 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"archive/tar"
+	"bytes"
+	gocontext "context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/continuity/devices"
+	"github.com/containerd/continuity/sysx"
+	"github.com/containerd/continuity/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestBuildManifestOverlay(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	root := t.TempDir()
+	generateTestFiles(t, root, []dresource{
+		{
+			kind: rdirectory,
+			path: "o",
+			mode: 0o755,
+		},
+		{
+			path: "o/a",
+			mode: 0o644,
+		},
+	})
+	if err := devices.Mknod(filepath.Join(root, "gone"), os.ModeDevice|os.ModeCharDevice|0o600, 0, 0); err != nil {
+		t.Fatalf("error creating whiteout: %v", err)
+	}
+	if err := sysx.LSetxattr(filepath.Join(root, "o"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Fatalf("error marking opaque directory: %v", err)
+	}
+
+	fsContext, err := NewContext(root)
+	if err != nil {
+		t.Fatalf("error getting context: %v", err)
+	}
+
+	m, err := BuildManifestWithOptions(gocontext.Background(), fsContext, BuildOptions{Overlay: true})
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
+	if len(m.Resources) != 3 {
+		t.Fatalf("unexpected resources: %v", m.Resources)
+	}
+	if w, ok := m.Resources[0].(Whiteout); !ok || w.Path() != "/gone" {
+		t.Fatalf("expected a whiteout, got %#v", m.Resources[0])
+	}
+	od, ok := m.Resources[1].(OpaqueDirectory)
+	if !ok || od.Path() != "/o" {
+		t.Fatalf("expected an opaque directory, got %#v", m.Resources[1])
+	}
+	if _, ok := od.XAttrs()["trusted.overlay.opaque"]; ok {
+		t.Fatalf("expected the opaque xattr to be dropped: %v", od.XAttrs())
+	}
+
+	plain, err := BuildManifest(fsContext)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+	if _, ok := plain.Resources[0].(Device); !ok {
+		t.Fatalf("expected a device without Overlay, got %#v", plain.Resources[0])
+	}
+
+	// parents of the selected paths are read as part of the overlay too.
+	f, err := NewFilter([]string{"/o/a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered, err := BuildManifestWithOptions(gocontext.Background(), fsContext, BuildOptions{Overlay: true, Filter: f, CacheKeys: true})
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+	if changes := DiffManifests(&Manifest{Resources: m.Resources[1:]}, filtered); len(changes) != 0 {
+		t.Fatalf("unexpected changes of the filtered manifest: %v", changes)
+	}
+}
+
+func TestWhiteoutProto(t *testing.T) {
+	m := &Manifest{Resources: []Resource{
+		newWhiteout("/gone"),
+		&opaqueDirectory{directory: directory{resource: resource{paths: []string{"/o"}, mode: os.ModeDir | 0o755}}},
+	}}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := decoded.Resources[0].(Whiteout); !ok || decoded.Resources[0].Path() != "/gone" {
+		t.Fatalf("unexpected whiteout: %#v", decoded.Resources[0])
+	}
+	if od, ok := decoded.Resources[1].(OpaqueDirectory); !ok || od.Mode() != os.ModeDir|0o755 {
+		t.Fatalf("unexpected opaque directory: %#v", decoded.Resources[1])
+	}
+
+	changes := DiffManifests(m, &Manifest{Resources: []Resource{
+		&directory{resource: resource{paths: []string{"/o"}, mode: os.ModeDir | 0o755}},
+	}})
+	if len(changes) != 2 || changes[0].Kind != ChangeRemoved || !reflect.DeepEqual(changes[1].Fields, []ChangeField{FieldOpaque}) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+}
+
+func TestApplyWhiteouts(t *testing.T) {
+	for _, opts := range []ApplyOptions{{}, {Transactional: true}} {
+		root := t.TempDir()
+		generateTestFiles(t, root, []dresource{
+			{
+				kind: rdirectory,
+				path: "gone",
+				mode: 0o755,
+			},
+			{
+				path: "gone/a",
+				mode: 0o644,
+			},
+			{
+				kind: rdirectory,
+				path: "o",
+				mode: 0o700,
+			},
+			{
+				path: "o/old",
+				mode: 0o644,
+			},
+			{
+				path: "o/new",
+				mode: 0o644,
+			},
+		})
+
+		fsContext, err := NewContext(root)
+		if err != nil {
+			t.Fatalf("error getting context: %v", err)
+		}
+
+		full, err := BuildManifest(fsContext)
+		if err != nil {
+			t.Fatalf("error building manifest: %v", err)
+		}
+		var created Resource
+		for _, rsrc := range full.Resources {
+			if rsrc.Path() == "/o/new" {
+				created = rsrc
+			}
+		}
+
+		layer := &Manifest{Resources: []Resource{
+			newWhiteout("/gone"),
+			newWhiteout("/missing"),
+			&opaqueDirectory{directory: directory{resource: resource{
+				paths: []string{"/o"},
+				mode:  os.ModeDir | 0o755,
+				uid:   int64(os.Getuid()),
+				gid:   int64(os.Getgid()),
+			}}},
+			created,
+		}}
+
+		operations, err := PlanManifest(fsContext, layer, opts)
+		if err != nil {
+			t.Fatalf("error planning manifest: %v", err)
+		}
+		expected := []Operation{
+			{Kind: OperationRemove, Path: "/gone"},
+			{Kind: OperationRemove, Path: "/o/new"},
+			{Kind: OperationRemove, Path: "/o/old"},
+			{Kind: OperationChmod, Path: "/o", Detail: "drwx------ -> drwxr-xr-x"},
+			{Kind: OperationCreateFile, Path: "/o/new"},
+		}
+		if !reflect.DeepEqual(operations[:len(expected)], expected) {
+			t.Fatalf("unexpected operations: %v", operations)
+		}
+
+		tc, err := NewContextWithOptions(root, ContextOptions{Provider: testProviderFrom(t, root, "o/new")})
+		if err != nil {
+			t.Fatalf("error getting context: %v", err)
+		}
+		if err := ApplyManifestWithOptions(tc, layer, opts); err != nil {
+			t.Fatalf("error applying manifest: %v", err)
+		}
+
+		if _, err := os.Lstat(filepath.Join(root, "gone")); !os.IsNotExist(err) {
+			t.Fatalf("expected whited out directory to be removed: %v", err)
+		}
+		entries, err := os.ReadDir(filepath.Join(root, "o"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "new" {
+			t.Fatalf("unexpected entries of opaque directory: %v", entries)
+		}
+
+		report, err := VerifyManifestReport(fsContext, layer)
+		if err != nil {
+			t.Fatalf("error verifying manifest: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("unexpected mismatches: %v", report.Err())
+		}
+	}
+}
+
+// testProviderFrom returns a content provider holding the content of the
+// files at the paths under root.
+func testProviderFrom(t *testing.T, root string, paths ...string) testProvider {
+	t.Helper()
+
+	provider := testProvider{}
+	for _, p := range paths {
+		content, err := os.ReadFile(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider[digest.FromBytes(content)] = content
+	}
+
+	return provider
+}
+
+func TestExportWhiteouts(t *testing.T) {
+	layer := &Manifest{Resources: []Resource{
+		newWhiteout("/a/gone"),
+		&opaqueDirectory{directory: directory{resource: resource{paths: []string{"/o"}, mode: os.ModeDir | 0o755}}},
+	}}
+
+	var buf bytes.Buffer
+	if err := ExportManifest(&buf, layer, nil, ExportOptions{}); err != nil {
+		t.Fatalf("error exporting manifest: %v", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	expected := []string{"a/.wh.gone", "o/", "o/.wh..wh..opq"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected entries: %q != %q", names, expected)
+	}
+}